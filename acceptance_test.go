@@ -134,7 +134,7 @@ func TestAcceptance(t *testing.T) {
 		t.Errorf("Unable to clear consul kv store after backup; %v", err)
 	}
 
-	restore.Runner("/tmp/acceptancetest.tar.gz")
+	restore.Runner("/tmp/acceptancetest.tar.gz", restore.Options{})
 
 	for _, kv := range seedData.Data {
 		//log.Printf("SEED: %v | %v", kv.Key, string(kv.Value))
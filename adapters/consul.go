@@ -1,6 +1,10 @@
 package adapters
 
 import (
+	"fmt"
+	"io"
+	"time"
+
 	consulapi "github.com/hashicorp/consul/api"
 	"github.com/pshima/consul-snapshot/interfaces"
 	"strings"
@@ -20,13 +24,17 @@ func NewConsulAdapter() (interfaces.ConsulClient, error) {
 	return &ConsulAdapter{Client: client}, nil
 }
 
-// ListKeys lists all keys from consul
-func (c *ConsulAdapter) ListKeys() (consulapi.KVPairs, error) {
+// ListKeys lists the keys under a prefix from consul, all keys when the
+// prefix is empty
+func (c *ConsulAdapter) ListKeys(prefix string) (consulapi.KVPairs, error) {
 	listOpt := &consulapi.QueryOptions{
 		AllowStale:        false,
 		RequireConsistent: true,
 	}
-	keys, _, err := c.Client.KV().List("/", listOpt)
+	if prefix == "" {
+		prefix = "/"
+	}
+	keys, _, err := c.Client.KV().List(prefix, listOpt)
 	return keys, err
 }
 
@@ -50,7 +58,7 @@ func (c *ConsulAdapter) ListACLs() ([]*consulapi.ACLEntry, error) {
 	acls, _, err := c.Client.ACL().List(listOpt)
 	if err != nil {
 		// Handle ACL disabled case
-		if strings.Contains(err.Error(), "401 (ACL support disabled)") {
+		if aclDisabled(err) {
 			return []*consulapi.ACLEntry{}, nil
 		}
 		return nil, err
@@ -58,21 +66,469 @@ func (c *ConsulAdapter) ListACLs() ([]*consulapi.ACLEntry, error) {
 	return acls, nil
 }
 
-// PutKV puts a key-value pair in consul
-func (c *ConsulAdapter) PutKV(key string, value []byte) error {
-	p := &consulapi.KVPair{Key: key, Value: value}
+// ListACLTokens lists all ACL tokens from consul including their secrets
+func (c *ConsulAdapter) ListACLTokens() ([]*consulapi.ACLToken, error) {
+	listOpt := &consulapi.QueryOptions{
+		AllowStale:        false,
+		RequireConsistent: true,
+	}
+
+	entries, _, err := c.Client.ACL().TokenList(listOpt)
+	if err != nil {
+		if aclDisabled(err) {
+			return []*consulapi.ACLToken{}, nil
+		}
+		return nil, err
+	}
+
+	// the list endpoint omits secrets, so read every token individually
+	tokens := make([]*consulapi.ACLToken, 0, len(entries))
+	for _, entry := range entries {
+		token, _, err := c.Client.ACL().TokenRead(entry.AccessorID, listOpt)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, nil
+}
+
+// ListACLPolicies lists all ACL policies from consul including their rules
+func (c *ConsulAdapter) ListACLPolicies() ([]*consulapi.ACLPolicy, error) {
+	listOpt := &consulapi.QueryOptions{
+		AllowStale:        false,
+		RequireConsistent: true,
+	}
+
+	entries, _, err := c.Client.ACL().PolicyList(listOpt)
+	if err != nil {
+		if aclDisabled(err) {
+			return []*consulapi.ACLPolicy{}, nil
+		}
+		return nil, err
+	}
+
+	// the list endpoint omits rules, so read every policy individually
+	policies := make([]*consulapi.ACLPolicy, 0, len(entries))
+	for _, entry := range entries {
+		policy, _, err := c.Client.ACL().PolicyRead(entry.ID, listOpt)
+		if err != nil {
+			return nil, err
+		}
+		policies = append(policies, policy)
+	}
+	return policies, nil
+}
+
+// ListACLRoles lists all ACL roles from consul
+func (c *ConsulAdapter) ListACLRoles() ([]*consulapi.ACLRole, error) {
+	listOpt := &consulapi.QueryOptions{
+		AllowStale:        false,
+		RequireConsistent: true,
+	}
+
+	roles, _, err := c.Client.ACL().RoleList(listOpt)
+	if err != nil {
+		if aclDisabled(err) {
+			return []*consulapi.ACLRole{}, nil
+		}
+		return nil, err
+	}
+	return roles, nil
+}
+
+// ListACLAuthMethods lists all ACL auth methods from consul including their config
+func (c *ConsulAdapter) ListACLAuthMethods() ([]*consulapi.ACLAuthMethod, error) {
+	listOpt := &consulapi.QueryOptions{
+		AllowStale:        false,
+		RequireConsistent: true,
+	}
+
+	entries, _, err := c.Client.ACL().AuthMethodList(listOpt)
+	if err != nil {
+		if aclDisabled(err) {
+			return []*consulapi.ACLAuthMethod{}, nil
+		}
+		return nil, err
+	}
+
+	// the list endpoint omits config, so read every auth method individually
+	methods := make([]*consulapi.ACLAuthMethod, 0, len(entries))
+	for _, entry := range entries {
+		method, _, err := c.Client.ACL().AuthMethodRead(entry.Name, listOpt)
+		if err != nil {
+			return nil, err
+		}
+		methods = append(methods, method)
+	}
+	return methods, nil
+}
+
+// ListACLBindingRules lists the binding rules of all ACL auth methods from consul
+func (c *ConsulAdapter) ListACLBindingRules() ([]*consulapi.ACLBindingRule, error) {
+	listOpt := &consulapi.QueryOptions{
+		AllowStale:        false,
+		RequireConsistent: true,
+	}
+
+	rules, _, err := c.Client.ACL().BindingRuleList("", listOpt)
+	if err != nil {
+		if aclDisabled(err) {
+			return []*consulapi.ACLBindingRule{}, nil
+		}
+		return nil, err
+	}
+	return rules, nil
+}
+
+// ListConfigEntries lists all config entries of one kind from consul
+func (c *ConsulAdapter) ListConfigEntries(kind string) ([]consulapi.ConfigEntry, error) {
+	listOpt := &consulapi.QueryOptions{
+		AllowStale:        false,
+		RequireConsistent: true,
+	}
+
+	entries, _, err := c.Client.ConfigEntries().List(kind, listOpt)
+	if err != nil {
+		// older consul versions do not know every kind
+		if strings.Contains(err.Error(), "invalid config entry kind") {
+			return []consulapi.ConfigEntry{}, nil
+		}
+		return nil, err
+	}
+	return entries, nil
+}
+
+// ListIntentions lists all service intentions from consul.  Consul 1.9 and
+// later store intentions as service-intentions config entries, older
+// versions only have the legacy intentions endpoint which is converted to
+// the same shape here.
+func (c *ConsulAdapter) ListIntentions() ([]*consulapi.ServiceIntentionsConfigEntry, error) {
+	listOpt := &consulapi.QueryOptions{
+		AllowStale:        false,
+		RequireConsistent: true,
+	}
+
+	entries, _, err := c.Client.ConfigEntries().List(consulapi.ServiceIntentions, listOpt)
+	if err == nil {
+		intentions := make([]*consulapi.ServiceIntentionsConfigEntry, 0, len(entries))
+		for _, entry := range entries {
+			if ixn, ok := entry.(*consulapi.ServiceIntentionsConfigEntry); ok {
+				intentions = append(intentions, ixn)
+			}
+		}
+		return intentions, nil
+	}
+	if !strings.Contains(err.Error(), "invalid config entry kind") {
+		return nil, err
+	}
+
+	legacy, _, err := c.Client.Connect().Intentions(listOpt)
+	if err != nil {
+		return nil, err
+	}
+	return groupIntentions(legacy), nil
+}
+
+// PutKV puts a key-value pair in consul, including its flags
+func (c *ConsulAdapter) PutKV(kv *consulapi.KVPair) error {
+	p := &consulapi.KVPair{Key: kv.Key, Value: kv.Value, Flags: kv.Flags}
 	_, err := c.Client.KV().Put(p, nil)
 	return err
 }
 
+// CASKV writes a key only if its ModifyIndex still matches kv.ModifyIndex,
+// an index of 0 only creates the key.  It returns false when the key was
+// changed by someone else.
+func (c *ConsulAdapter) CASKV(kv *consulapi.KVPair) (bool, error) {
+	ok, _, err := c.Client.KV().CAS(kv, nil)
+	return ok, err
+}
+
+// DeleteCASKV deletes a key only if its ModifyIndex still matches kv.  ok is
+// false when the key changed since it was read.
+func (c *ConsulAdapter) DeleteCASKV(kv *consulapi.KVPair) (bool, error) {
+	ok, _, err := c.Client.KV().DeleteCAS(kv, nil)
+	return ok, err
+}
+
+// KVTxn applies KV operations in a single transaction.  ok is false when
+// consul rolled the transaction back, the response then holds the errors.
+func (c *ConsulAdapter) KVTxn(ops consulapi.KVTxnOps) (bool, *consulapi.TxnResponse, error) {
+	txn := make(consulapi.TxnOps, 0, len(ops))
+	for _, op := range ops {
+		txn = append(txn, &consulapi.TxnOp{KV: op})
+	}
+	ok, resp, _, err := c.Client.Txn().Txn(txn, nil)
+	return ok, resp, err
+}
+
 // CreatePQ creates a prepared query in consul
 func (c *ConsulAdapter) CreatePQ(pq *consulapi.PreparedQueryDefinition) error {
 	_, _, err := c.Client.PreparedQuery().Create(pq, nil)
 	return err
 }
 
+// UpdatePQ updates an existing prepared query in consul
+func (c *ConsulAdapter) UpdatePQ(pq *consulapi.PreparedQueryDefinition) error {
+	_, err := c.Client.PreparedQuery().Update(pq, nil)
+	return err
+}
+
 // CreateACL creates an ACL in consul
 func (c *ConsulAdapter) CreateACL(acl *consulapi.ACLEntry) error {
 	_, _, err := c.Client.ACL().Create(acl, nil)
 	return err
-}
\ No newline at end of file
+}
+
+// UpdateACL updates an existing ACL in consul
+func (c *ConsulAdapter) UpdateACL(acl *consulapi.ACLEntry) error {
+	_, err := c.Client.ACL().Update(acl, nil)
+	return err
+}
+
+// CreateACLToken creates an ACL token in consul, keeping the accessor and
+// secret IDs when they are set
+func (c *ConsulAdapter) CreateACLToken(token *consulapi.ACLToken) error {
+	_, _, err := c.Client.ACL().TokenCreate(token, nil)
+	return err
+}
+
+// UpdateACLToken updates an existing ACL token in consul
+func (c *ConsulAdapter) UpdateACLToken(token *consulapi.ACLToken) error {
+	_, _, err := c.Client.ACL().TokenUpdate(token, nil)
+	return err
+}
+
+// CreateACLPolicy creates an ACL policy in consul and returns it with its new ID
+func (c *ConsulAdapter) CreateACLPolicy(policy *consulapi.ACLPolicy) (*consulapi.ACLPolicy, error) {
+	created, _, err := c.Client.ACL().PolicyCreate(policy, nil)
+	return created, err
+}
+
+// UpdateACLPolicy updates an existing ACL policy in consul
+func (c *ConsulAdapter) UpdateACLPolicy(policy *consulapi.ACLPolicy) (*consulapi.ACLPolicy, error) {
+	updated, _, err := c.Client.ACL().PolicyUpdate(policy, nil)
+	return updated, err
+}
+
+// CreateACLRole creates an ACL role in consul and returns it with its new ID
+func (c *ConsulAdapter) CreateACLRole(role *consulapi.ACLRole) (*consulapi.ACLRole, error) {
+	created, _, err := c.Client.ACL().RoleCreate(role, nil)
+	return created, err
+}
+
+// UpdateACLRole updates an existing ACL role in consul
+func (c *ConsulAdapter) UpdateACLRole(role *consulapi.ACLRole) (*consulapi.ACLRole, error) {
+	updated, _, err := c.Client.ACL().RoleUpdate(role, nil)
+	return updated, err
+}
+
+// CreateACLAuthMethod creates an ACL auth method in consul
+func (c *ConsulAdapter) CreateACLAuthMethod(method *consulapi.ACLAuthMethod) error {
+	_, _, err := c.Client.ACL().AuthMethodCreate(method, nil)
+	return err
+}
+
+// UpdateACLAuthMethod updates an existing ACL auth method in consul
+func (c *ConsulAdapter) UpdateACLAuthMethod(method *consulapi.ACLAuthMethod) error {
+	_, _, err := c.Client.ACL().AuthMethodUpdate(method, nil)
+	return err
+}
+
+// CreateACLBindingRule creates an ACL binding rule in consul
+func (c *ConsulAdapter) CreateACLBindingRule(rule *consulapi.ACLBindingRule) error {
+	_, _, err := c.Client.ACL().BindingRuleCreate(rule, nil)
+	return err
+}
+
+// UpdateACLBindingRule updates an existing ACL binding rule in consul
+func (c *ConsulAdapter) UpdateACLBindingRule(rule *consulapi.ACLBindingRule) error {
+	_, _, err := c.Client.ACL().BindingRuleUpdate(rule, nil)
+	return err
+}
+
+// SetConfigEntry creates or replaces a config entry in consul
+func (c *ConsulAdapter) SetConfigEntry(entry consulapi.ConfigEntry) error {
+	ok, _, err := c.Client.ConfigEntries().Set(entry, nil)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("consul did not apply %s config entry %s", entry.GetKind(), entry.GetName())
+	}
+	return nil
+}
+
+// SetIntentions writes every source intention for one destination service.
+// When the server does not support service-intentions config entries each
+// source is written through the legacy intentions endpoint instead.
+func (c *ConsulAdapter) SetIntentions(entry *consulapi.ServiceIntentionsConfigEntry) error {
+	// consul computes precedence and owns the legacy fields, it rejects
+	// config entries that set them
+	clean := *entry
+	clean.Sources = make([]*consulapi.SourceIntention, len(entry.Sources))
+	for i, source := range entry.Sources {
+		src := *source
+		src.Precedence = 0
+		src.LegacyID = ""
+		src.LegacyMeta = nil
+		src.LegacyCreateTime = nil
+		src.LegacyUpdateTime = nil
+		clean.Sources[i] = &src
+	}
+
+	err := c.SetConfigEntry(&clean)
+	if err == nil || !strings.Contains(err.Error(), "invalid config entry kind") {
+		return err
+	}
+
+	existing, _, err := c.Client.Connect().Intentions(nil)
+	if err != nil {
+		return err
+	}
+
+	for _, source := range entry.Sources {
+		ixn := &consulapi.Intention{
+			Description:     source.Description,
+			SourceNS:        source.Namespace,
+			SourceName:      source.Name,
+			DestinationNS:   entry.Namespace,
+			DestinationName: entry.Name,
+			SourceType:      source.Type,
+			Action:          source.Action,
+			Meta:            source.LegacyMeta,
+		}
+
+		for _, live := range existing {
+			if live.SourceName == ixn.SourceName && live.DestinationName == ixn.DestinationName &&
+				live.SourceNS == ixn.SourceNS && live.DestinationNS == ixn.DestinationNS {
+				ixn.ID = live.ID
+				break
+			}
+		}
+
+		if ixn.ID != "" {
+			_, err = c.Client.Connect().IntentionUpdate(ixn, nil)
+		} else {
+			_, _, err = c.Client.Connect().IntentionCreate(ixn, nil)
+		}
+		if err != nil {
+			return fmt.Errorf("unable to write intention %s => %s: %v", ixn.SourceName, ixn.DestinationName, err)
+		}
+	}
+	return nil
+}
+
+// Datacenter returns the datacenter of the consul agent we are talking to
+func (c *ConsulAdapter) Datacenter() (string, error) {
+	self, err := c.Client.Agent().Self()
+	if err != nil {
+		return "", err
+	}
+	datacenter, ok := self["Config"]["Datacenter"].(string)
+	if !ok {
+		return "", fmt.Errorf("consul agent did not report its datacenter")
+	}
+	return datacenter, nil
+}
+
+// SaveSnapshot streams a native raft snapshot from the consul leader
+func (c *ConsulAdapter) SaveSnapshot() (io.ReadCloser, error) {
+	snapshot, _, err := c.Client.Snapshot().Save(&consulapi.QueryOptions{
+		AllowStale:        false,
+		RequireConsistent: true,
+	})
+	return snapshot, err
+}
+
+// RestoreSnapshot feeds a native raft snapshot back in to consul, replacing
+// all of the cluster state
+func (c *ConsulAdapter) RestoreSnapshot(snapshot io.Reader) error {
+	return c.Client.Snapshot().Restore(nil, snapshot)
+}
+
+// KVIndex blocks until the index of the key/value store moves past
+// waitIndex or wait passes, and returns the index
+func (c *ConsulAdapter) KVIndex(waitIndex uint64, wait time.Duration) (uint64, error) {
+	_, meta, err := c.Client.KV().Keys("", "/", &consulapi.QueryOptions{WaitIndex: waitIndex, WaitTime: wait})
+	if err != nil {
+		return 0, err
+	}
+	return meta.LastIndex, nil
+}
+
+// PQIndex blocks until the index of the prepared queries moves past
+// waitIndex or wait passes, and returns the index
+func (c *ConsulAdapter) PQIndex(waitIndex uint64, wait time.Duration) (uint64, error) {
+	_, meta, err := c.Client.PreparedQuery().List(&consulapi.QueryOptions{WaitIndex: waitIndex, WaitTime: wait})
+	if err != nil {
+		return 0, err
+	}
+	return meta.LastIndex, nil
+}
+
+// ACLIndex blocks until the index of the ACL tokens moves past waitIndex or
+// wait passes, and returns the index
+func (c *ConsulAdapter) ACLIndex(waitIndex uint64, wait time.Duration) (uint64, error) {
+	_, meta, err := c.Client.ACL().TokenList(&consulapi.QueryOptions{WaitIndex: waitIndex, WaitTime: wait})
+	if err != nil {
+		return 0, err
+	}
+	return meta.LastIndex, nil
+}
+
+// NewLock returns a lock on key that records value while it is held.  The
+// session is kept alive by the lock and a few failed checks are retried
+// before the lock counts as lost.
+func (c *ConsulAdapter) NewLock(key, value string) (interfaces.Locker, error) {
+	lock, err := c.Client.LockOpts(&consulapi.LockOptions{
+		Key:            key,
+		Value:          []byte(value),
+		SessionName:    "consul-snapshot",
+		MonitorRetries: 3,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return lock, nil
+}
+
+// groupIntentions converts legacy intentions in to one service-intentions
+// config entry per destination service
+func groupIntentions(legacy []*consulapi.Intention) []*consulapi.ServiceIntentionsConfigEntry {
+	var intentions []*consulapi.ServiceIntentionsConfigEntry
+	byDestination := make(map[string]*consulapi.ServiceIntentionsConfigEntry)
+
+	for _, ixn := range legacy {
+		key := ixn.DestinationNS + "/" + ixn.DestinationName
+		entry, ok := byDestination[key]
+		if !ok {
+			entry = &consulapi.ServiceIntentionsConfigEntry{
+				Kind:      consulapi.ServiceIntentions,
+				Name:      ixn.DestinationName,
+				Namespace: ixn.DestinationNS,
+			}
+			byDestination[key] = entry
+			intentions = append(intentions, entry)
+		}
+
+		entry.Sources = append(entry.Sources, &consulapi.SourceIntention{
+			Name:        ixn.SourceName,
+			Namespace:   ixn.SourceNS,
+			Action:      ixn.Action,
+			Permissions: ixn.Permissions,
+			Precedence:  ixn.Precedence,
+			Type:        ixn.SourceType,
+			Description: ixn.Description,
+			LegacyID:    ixn.ID,
+			LegacyMeta:  ixn.Meta,
+		})
+	}
+	return intentions
+}
+
+// aclDisabled reports whether an error is consul telling us ACLs are not enabled
+func aclDisabled(err error) bool {
+	return strings.Contains(err.Error(), "ACL support disabled")
+}
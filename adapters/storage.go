@@ -3,6 +3,7 @@ package adapters
 import (
 	"bytes"
 	"context"
+	"fmt"
 	"io"
 
 	"cloud.google.com/go/storage"
@@ -11,6 +12,7 @@ import (
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/pshima/consul-snapshot/interfaces"
+	"google.golang.org/api/iterator"
 )
 
 // S3Adapter implements StorageClient for AWS S3
@@ -77,6 +79,59 @@ func (s *S3Adapter) Download(bucket, key string) ([]byte, error) {
 	return buf.Bytes(), err
 }
 
+// List lists every object in an S3 bucket under a prefix
+func (s *S3Adapter) List(bucket, prefix string) ([]interfaces.StorageObject, error) {
+	var objects []interfaces.StorageObject
+	params := &s3.ListObjectsV2Input{
+		Bucket: &bucket,
+		Prefix: &prefix,
+	}
+	err := s3.New(s.session).ListObjectsV2Pages(params, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			objects = append(objects, interfaces.StorageObject{
+				Key:          aws.StringValue(obj.Key),
+				Size:         aws.Int64Value(obj.Size),
+				LastModified: aws.TimeValue(obj.LastModified),
+			})
+		}
+		return true
+	})
+	return objects, err
+}
+
+// ListPrefixes lists the directories one level below a prefix in an S3
+// bucket, with a trailing slash
+func (s *S3Adapter) ListPrefixes(bucket, prefix string) ([]string, error) {
+	var prefixes []string
+	params := &s3.ListObjectsV2Input{
+		Bucket:    &bucket,
+		Prefix:    &prefix,
+		Delimiter: aws.String("/"),
+	}
+	err := s3.New(s.session).ListObjectsV2Pages(params, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, p := range page.CommonPrefixes {
+			prefixes = append(prefixes, aws.StringValue(p.Prefix))
+		}
+		return true
+	})
+	return prefixes, err
+}
+
+// Peek downloads only the first length bytes of an object in S3
+func (s *S3Adapter) Peek(bucket, key string, length int64) ([]byte, error) {
+	out, err := s3.New(s.session).GetObject(&s3.GetObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+		Range:  aws.String(fmt.Sprintf("bytes=0-%d", length-1)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer out.Body.Close()
+
+	return io.ReadAll(out.Body)
+}
+
 // GCSAdapter implements StorageClient for Google Cloud Storage
 type GCSAdapter struct {
 	client *storage.Client
@@ -117,4 +172,56 @@ func (g *GCSAdapter) Download(bucket, key string) ([]byte, error) {
 	defer r.Close()
 	
 	return io.ReadAll(r)
-}
\ No newline at end of file
+}
+
+// List lists every object in a GCS bucket under a prefix
+func (g *GCSAdapter) List(bucket, prefix string) ([]interfaces.StorageObject, error) {
+	var objects []interfaces.StorageObject
+	it := g.client.Bucket(bucket).Objects(context.Background(), &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, interfaces.StorageObject{
+			Key:          attrs.Name,
+			Size:         attrs.Size,
+			LastModified: attrs.Updated,
+		})
+	}
+	return objects, nil
+}
+
+// ListPrefixes lists the directories one level below a prefix in a GCS
+// bucket, with a trailing slash
+func (g *GCSAdapter) ListPrefixes(bucket, prefix string) ([]string, error) {
+	var prefixes []string
+	it := g.client.Bucket(bucket).Objects(context.Background(), &storage.Query{Prefix: prefix, Delimiter: "/"})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if attrs.Prefix != "" {
+			prefixes = append(prefixes, attrs.Prefix)
+		}
+	}
+	return prefixes, nil
+}
+
+// Peek downloads only the first length bytes of an object in GCS
+func (g *GCSAdapter) Peek(bucket, key string, length int64) ([]byte, error) {
+	r, err := g.client.Bucket(bucket).Object(key).NewRangeReader(context.Background(), 0, length)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return io.ReadAll(r)
+}
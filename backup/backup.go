@@ -10,6 +10,7 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"net/url"
 	"os"
 	"path/filepath"
 	"time"
@@ -20,108 +21,89 @@ import (
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	consulapi "github.com/hashicorp/consul/api"
 	"github.com/mholt/archives"
+	"github.com/pshima/consul-snapshot/adapters"
 	"github.com/pshima/consul-snapshot/config"
 	"github.com/pshima/consul-snapshot/consul"
 	"github.com/pshima/consul-snapshot/crypt"
+	"github.com/pshima/consul-snapshot/filter"
 	"github.com/pshima/consul-snapshot/health"
 	"github.com/pshima/consul-snapshot/interfaces"
-	"strings"
 )
 
-// ConsulAdapter wraps the consul API client to implement ConsulClient interface
-type ConsulAdapter struct {
-	Client *consulapi.Client
-}
-
-// ListKeys lists all keys from consul
-func (c *ConsulAdapter) ListKeys() (consulapi.KVPairs, error) {
-	listOpt := &consulapi.QueryOptions{
-		AllowStale:        false,
-		RequireConsistent: true,
-	}
-	keys, _, err := c.Client.KV().List("/", listOpt)
-	return keys, err
-}
-
-// ListPQs lists all prepared queries from consul
-func (c *ConsulAdapter) ListPQs() ([]*consulapi.PreparedQueryDefinition, error) {
-	listOpt := &consulapi.QueryOptions{
-		AllowStale:        false,
-		RequireConsistent: true,
-	}
-	pqs, _, err := c.Client.PreparedQuery().List(listOpt)
-	return pqs, err
-}
-
-// ListACLs lists all ACLs from consul
-func (c *ConsulAdapter) ListACLs() ([]*consulapi.ACLEntry, error) {
-	listOpt := &consulapi.QueryOptions{
-		AllowStale:        false,
-		RequireConsistent: true,
-	}
-	
-	acls, _, err := c.Client.ACL().List(listOpt)
-	if err != nil {
-		// Handle ACL disabled case
-		if strings.Contains(err.Error(), "401 (ACL support disabled)") {
-			return []*consulapi.ACLEntry{}, nil
-		}
-		return nil, err
-	}
-	return acls, nil
-}
-
-// PutKV puts a key-value pair in consul
-func (c *ConsulAdapter) PutKV(key string, value []byte) error {
-	p := &consulapi.KVPair{Key: key, Value: value}
-	_, err := c.Client.KV().Put(p, nil)
-	return err
-}
+// ConsulAdapter wraps the consul API client to implement ConsulClient interface.
+// It is an alias of adapters.ConsulAdapter so backups and restores share one
+// implementation of every consul operation.
+type ConsulAdapter = adapters.ConsulAdapter
 
-// CreatePQ creates a prepared query in consul
-func (c *ConsulAdapter) CreatePQ(pq *consulapi.PreparedQueryDefinition) error {
-	_, _, err := c.Client.PreparedQuery().Create(pq, nil)
-	return err
-}
-
-// CreateACL creates an ACL in consul
-func (c *ConsulAdapter) CreateACL(acl *consulapi.ACLEntry) error {
-	_, _, err := c.Client.ACL().Create(acl, nil)
-	return err
-}
+// retentionTag is the object tag, or metadata key in GCS, holding the
+// retention class of a backup
+const retentionTag = "retention-class"
 
 // Backup is the backup itself including configuration and data
 type Backup struct {
-	ACLFileChecksum  string
-	ACLJSONData      []byte
-	Client           *consul.Consul
-	Config           *config.Config
-	Storage          interfaces.StorageClient
-	FileSystem       interfaces.FileSystem
-	Archiver         interfaces.Archiver
-	Logger           interfaces.Logger
-	FullFilename     string
-	KVFileChecksum   string
-	KVJSONData       []byte
-	LocalACLFileName string
-	LocalFilePath    string
-	LocalKVFileName  string
-	LocalPQFileName  string
-	PQFileChecksum   string
-	PQJSONData       []byte
-	RemoteFilePath   string
-	StartTime        int64
+	ACLFileChecksum         string
+	ACLJSONData             []byte
+	ACLSystemFileChecksum   string
+	ACLSystemJSONData       []byte
+	Client                  *consul.Consul
+	Config                  *config.Config
+	ConfigFileChecksum      string
+	ConfigJSONData          []byte
+	IntentionsFileChecksum  string
+	IntentionsJSONData      []byte
+	Storage                 interfaces.StorageClient
+	FileSystem              interfaces.FileSystem
+	Archiver                interfaces.Archiver
+	Logger                  interfaces.Logger
+	FullFilename            string
+	KVFileChecksum          string
+	KVJSONData              []byte
+	LocalACLFileName        string
+	LocalACLSystemFileName  string
+	LocalConfigFileName     string
+	LocalIntentionsFileName string
+	LocalFilePath           string
+	LocalKVFileName         string
+	LocalPQFileName         string
+	LocalRaftFileName       string
+	PQFileChecksum          string
+	PQJSONData              []byte
+	RaftFileChecksum        string
+	RemoteFilePath          string
+	StartTime               int64
+	BackupType              string
+	KVIndex                 uint64
+	FullBackup              string
+	ParentBackup            string
+	Tombstones              []string
+	LocalTombstonesFileName string
+	TombstonesFileChecksum  string
+	ContentChecksum         string
+	fullStartTime           int64
 }
 
 // Meta holds the meta struct to write inside the compressed data
 type Meta struct {
 	ACLSha256             string
+	ACLSystemSha256       string
+	BackupMode            string
+	BackupType            string `json:",omitempty"`
+	ConfigSha256          string
 	ConsulSnapshotVersion string
+	Datacenter            string
 	EndTime               int64
+	FullBackup            string `json:",omitempty"`
+	IntentionsSha256      string
+	KVFilter              *filter.KV `json:",omitempty"`
+	KVIndex               uint64     `json:",omitempty"`
 	KVSha256              string
 	NodeName              string
 	PQSha256              string
+	ParentBackup          string `json:",omitempty"`
+	RaftSha256            string
+	RetentionClass        string `json:",omitempty"`
 	StartTime             int64
+	TombstonesSha256      string `json:",omitempty"`
 }
 
 func calcSha256(path string) (string, error) {
@@ -156,12 +138,25 @@ func Runner(version string, once bool) int {
 		}
 	} else {
 		// Start up the http server health checks, only needed for daemon-mode
+		health.SetMaxAge(conf.HealthMaxAge)
 		go health.StartServer()
 
+		backup := func(c *config.Config) error { return doWork(c, client) }
+		if conf.HA {
+			backup = startElection(conf, client).guard(backup)
+		}
+
+		if conf.Watch {
+			watchBackups(conf, client, func() error { return backup(conf) })
+		}
+		if len(conf.Schedules) > 0 {
+			scheduleBackups(conf, backup)
+		}
+
 		log.Printf("[DEBUG] Backup starting on interval: %v", conf.BackupInterval)
 		ticker := time.NewTicker(conf.BackupInterval)
 		for range ticker.C {
-			err := doWork(conf, client)
+			err := backup(conf)
 			if err != nil {
 				log.Fatalf("Error during backup: %s", err.Error())
 			}
@@ -185,8 +180,73 @@ func doWork(conf *config.Config, client *consul.Consul) error {
 
 	log.Printf("[INFO] Starting Backup At: %s", startString)
 
-	log.Print("[INFO] Listing keys from consul")
-	b.Client.ListKeys()
+	if b.Config.JSONBackup() {
+		if err := b.listJSONData(); err != nil {
+			return err
+		}
+		// a full backup is wanted even when nothing changed, incremental
+		// backups build on it
+		if b.Config.SkipUnchanged && !b.Config.ForceFullBackup && b.unchanged() {
+			log.Print("[INFO] Nothing changed since the last backup, skipping the upload")
+			if !conf.Acceptance {
+				b.writeLastBackup()
+			}
+			return nil
+		}
+		if b.Config.Incremental {
+			b.planIncremental()
+		}
+	}
+
+	log.Print("[INFO] Preparing temporary directory for backup staging")
+	b.preProcess()
+
+	if b.Config.JSONBackup() {
+		if err := b.writeJSONLocal(); err != nil {
+			return err
+		}
+	}
+
+	if b.Config.NativeBackup() {
+		log.Print("[INFO] Saving native snapshot from consul")
+		if err := b.writeSnapshotLocal(); err != nil {
+			return err
+		}
+	}
+
+	b.writeMetaLocal()
+	b.compressStagedBackup()
+
+	if b.Config.Encryption != "" {
+		crypt.EncryptFile(b.LocalFilePath, b.Config.Encryption)
+	}
+
+	if conf.Acceptance {
+		log.Print("[INFO] Skipping remote backup during testing")
+		log.Print("[INFO] Skipping post processing during testing")
+	} else {
+		log.Print("[INFO] Writing Backup to Remote File")
+		b.writeBackupRemote()
+		log.Print("[INFO] Running post processing")
+		b.postProcess()
+	}
+
+	log.Print("[INFO] Backup completed successfully")
+	return nil
+}
+
+// listJSONData lists everything that is exported as JSON from consul and
+// marshalls it on to the Backup object.  Keys that can not be listed fail
+// the backup, an empty key set would look like every key was deleted.
+func (b *Backup) listJSONData() error {
+	if b.Config.KVFilter.Empty() {
+		log.Print("[INFO] Listing keys from consul")
+	} else {
+		log.Printf("[INFO] Listing keys from consul with %s", b.Config.KVFilter.String())
+	}
+	if err := b.Client.ListFilteredKeys(&b.Config.KVFilter); err != nil {
+		return fmt.Errorf("[ERR] Unable to list keys: %v", err)
+	}
 	log.Printf("[INFO] Converting %v keys to JSON", b.Client.KeyDataLen)
 	b.KeysToJSON()
 
@@ -200,9 +260,34 @@ func doWork(conf *config.Config, client *consul.Consul) error {
 	log.Printf("[INFO] Converting %v ACLs to JSON", b.Client.ACLDataLen)
 	b.ACLsToJSON()
 
-	log.Print("[INFO] Preparing temporary directory for backup staging")
-	b.preProcess()
+	log.Print("[INFO] Listing ACL tokens, policies, roles, auth methods and binding rules from consul")
+	if err := b.Client.ListACLSystem(); err != nil {
+		log.Printf("[WARN] Unable to list ACL system, it will not be part of this backup: %v", err)
+	} else {
+		b.ACLSystemToJSON()
+	}
 
+	log.Print("[INFO] Listing config entries from consul")
+	if err := b.Client.ListConfigEntries(); err != nil {
+		log.Printf("[WARN] Unable to list config entries, they will not be part of this backup: %v", err)
+	} else {
+		log.Printf("[INFO] Converting %v config entries to JSON", b.Client.ConfigEntryDataLen)
+		b.ConfigEntriesToJSON()
+	}
+
+	log.Print("[INFO] Listing intentions from consul")
+	if err := b.Client.ListIntentions(); err != nil {
+		log.Printf("[WARN] Unable to list intentions, they will not be part of this backup: %v", err)
+	} else {
+		log.Printf("[INFO] Converting %v intentions to JSON", b.Client.IntentionDataLen)
+		b.IntentionsToJSON()
+	}
+	return nil
+}
+
+// writeJSONLocal writes the JSON exports to the staging directory and
+// records their checksums
+func (b *Backup) writeJSONLocal() error {
 	log.Print("[INFO] Writing KVs to local backup file")
 	if err := writeFileLocal(b.LocalFilePath, b.LocalKVFileName, b.KVJSONData); err != nil {
 		return fmt.Errorf("[ERR] Unable to write file %s/%s: %v", b.LocalFilePath, b.LocalKVFileName, err)
@@ -214,6 +299,12 @@ func doWork(conf *config.Config, client *consul.Consul) error {
 	}
 	b.KVFileChecksum = kvchecksum
 
+	if b.BackupType == BackupTypeIncremental {
+		if err := b.writeTombstonesLocal(); err != nil {
+			return err
+		}
+	}
+
 	log.Print("[INFO] Writing PQs to local backup file")
 	if err := writeFileLocal(b.LocalFilePath, b.LocalPQFileName, b.PQJSONData); err != nil {
 		return fmt.Errorf("[ERR] Unable to write file %s/%s: %v", b.LocalFilePath, b.LocalPQFileName, err)
@@ -236,24 +327,78 @@ func doWork(conf *config.Config, client *consul.Consul) error {
 	}
 	b.ACLFileChecksum = aclchecksum
 
-	b.writeMetaLocal()
-	b.compressStagedBackup()
+	// an ACL system that could not be listed is left out, restores skip
+	// backups without its checksum
+	if b.ACLSystemJSONData != nil {
+		log.Print("[INFO] Writing ACL system to local backup file")
+		if err := writeFileLocal(b.LocalFilePath, b.LocalACLSystemFileName, b.ACLSystemJSONData); err != nil {
+			return fmt.Errorf("[ERR] Unable to write file %s/%s: %v", b.LocalFilePath, b.LocalACLSystemFileName, err)
+		}
 
-	if b.Config.Encryption != "" {
-		crypt.EncryptFile(b.LocalFilePath, b.Config.Encryption)
+		aclsystemchecksum, err := calcSha256(filepath.Join(b.LocalFilePath, b.LocalACLSystemFileName))
+		if err != nil {
+			return fmt.Errorf("[ERR] Unable to generate checksum for file %s: %v", b.LocalACLSystemFileName, err)
+		}
+		b.ACLSystemFileChecksum = aclsystemchecksum
 	}
 
-	if conf.Acceptance {
-		log.Print("[INFO] Skipping remote backup during testing")
-		log.Print("[INFO] Skipping post processing during testing")
-	} else {
-		log.Print("[INFO] Writing Backup to Remote File")
-		b.writeBackupRemote()
-		log.Print("[INFO] Running post processing")
-		b.postProcess()
+	// so are config entries
+	if b.ConfigJSONData != nil {
+		log.Print("[INFO] Writing config entries to local backup file")
+		if err := writeFileLocal(b.LocalFilePath, b.LocalConfigFileName, b.ConfigJSONData); err != nil {
+			return fmt.Errorf("[ERR] Unable to write file %s/%s: %v", b.LocalFilePath, b.LocalConfigFileName, err)
+		}
+
+		configchecksum, err := calcSha256(filepath.Join(b.LocalFilePath, b.LocalConfigFileName))
+		if err != nil {
+			return fmt.Errorf("[ERR] Unable to generate checksum for file %s: %v", b.LocalConfigFileName, err)
+		}
+		b.ConfigFileChecksum = configchecksum
 	}
 
-	log.Print("[INFO] Backup completed successfully")
+	// and intentions
+	if b.IntentionsJSONData != nil {
+		log.Print("[INFO] Writing intentions to local backup file")
+		if err := writeFileLocal(b.LocalFilePath, b.LocalIntentionsFileName, b.IntentionsJSONData); err != nil {
+			return fmt.Errorf("[ERR] Unable to write file %s/%s: %v", b.LocalFilePath, b.LocalIntentionsFileName, err)
+		}
+
+		intentionschecksum, err := calcSha256(filepath.Join(b.LocalFilePath, b.LocalIntentionsFileName))
+		if err != nil {
+			return fmt.Errorf("[ERR] Unable to generate checksum for file %s: %v", b.LocalIntentionsFileName, err)
+		}
+		b.IntentionsFileChecksum = intentionschecksum
+	}
+	return nil
+}
+
+// writeSnapshotLocal streams a native raft snapshot from consul to the
+// staging directory and records its checksum
+func (b *Backup) writeSnapshotLocal() error {
+	snapshot, err := b.Client.Client.SaveSnapshot()
+	if err != nil {
+		return fmt.Errorf("[ERR] Unable to save native snapshot: %v", err)
+	}
+	defer snapshot.Close()
+
+	writepath := filepath.Join(b.LocalFilePath, b.LocalRaftFileName)
+	handle, err := os.OpenFile(writepath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("[ERR] Unable to write file %s/%s: %v", b.LocalFilePath, b.LocalRaftFileName, err)
+	}
+	defer handle.Close()
+
+	bytesWritten, err := io.Copy(handle, snapshot)
+	if err != nil {
+		return fmt.Errorf("[ERR] Unable to write file %s/%s: %v", b.LocalFilePath, b.LocalRaftFileName, err)
+	}
+	log.Printf("[DEBUG] Wrote %v bytes to file, %v", bytesWritten, writepath)
+
+	raftchecksum, err := calcSha256(writepath)
+	if err != nil {
+		return fmt.Errorf("[ERR] Unable to generate checksum for file %s: %v", b.LocalRaftFileName, err)
+	}
+	b.RaftFileChecksum = raftchecksum
 	return nil
 }
 
@@ -284,6 +429,47 @@ func (b *Backup) ACLsToJSON() {
 	b.ACLJSONData = jsonData
 }
 
+// ACLSystemToJSON used to marshall the ACL system and put it on a Backup object
+func (b *Backup) ACLSystemToJSON() {
+	system := b.Client.ACLSystem
+	if system == nil {
+		system = &consul.ACLSystem{}
+	}
+	log.Printf("[INFO] Converting %v ACL tokens, %v policies, %v roles, %v auth methods and %v binding rules to JSON",
+		len(system.Tokens), len(system.Policies), len(system.Roles), len(system.AuthMethods), len(system.BindingRules))
+	jsonData, err := json.Marshal(system)
+	if err != nil {
+		log.Fatalf("[ERR] Could not encode ACL system to json!: %v", err)
+	}
+	b.ACLSystemJSONData = jsonData
+}
+
+// ConfigEntriesToJSON used to marshall the config entries and put it on a Backup object
+func (b *Backup) ConfigEntriesToJSON() {
+	entries := b.Client.ConfigEntryData
+	if entries == nil {
+		entries = consul.ConfigEntries{}
+	}
+	jsonData, err := json.Marshal(entries)
+	if err != nil {
+		log.Fatalf("[ERR] Could not encode config entries to json!: %v", err)
+	}
+	b.ConfigJSONData = jsonData
+}
+
+// IntentionsToJSON used to marshall the service intentions and put it on a Backup object
+func (b *Backup) IntentionsToJSON() {
+	intentions := b.Client.IntentionData
+	if intentions == nil {
+		intentions = []*consulapi.ServiceIntentionsConfigEntry{}
+	}
+	jsonData, err := json.Marshal(intentions)
+	if err != nil {
+		log.Fatalf("[ERR] Could not encode intentions to json!: %v", err)
+	}
+	b.IntentionsJSONData = jsonData
+}
+
 // preProcess is used to prepare the backup temp location
 func (b *Backup) preProcess() {
 	startString := fmt.Sprintf("%v", b.StartTime)
@@ -303,6 +489,11 @@ func (b *Backup) preProcess() {
 	b.LocalKVFileName = fmt.Sprintf("consul.kv.%s.json", startString)
 	b.LocalPQFileName = fmt.Sprintf("consul.pq.%s.json", startString)
 	b.LocalACLFileName = fmt.Sprintf("consul.acl.%s.json", startString)
+	b.LocalACLSystemFileName = fmt.Sprintf("consul.aclsystem.%s.json", startString)
+	b.LocalConfigFileName = fmt.Sprintf("consul.config.%s.json", startString)
+	b.LocalIntentionsFileName = fmt.Sprintf("consul.intentions.%s.json", startString)
+	b.LocalRaftFileName = fmt.Sprintf("consul.raft.%s.snap", startString)
+	b.LocalTombstonesFileName = fmt.Sprintf("consul.tombstones.%s.json", startString)
 
 	b.LocalFilePath = dir
 }
@@ -325,14 +516,43 @@ func (b *Backup) writeMetaLocal() {
 		nodename = ""
 	}
 
+	// restores check this against the cluster they are writing to
+	datacenter, err := b.Client.Client.Datacenter()
+	if err != nil {
+		log.Printf("[WARN] Unable to determine the datacenter, it will not be recorded in the backup: %v", err)
+		datacenter = ""
+	}
+
 	meta := &Meta{
 		KVSha256:              b.KVFileChecksum,
 		PQSha256:              b.PQFileChecksum,
 		ACLSha256:             b.ACLFileChecksum,
+		ACLSystemSha256:       b.ACLSystemFileChecksum,
+		ConfigSha256:          b.ConfigFileChecksum,
+		IntentionsSha256:      b.IntentionsFileChecksum,
+		RaftSha256:            b.RaftFileChecksum,
+		BackupMode:            b.Config.BackupMode,
 		ConsulSnapshotVersion: b.Config.Version,
 		StartTime:             b.StartTime,
 		EndTime:               endTime,
 		NodeName:              nodename,
+		Datacenter:            datacenter,
+		RetentionClass:        b.Config.RetentionClass,
+	}
+
+	// a filtered backup only holds some of the keys, restores need to know
+	// that the missing keys were never captured
+	if b.Config.JSONBackup() && !b.Config.KVFilter.Empty() {
+		meta.KVFilter = &b.Config.KVFilter
+	}
+
+	// restores rebuild an incremental backup from its chain of parents
+	if b.Config.Incremental {
+		meta.BackupType = b.BackupType
+		meta.KVIndex = b.KVIndex
+		meta.FullBackup = b.FullBackup
+		meta.ParentBackup = b.ParentBackup
+		meta.TombstonesSha256 = b.TombstonesFileChecksum
 	}
 
 	metajsonData, err := json.Marshal(meta)
@@ -435,6 +655,11 @@ func (b *Backup) writeBackupRemoteS3(localFileContents []byte) {
 		params.SSEKMSKeyId = &b.Config.S3KmsKeyID
 	}
 
+	// bucket lifecycle rules can expire backups by their retention class
+	if b.Config.RetentionClass != "" {
+		params.Tagging = aws.String(retentionTag + "=" + url.QueryEscape(b.Config.RetentionClass))
+	}
+
 	log.Printf("[INFO] Uploading %v/%v to S3 in %v", string(b.Config.S3Bucket), b.RemoteFilePath, string(b.Config.S3Region))
 	uploader := s3manager.NewUploader(s3Conn)
 	_, err := uploader.Upload(params)
@@ -454,6 +679,9 @@ func (b *Backup) writeBackupRemoteGoogleStorage(localFileContents []byte) {
 	wc := client.Bucket(b.Config.GCSBucket).Object(b.RemoteFilePath).NewWriter(ctx)
 	log.Printf("[INFO] Uploading %v/%v to GCS", string(b.Config.GCSBucket), b.RemoteFilePath)
 	wc.ContentType = "text/plain"
+	if b.Config.RetentionClass != "" {
+		wc.Metadata = map[string]string{retentionTag: b.Config.RetentionClass}
+	}
 	// wc.ACL = []storage.ACLRule{{AllUsers: storage.AllUsers, RoleReader: storage.RoleReader}}
 	if _, err := wc.Write(localFileContents); err != nil {
 		log.Fatalf("[ERR] Could not upload to GCS!: %v", err)
@@ -483,19 +711,29 @@ func (b *Backup) writeBackupRemote() {
 	}
 }
 
+// writeLastBackup marks a key in consul with the time of the last backup
+// for the health check.  A backup that was skipped because nothing changed
+// still verified the data, so it counts as fresh.
+func (b *Backup) writeLastBackup() {
+	startstring := fmt.Sprintf("%v", b.StartTime)
+	lastbackup := &consulapi.KVPair{Key: statusPrefix + "lastbackup", Value: []byte(startstring)}
+	if err := b.putStatus(lastbackup); err != nil {
+		log.Fatalf("[ERR] Failed writing last backup timestamp to consul: %v", err)
+	}
+}
+
 // Run post processing on the backup, acking the key and removing and temp files.
 // There are no tests for the remote operation.
 func (b *Backup) postProcess() {
-	// Mark a key in consul for our last backup time.
-	startstring := fmt.Sprintf("%v", b.StartTime)
-
 	var err error
 
-	lastbackup := &consulapi.KVPair{Key: "service/consul-snapshot/lastbackup", Value: []byte(startstring)}
-	// Use the PutKV method from the ConsulClient interface
-	err = b.Client.Client.PutKV(lastbackup.Key, lastbackup.Value)
-	if err != nil {
-		log.Fatalf("[ERR] Failed writing last backup timestamp to consul: %v", err)
+	b.writeLastBackup()
+	if b.Config.SkipUnchanged {
+		b.saveChecksum()
+	}
+
+	if b.Config.Incremental {
+		b.saveChainState()
 	}
 
 	// Remove the compressed archive
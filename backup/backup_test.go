@@ -13,6 +13,10 @@ import (
 	consulapi "github.com/hashicorp/consul/api"
 	"github.com/pshima/consul-snapshot/config"
 	"github.com/pshima/consul-snapshot/consul"
+	"github.com/pshima/consul-snapshot/cron"
+	"github.com/pshima/consul-snapshot/filter"
+	"github.com/pshima/consul-snapshot/health"
+	"github.com/pshima/consul-snapshot/mocks"
 )
 
 const (
@@ -142,6 +146,189 @@ func TestACLsToJSON(t *testing.T) {
 	}
 }
 
+func TestACLSystemToJSON(t *testing.T) {
+	backup := testingStructs()
+	backup.ACLSystemToJSON()
+
+	// with nothing listed from consul an empty ACL system is written
+	marshallSouce, err := json.Marshal(&consul.ACLSystem{})
+	if err != nil {
+		t.Errorf("Unable to marshall source testing data: %v", err)
+	}
+	if !reflect.DeepEqual(backup.ACLSystemJSONData, marshallSouce) {
+		t.Errorf("JSON marshall did not equal. Got %s, expected %s", backup.ACLSystemJSONData, marshallSouce)
+	}
+
+	backup.Client.ACLSystem = &consul.ACLSystem{
+		Policies: []*consulapi.ACLPolicy{{ID: "p1", Name: "policy"}},
+	}
+	backup.ACLSystemToJSON()
+
+	system := &consul.ACLSystem{}
+	if err := json.Unmarshal(backup.ACLSystemJSONData, system); err != nil {
+		t.Fatalf("Unable to unmarshall ACL system: %v", err)
+	}
+	if len(system.Policies) != 1 || system.Policies[0].Name != "policy" {
+		t.Errorf("expected ACL system to round trip, got %+v", system)
+	}
+}
+
+func TestACLSystemListError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "aclsystem")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	mockClient := mocks.NewMockConsulClient()
+	mockClient.ACLSystemError = fmt.Errorf("permission denied")
+	backup := &Backup{
+		Client:    consul.NewConsul(mockClient),
+		StartTime: time.Now().Unix(),
+		Config:    &config.Config{TmpDir: dir},
+	}
+	backup.listJSONData()
+	backup.preProcess()
+	if err := backup.writeJSONLocal(); err != nil {
+		t.Fatalf("Unable to write JSON exports: %v", err)
+	}
+
+	if backup.ACLSystemFileChecksum != "" {
+		t.Errorf("Expected no ACL system checksum, got %s", backup.ACLSystemFileChecksum)
+	}
+	if _, err := os.Stat(filepath.Join(backup.LocalFilePath, backup.LocalACLSystemFileName)); !os.IsNotExist(err) {
+		t.Errorf("Expected no ACL system file, got %v", err)
+	}
+	if backup.KVFileChecksum == "" {
+		t.Error("Expected the other exports to be written")
+	}
+}
+
+func TestKeysListError(t *testing.T) {
+	mockClient := mocks.NewMockConsulClient()
+	mockClient.KeyError = fmt.Errorf("no leader")
+	backup := &Backup{
+		Client:    consul.NewConsul(mockClient),
+		StartTime: time.Now().Unix(),
+		Config:    &config.Config{},
+	}
+
+	if err := backup.listJSONData(); err == nil {
+		t.Error("Expected the backup to fail when keys can not be listed")
+	}
+	if backup.KVJSONData != nil {
+		t.Errorf("Expected no keys to be backed up, got %s", backup.KVJSONData)
+	}
+}
+
+func TestConfigEntriesListError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "configentries")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	mockClient := mocks.NewMockConsulClient()
+	mockClient.ConfigEntryError = fmt.Errorf("permission denied")
+	backup := &Backup{
+		Client:    consul.NewConsul(mockClient),
+		StartTime: time.Now().Unix(),
+		Config:    &config.Config{TmpDir: dir},
+	}
+	backup.listJSONData()
+	backup.preProcess()
+	if err := backup.writeJSONLocal(); err != nil {
+		t.Fatalf("Unable to write JSON exports: %v", err)
+	}
+
+	if backup.ConfigFileChecksum != "" {
+		t.Errorf("Expected no config entries checksum, got %s", backup.ConfigFileChecksum)
+	}
+	if _, err := os.Stat(filepath.Join(backup.LocalFilePath, backup.LocalConfigFileName)); !os.IsNotExist(err) {
+		t.Errorf("Expected no config entries file, got %v", err)
+	}
+	if backup.IntentionsFileChecksum == "" {
+		t.Error("Expected the other exports to be written")
+	}
+}
+
+func TestIntentionsListError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "intentions")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	mockClient := mocks.NewMockConsulClient()
+	mockClient.IntentionError = fmt.Errorf("permission denied")
+	backup := &Backup{
+		Client:    consul.NewConsul(mockClient),
+		StartTime: time.Now().Unix(),
+		Config:    &config.Config{TmpDir: dir},
+	}
+	backup.listJSONData()
+	backup.preProcess()
+	if err := backup.writeJSONLocal(); err != nil {
+		t.Fatalf("Unable to write JSON exports: %v", err)
+	}
+
+	if backup.IntentionsFileChecksum != "" {
+		t.Errorf("Expected no intentions checksum, got %s", backup.IntentionsFileChecksum)
+	}
+	if _, err := os.Stat(filepath.Join(backup.LocalFilePath, backup.LocalIntentionsFileName)); !os.IsNotExist(err) {
+		t.Errorf("Expected no intentions file, got %v", err)
+	}
+	if backup.ConfigFileChecksum == "" {
+		t.Error("Expected the other exports to be written")
+	}
+}
+
+func TestConfigEntriesToJSON(t *testing.T) {
+	backup := testingStructs()
+	backup.ConfigEntriesToJSON()
+
+	if string(backup.ConfigJSONData) != "{}" {
+		t.Errorf("expected empty config entries to be written as {}, got %s", backup.ConfigJSONData)
+	}
+
+	backup.Client.ConfigEntryData = consul.ConfigEntries{
+		consulapi.ServiceDefaults: {
+			&consulapi.ServiceConfigEntry{Kind: consulapi.ServiceDefaults, Name: "web"},
+		},
+	}
+	backup.ConfigEntriesToJSON()
+
+	var entries consul.ConfigEntries
+	if err := json.Unmarshal(backup.ConfigJSONData, &entries); err != nil {
+		t.Fatalf("Unable to unmarshall config entries: %v", err)
+	}
+	if len(entries[consulapi.ServiceDefaults]) != 1 || entries[consulapi.ServiceDefaults][0].GetName() != "web" {
+		t.Errorf("expected config entries to round trip, got %+v", entries)
+	}
+}
+
+func TestIntentionsToJSON(t *testing.T) {
+	backup := testingStructs()
+	backup.IntentionsToJSON()
+
+	if string(backup.IntentionsJSONData) != "[]" {
+		t.Errorf("expected empty intentions to be written as [], got %s", backup.IntentionsJSONData)
+	}
+
+	backup.Client.IntentionData = []*consulapi.ServiceIntentionsConfigEntry{
+		{Kind: consulapi.ServiceIntentions, Name: "db", Sources: []*consulapi.SourceIntention{{Name: "web"}}},
+	}
+	backup.IntentionsToJSON()
+
+	var intentions []*consulapi.ServiceIntentionsConfigEntry
+	if err := json.Unmarshal(backup.IntentionsJSONData, &intentions); err != nil {
+		t.Fatalf("Unable to unmarshall intentions: %v", err)
+	}
+	if len(intentions) != 1 || intentions[0].Sources[0].Name != "web" {
+		t.Errorf("expected intentions to round trip, got %+v", intentions)
+	}
+}
+
 func TestPreProcess(t *testing.T) {
 	backup := testingStructs()
 	backup.KeysToJSON()
@@ -162,6 +349,18 @@ func TestPreProcess(t *testing.T) {
 		t.Error("Generated acl file name is invalid!")
 	}
 
+	if backup.LocalACLSystemFileName != fmt.Sprintf("consul.aclsystem.%s.json", startString) {
+		t.Error("Generated acl system file name is invalid!")
+	}
+
+	if backup.LocalConfigFileName != fmt.Sprintf("consul.config.%s.json", startString) {
+		t.Error("Generated config file name is invalid!")
+	}
+
+	if backup.LocalIntentionsFileName != fmt.Sprintf("consul.intentions.%s.json", startString) {
+		t.Error("Generated intentions file name is invalid!")
+	}
+
 	prefix := fmt.Sprintf("%s.consul.snapshot.%s", backup.Config.Hostname, startString)
 	dir := filepath.Join(backup.Config.TmpDir, prefix)
 
@@ -220,6 +419,26 @@ func TestWriteMetaLocal(t *testing.T) {
 
 }
 
+func TestWriteMetaLocalKVFilter(t *testing.T) {
+	backup := testingStructs()
+	backup.Config.KVFilter = filter.KV{IncludePrefixes: []string{"service/web/"}}
+	backup.preProcess()
+	backup.writeMetaLocal()
+
+	data, err := ioutil.ReadFile(filepath.Join(backup.LocalFilePath, "meta.json"))
+	if err != nil {
+		t.Fatalf("[ERR] Unable to read testfile: %v", err)
+	}
+
+	meta := &Meta{}
+	if err := json.Unmarshal(data, meta); err != nil {
+		t.Fatalf("Unable to marshall source testing data: %v", err)
+	}
+	if meta.KVFilter == nil || !reflect.DeepEqual(meta.KVFilter.IncludePrefixes, []string{"service/web/"}) {
+		t.Errorf("expected the key filter to be recorded, got %+v", meta.KVFilter)
+	}
+}
+
 func TestWriteFileLocal(t *testing.T) {
 	// Test writeFileLocal function
 	testPath := "/tmp"
@@ -549,3 +768,429 @@ func TestWriteBackupLocal(t *testing.T) {
 
 }
 */
+
+func TestWriteSnapshotLocal(t *testing.T) {
+	mockClient := mocks.NewMockConsulClient()
+	mockClient.SnapshotData = []byte("raft snapshot")
+	backup := &Backup{
+		Client:        &consul.Consul{Client: mockClient},
+		StartTime:     time.Now().Unix(),
+		Config:        testingConfig(),
+		LocalFilePath: tmpDir,
+	}
+	backup.LocalRaftFileName = fmt.Sprintf("consul.raft.%v.snap", backup.StartTime)
+	defer os.Remove(filepath.Join(tmpDir, backup.LocalRaftFileName))
+
+	if err := backup.writeSnapshotLocal(); err != nil {
+		t.Fatalf("Unable to write native snapshot: %v", err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(tmpDir, backup.LocalRaftFileName))
+	if err != nil {
+		t.Fatalf("Unable to read native snapshot: %v", err)
+	}
+	if string(data) != "raft snapshot" {
+		t.Errorf("Expected snapshot contents to be written, got %q", data)
+	}
+	if backup.RaftFileChecksum == "" {
+		t.Error("Expected snapshot checksum to be set")
+	}
+
+	mockClient.SnapshotError = fmt.Errorf("no leader")
+	if err := backup.writeSnapshotLocal(); err == nil {
+		t.Error("Expected an error when consul cannot save a snapshot")
+	}
+}
+
+func TestPlanIncremental(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chain")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf := &config.Config{TmpDir: dir, Incremental: true, FullBackupInterval: time.Hour}
+	first := &Backup{
+		Config:    conf,
+		StartTime: 1000,
+		Client: &consul.Consul{KeyData: consulapi.KVPairs{
+			{Key: "a", Value: []byte("1"), ModifyIndex: 10},
+			{Key: "b", Value: []byte("2"), ModifyIndex: 20},
+			{Key: "c", Value: []byte("3"), ModifyIndex: 30},
+		}},
+		RemoteFilePath: "backups/full.tar.gz",
+	}
+	first.planIncremental()
+	if first.BackupType != BackupTypeFull || first.KVIndex != 30 {
+		t.Fatalf("expected a full backup at index 30 without a chain, got %v at %v", first.BackupType, first.KVIndex)
+	}
+	first.saveChainState()
+
+	second := &Backup{
+		Config:    conf,
+		StartTime: 1060,
+		Client: &consul.Consul{KeyData: consulapi.KVPairs{
+			{Key: "a", Value: []byte("1"), ModifyIndex: 10},
+			{Key: "b", Value: []byte("new"), ModifyIndex: 40},
+			{Key: "d", Value: []byte("4"), ModifyIndex: 41},
+		}},
+		RemoteFilePath: "backups/incremental.tar.gz",
+	}
+	second.planIncremental()
+	if second.BackupType != BackupTypeIncremental {
+		t.Fatalf("expected an incremental backup, got %v", second.BackupType)
+	}
+	if second.ParentBackup != "backups/full.tar.gz" || second.FullBackup != "backups/full.tar.gz" {
+		t.Errorf("unexpected chain %v -> %v", second.FullBackup, second.ParentBackup)
+	}
+	var changed consulapi.KVPairs
+	if err := json.Unmarshal(second.KVJSONData, &changed); err != nil {
+		t.Fatalf("Unable to unmarshal keys: %v", err)
+	}
+	if len(changed) != 2 || changed[0].Key != "b" || changed[1].Key != "d" {
+		t.Errorf("expected b and d to be backed up, got %v", changed)
+	}
+	if !reflect.DeepEqual(second.Tombstones, []string{"c"}) {
+		t.Errorf("expected c to be tombstoned, got %v", second.Tombstones)
+	}
+	second.saveChainState()
+
+	state, err := readChainState(dir, &conf.KVFilter)
+	if err != nil || state == nil {
+		t.Fatalf("expected chain state, got %v %v", state, err)
+	}
+	if state.FullBackup != "backups/full.tar.gz" || state.LastBackup != "backups/incremental.tar.gz" || state.KVIndex != 41 {
+		t.Errorf("unexpected chain state %+v", state)
+	}
+
+	// the full backup interval starts a new chain
+	third := &Backup{Config: conf, StartTime: 1000 + 3600, Client: second.Client}
+	third.planIncremental()
+	if third.BackupType != BackupTypeFull {
+		t.Errorf("expected a full backup once the interval passed, got %v", third.BackupType)
+	}
+
+	// so do indexes going backwards after a cluster was rebuilt
+	rebuilt := &Backup{Config: conf, StartTime: 1120, Client: &consul.Consul{KeyData: consulapi.KVPairs{
+		{Key: "a", Value: []byte("1"), ModifyIndex: 5},
+	}}}
+	rebuilt.planIncremental()
+	if rebuilt.BackupType != BackupTypeFull {
+		t.Errorf("expected a full backup after indexes went backwards, got %v", rebuilt.BackupType)
+	}
+
+	// and keys the chain never saw that have indexes below it, like the
+	// keys of a restored snapshot
+	restored := &Backup{Config: conf, StartTime: 1120, Client: &consul.Consul{KeyData: consulapi.KVPairs{
+		{Key: "a", Value: []byte("1"), ModifyIndex: 10},
+		{Key: "e", Value: []byte("5"), ModifyIndex: 15},
+	}}}
+	restored.planIncremental()
+	if restored.BackupType != BackupTypeFull {
+		t.Errorf("expected a full backup for a new key below the chain index, got %v", restored.BackupType)
+	}
+}
+
+func TestUnchanged(t *testing.T) {
+	mockClient := mocks.NewMockConsulClient()
+	client := consul.NewConsul(mockClient)
+	client.KeyData = consulapi.KVPairs{
+		{Key: "service/web/config", Value: []byte("web"), ModifyIndex: 10},
+		{Key: "service/consul-snapshot/lastbackup", Value: []byte("1000"), ModifyIndex: 11},
+	}
+	b := &Backup{Config: &config.Config{SkipUnchanged: true}, Client: client, PQJSONData: []byte("[]")}
+
+	if b.unchanged() {
+		t.Fatal("expected the first backup to be taken")
+	}
+	b.saveChecksum()
+	if !b.unchanged() {
+		t.Error("expected a backup of the same data to be skipped")
+	}
+
+	// consul-snapshot's own keys change with every backup
+	client.KeyData[1] = &consulapi.KVPair{Key: "service/consul-snapshot/lastbackup", Value: []byte("1060"), ModifyIndex: 12}
+	if !b.unchanged() {
+		t.Error("expected the last backup timestamp to be ignored")
+	}
+
+	client.KeyData[0] = &consulapi.KVPair{Key: "service/web/config", Value: []byte("changed"), ModifyIndex: 13}
+	if b.unchanged() {
+		t.Error("expected a changed key to be backed up")
+	}
+
+	b.Client.KeyData[0] = &consulapi.KVPair{Key: "service/web/config", Value: []byte("web"), ModifyIndex: 10}
+	b.PQJSONData = []byte(`[{"ID":"99"}]`)
+	if b.unchanged() {
+		t.Error("expected a changed prepared query to be backed up")
+	}
+
+	mockClient.KeyError = fmt.Errorf("no leader")
+	b.PQJSONData = []byte("[]")
+	if b.unchanged() {
+		t.Error("expected the backup to be taken when the last checksum can not be read")
+	}
+}
+
+func TestUnchangedPerSchedule(t *testing.T) {
+	mockClient := mocks.NewMockConsulClient()
+	client := consul.NewConsul(mockClient)
+	client.KeyData = consulapi.KVPairs{{Key: "service/web/config", Value: []byte("web"), ModifyIndex: 10}}
+	short := &Backup{Config: &config.Config{SkipUnchanged: true, ScheduleName: "short"}, Client: client, PQJSONData: []byte("[]")}
+	long := &Backup{Config: &config.Config{SkipUnchanged: true, ScheduleName: "long"}, Client: client, PQJSONData: []byte("[]")}
+
+	if short.unchanged() {
+		t.Fatal("expected the first backup of the short schedule to be taken")
+	}
+	short.saveChecksum()
+	if long.unchanged() {
+		t.Error("expected the long schedule not to be skipped for content the short schedule uploaded")
+	}
+	long.saveChecksum()
+	if !short.unchanged() || !long.unchanged() {
+		t.Error("expected both schedules to skip content they uploaded themselves")
+	}
+	if short.checksumKey() != lastChecksumKey+"/short" {
+		t.Errorf("unexpected checksum key %s", short.checksumKey())
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	start := time.Unix(1000, 0)
+	s := &schedule{debounce: 10 * time.Second, minInterval: time.Minute, maxAge: 30 * time.Minute}
+	if !s.next().Before(start) {
+		t.Errorf("expected the first backup to be due straight away, got %v", s.next())
+	}
+
+	s.done(start)
+	if !s.next().Equal(start.Add(30 * time.Minute)) {
+		t.Errorf("expected the next backup at the max age without changes, got %v", s.next())
+	}
+
+	// the minimum interval holds back a change right after a backup
+	s.change(start.Add(5 * time.Second))
+	if !s.next().Equal(start.Add(time.Minute)) {
+		t.Errorf("expected the next backup after the minimum interval, got %v", s.next())
+	}
+
+	// later changes wait for the debounce
+	s.change(start.Add(2 * time.Minute))
+	s.change(start.Add(2*time.Minute + 5*time.Second))
+	if !s.next().Equal(start.Add(2*time.Minute + 15*time.Second)) {
+		t.Errorf("expected the next backup after the debounce, got %v", s.next())
+	}
+
+	// changes that never settle are still backed up at the max age
+	s.change(start.Add(30*time.Minute - time.Second))
+	if !s.next().Equal(start.Add(30 * time.Minute)) {
+		t.Errorf("expected the next backup at the max age, got %v", s.next())
+	}
+}
+
+func TestWatchIndex(t *testing.T) {
+	oldMinPoll := watchMinPoll
+	watchMinPoll = 0
+	defer func() { watchMinPoll = oldMinPoll }()
+
+	indexes := []uint64{5, 5, 6, 8, 3}
+	calls := make(chan uint64, len(indexes))
+	index := func(waitIndex uint64, wait time.Duration) (uint64, error) {
+		if len(indexes) == 0 {
+			close(calls)
+			select {}
+		}
+		calls <- waitIndex
+		next := indexes[0]
+		indexes = indexes[1:]
+		return next, nil
+	}
+
+	changes := make(chan string, 10)
+	go watchIndex("keys", index, func(index uint64) bool { return index == 8 }, changes)
+
+	var waited []uint64
+	for waitIndex := range calls {
+		waited = append(waited, waitIndex)
+	}
+	if !reflect.DeepEqual(waited, []uint64{0, 5, 5, 6, 8}) {
+		t.Errorf("expected every query to wait on the last index, got %v", waited)
+	}
+	// 6 is a change, 8 is ignored and 3 went backwards
+	if len(changes) != 2 {
+		t.Errorf("expected 2 changes, got %v", len(changes))
+	}
+}
+
+func TestOwnWrite(t *testing.T) {
+	mockClient := mocks.NewMockConsulClient()
+	b := &Backup{Client: consul.NewConsul(mockClient), StartTime: 1000, ContentChecksum: "abc"}
+
+	b.writeLastBackup()
+	b.saveChecksum()
+	if _, _, err := mockClient.KVTxn(consulapi.KVTxnOps{{Verb: consulapi.KVSet, Key: "service/web/config"}}); err != nil {
+		t.Fatalf("Unable to write a service key: %v", err)
+	}
+
+	indexes := make(map[string]uint64)
+	for _, kv := range mockClient.KeyData {
+		indexes[kv.Key] = kv.ModifyIndex
+	}
+	if !ownWrite(indexes["service/consul-snapshot/lastbackup"]) || !ownWrite(indexes[lastChecksumKey]) {
+		t.Errorf("expected the status keys to be own writes, got %v", indexes)
+	}
+	if ownWrite(indexes["service/web/config"]) {
+		t.Error("expected a service key not to be an own write")
+	}
+}
+
+func TestScheduledRuns(t *testing.T) {
+	hourly, _ := cron.Parse("5 * * * *", nil)
+	nightly, _ := cron.Parse("0 2 * * *", nil)
+	never, _ := cron.Parse("0 0 31 2 *", nil)
+	now := time.Date(2017, 8, 16, 9, 33, 40, 0, time.UTC)
+
+	jittered := &config.Schedule{Name: "hourly", Expr: hourly, Jitter: 2 * time.Minute}
+	for i := 0; i < 20; i++ {
+		at := nextRun(jittered, now)
+		earliest := time.Date(2017, 8, 16, 10, 5, 0, 0, time.UTC)
+		if at.Before(earliest) || !at.Before(earliest.Add(2*time.Minute)) {
+			t.Fatalf("expected the run within the jitter after %v, got %v", earliest, at)
+		}
+	}
+
+	runs := []*scheduledRun{
+		{schedule: &config.Schedule{Name: "never", Expr: never}, at: nextRun(&config.Schedule{Expr: never}, now)},
+		{schedule: &config.Schedule{Name: "nightly", Expr: nightly}, at: nextRun(&config.Schedule{Expr: nightly}, now)},
+		{schedule: &config.Schedule{Name: "hourly", Expr: hourly}, at: nextRun(&config.Schedule{Expr: hourly}, now)},
+	}
+	if first := firstDue(runs); first == nil || first.schedule.Name != "hourly" {
+		t.Errorf("expected the hourly schedule to be due first, got %+v", first)
+	}
+	if first := firstDue(runs[:1]); first != nil {
+		t.Errorf("expected a schedule that never runs to never be due, got %+v", first)
+	}
+}
+
+func TestChainStatePerScope(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chain")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	all := &filter.KV{}
+	payments := &filter.KV{IncludePrefixes: []string{"service/payments/"}}
+	if chainStatePath(dir, all) == chainStatePath(dir, payments) {
+		t.Fatal("expected schedules with different keys to keep separate chains")
+	}
+	if err := writeChainState(dir, payments, &chainState{LastBackup: "backups/payments.tar.gz"}); err != nil {
+		t.Fatalf("writeChainState failed: %v", err)
+	}
+	if state, err := readChainState(dir, all); err != nil || state != nil {
+		t.Errorf("expected no chain for all keys, got %+v %v", state, err)
+	}
+	if state, err := readChainState(dir, payments); err != nil || state == nil || state.LastBackup != "backups/payments.tar.gz" {
+		t.Errorf("expected the payments chain, got %+v %v", state, err)
+	}
+}
+
+func TestForceFullBackup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chain")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf := &config.Config{TmpDir: dir, Incremental: true, FullBackupInterval: time.Hour}
+	client := &consul.Consul{KeyData: consulapi.KVPairs{{Key: "a", ModifyIndex: 10}}}
+	first := &Backup{Config: conf, Client: client, StartTime: 1000, RemoteFilePath: "backups/first.tar.gz"}
+	first.planIncremental()
+	first.saveChainState()
+
+	nightly := conf.ForSchedule(&config.Schedule{Type: config.ScheduleFull, RetentionClass: "long"})
+	second := &Backup{Config: nightly, Client: client, StartTime: 1060}
+	second.planIncremental()
+	if second.BackupType != BackupTypeFull {
+		t.Errorf("expected a full schedule to take a full backup, got %v", second.BackupType)
+	}
+}
+
+// waitFor polls cond until it holds or a second passed
+func waitFor(cond func() bool) bool {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if cond() {
+			return true
+		}
+	}
+	return false
+}
+
+func TestLeaderElection(t *testing.T) {
+	lock := mocks.NewMockLocker()
+	l := &leadership{}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		l.elect("service/consul-snapshot/leader", lock, stop)
+		close(done)
+	}()
+	defer health.SetRole("")
+
+	if !waitFor(l.isLeader) {
+		t.Fatal("Expected to become the leader")
+	}
+	if health.Role() != health.RoleLeader {
+		t.Errorf("Expected the health role %s, got %s", health.RoleLeader, health.Role())
+	}
+
+	backups := 0
+	backup := l.guard(func(*config.Config) error { backups++; return nil })
+	_ = backup(&config.Config{})
+	if backups != 1 {
+		t.Errorf("Expected the leader to take a backup, took %v", backups)
+	}
+
+	// losing the lock releases it and waits for it again
+	lock.Lost <- struct{}{}
+	if !waitFor(func() bool { return lock.LockCount() == 2 && l.isLeader() }) {
+		t.Fatalf("Expected to wait for the lock again, locked %v times", lock.LockCount())
+	}
+
+	close(stop)
+	<-done
+	if l.isLeader() || health.Role() != health.RoleFollower {
+		t.Errorf("Expected to stop leading, role %s", health.Role())
+	}
+	if lock.Unlocks != 2 {
+		t.Errorf("Expected the lock to be released after it was lost and on stop, released %v times", lock.Unlocks)
+	}
+	_ = backup(&config.Config{})
+	if backups != 1 {
+		t.Errorf("Expected a follower not to take backups, took %v", backups)
+	}
+}
+
+func TestLeaderElectionRetry(t *testing.T) {
+	leaderRetryWait = time.Millisecond
+	defer func() { leaderRetryWait = 10 * time.Second }()
+
+	lock := mocks.NewMockLocker()
+	lock.LockError = fmt.Errorf("no cluster leader")
+	l := &leadership{}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		l.elect("service/consul-snapshot/leader", lock, stop)
+		close(done)
+	}()
+	defer health.SetRole("")
+
+	if !waitFor(func() bool { return lock.LockCount() > 2 }) {
+		t.Fatal("Expected failed lock attempts to be retried")
+	}
+	if l.isLeader() {
+		t.Error("Expected not to lead without the lock")
+	}
+	close(stop)
+	<-done
+}
@@ -0,0 +1,227 @@
+package backup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/pshima/consul-snapshot/filter"
+)
+
+// Backup types recorded in the metadata of JSON backups
+const (
+	// BackupTypeFull holds every key
+	BackupTypeFull = "full"
+	// BackupTypeIncremental holds the keys that changed since ParentBackup
+	// and the keys deleted since then
+	BackupTypeIncremental = "incremental"
+)
+
+// chainStateFile is where the daemon remembers the previous backup so the
+// next one can be incremental.  Without it the next backup is full.
+const chainStateFile = "consul-snapshot.chain%s.json"
+
+// chainState describes the last backup uploaded in an incremental chain
+type chainState struct {
+	FullBackup    string
+	FullStartTime int64
+	LastBackup    string
+	KVIndex       uint64
+	KVFilter      string
+	// Keys holds the ModifyIndex of every key in the last backup, to find
+	// deleted keys and clusters whose indexes went backwards
+	Keys map[string]uint64
+}
+
+// chainStatePath is the state of the chain of backups of the keys matching
+// f.  Schedules backing up different keys each keep their own chain.
+func chainStatePath(dir string, f *filter.KV) string {
+	scope := ""
+	if !f.Empty() {
+		sum := sha256.Sum256([]byte(f.String()))
+		scope = "." + hex.EncodeToString(sum[:6])
+	}
+	return filepath.Join(dir, fmt.Sprintf(chainStateFile, scope))
+}
+
+// readChainState returns the state of the last incremental chain of the
+// keys matching f, or nil if there is none
+func readChainState(dir string, f *filter.KV) (*chainState, error) {
+	path := chainStatePath(dir, f)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	state := &chainState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("Unable to parse %s: %v", path, err)
+	}
+	return state, nil
+}
+
+// writeChainState replaces the chain state, writing it to a temporary file
+// first so an interrupted write never leaves half a state behind
+func writeChainState(dir string, f *filter.KV, state *chainState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	path := chainStatePath(dir, f)
+	if err := ioutil.WriteFile(path+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// maxModifyIndex is the highest ModifyIndex of any key
+func maxModifyIndex(keys consulapi.KVPairs) uint64 {
+	var index uint64
+	for _, kv := range keys {
+		if kv.ModifyIndex > index {
+			index = kv.ModifyIndex
+		}
+	}
+	return index
+}
+
+// fullBackupReason returns why the next backup can not build on the chain,
+// or "" when it can be incremental
+func (s *chainState) fullBackupReason(b *Backup) string {
+	if b.Config.ForceFullBackup {
+		return "the schedule takes full backups"
+	}
+	if s.KVFilter != b.Config.KVFilter.String() {
+		return "the key filter changed since the last full backup"
+	}
+	fullAge := time.Duration(b.StartTime-s.FullStartTime) * time.Second
+	if fullAge >= b.Config.FullBackupInterval {
+		return fmt.Sprintf("the last full backup is %v old", fullAge)
+	}
+	// a cluster rebuilt from scratch starts its indexes again, and a
+	// restored snapshot brings back keys with old indexes, either way keys
+	// could have indexes the next backup would not look past
+	for _, kv := range b.Client.KeyData {
+		index, ok := s.Keys[kv.Key]
+		if ok && kv.ModifyIndex < index {
+			return fmt.Sprintf("the index of key %s went backwards", kv.Key)
+		}
+		if !ok && kv.ModifyIndex <= s.KVIndex {
+			return fmt.Sprintf("key %s is not in the chain but has an index below it", kv.Key)
+		}
+	}
+	return ""
+}
+
+// planIncremental decides whether this backup is full or incremental.  An
+// incremental backup only keeps the keys whose ModifyIndex is above the
+// index of the previous backup, and lists the keys deleted since then as
+// tombstones.
+func (b *Backup) planIncremental() {
+	keys := b.Client.KeyData
+	b.BackupType = BackupTypeFull
+	b.KVIndex = maxModifyIndex(keys)
+
+	state, err := readChainState(b.Config.TmpDir, &b.Config.KVFilter)
+	if err != nil {
+		log.Printf("[WARN] Unable to read the incremental backup state, taking a full backup: %v", err)
+		return
+	}
+	if state == nil {
+		log.Print("[INFO] No previous backup to build on, taking a full backup")
+		return
+	}
+	if reason := state.fullBackupReason(b); reason != "" {
+		log.Printf("[INFO] Taking a full backup, %s", reason)
+		return
+	}
+
+	// deleting the key with the highest index lowers the maximum, the next
+	// backup still has to start from the old one
+	if state.KVIndex > b.KVIndex {
+		b.KVIndex = state.KVIndex
+	}
+
+	changed := consulapi.KVPairs{}
+	live := make(map[string]bool, len(keys))
+	for _, kv := range keys {
+		live[kv.Key] = true
+		if kv.ModifyIndex > state.KVIndex {
+			changed = append(changed, kv)
+		}
+	}
+	b.Tombstones = []string{}
+	for key := range state.Keys {
+		if !live[key] {
+			b.Tombstones = append(b.Tombstones, key)
+		}
+	}
+	sort.Strings(b.Tombstones)
+
+	jsonData, err := json.Marshal(changed)
+	if err != nil {
+		log.Fatalf("[ERR] Could not encode keys to json!: %v", err)
+	}
+	b.KVJSONData = jsonData
+	b.BackupType = BackupTypeIncremental
+	b.FullBackup = state.FullBackup
+	b.ParentBackup = state.LastBackup
+	b.fullStartTime = state.FullStartTime
+	log.Printf("[INFO] Taking an incremental backup of %v changed and %v deleted keys since %s",
+		len(changed), len(b.Tombstones), state.LastBackup)
+}
+
+// writeTombstonesLocal writes the keys deleted since the parent backup to
+// the staging directory and records their checksum
+func (b *Backup) writeTombstonesLocal() error {
+	log.Print("[INFO] Writing tombstones to local backup file")
+	data, err := json.Marshal(b.Tombstones)
+	if err != nil {
+		return fmt.Errorf("[ERR] Could not encode tombstones to json: %v", err)
+	}
+	if err := writeFileLocal(b.LocalFilePath, b.LocalTombstonesFileName, data); err != nil {
+		return fmt.Errorf("[ERR] Unable to write file %s/%s: %v", b.LocalFilePath, b.LocalTombstonesFileName, err)
+	}
+
+	checksum, err := calcSha256(filepath.Join(b.LocalFilePath, b.LocalTombstonesFileName))
+	if err != nil {
+		return fmt.Errorf("[ERR] Unable to generate checksum for file %s: %v", b.LocalTombstonesFileName, err)
+	}
+	b.TombstonesFileChecksum = checksum
+	return nil
+}
+
+// saveChainState records the uploaded backup as the parent of the next one
+func (b *Backup) saveChainState() {
+	state := &chainState{
+		FullBackup:    b.RemoteFilePath,
+		FullStartTime: b.StartTime,
+		LastBackup:    b.RemoteFilePath,
+		KVIndex:       b.KVIndex,
+		KVFilter:      b.Config.KVFilter.String(),
+		Keys:          make(map[string]uint64, len(b.Client.KeyData)),
+	}
+	if b.BackupType == BackupTypeIncremental {
+		state.FullBackup = b.FullBackup
+		state.FullStartTime = b.fullStartTime
+	}
+	for _, kv := range b.Client.KeyData {
+		state.Keys[kv.Key] = kv.ModifyIndex
+	}
+
+	// the next backup is full when this fails, nothing is lost
+	if err := writeChainState(b.Config.TmpDir, &b.Config.KVFilter, state); err != nil {
+		log.Printf("[WARN] Unable to save the incremental backup state, the next backup will be full: %v", err)
+	}
+}
@@ -0,0 +1,125 @@
+package backup
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/pshima/consul-snapshot/config"
+	"github.com/pshima/consul-snapshot/consul"
+	"github.com/pshima/consul-snapshot/health"
+	"github.com/pshima/consul-snapshot/interfaces"
+)
+
+// leaderRetryWait is the wait after failing to wait for the lock
+var leaderRetryWait = 10 * time.Second
+
+// leadership tracks whether this daemon holds the lock that makes it the
+// one taking backups
+type leadership struct {
+	mu     sync.Mutex
+	leader bool
+}
+
+func (l *leadership) isLeader() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.leader
+}
+
+func (l *leadership) set(leader bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.leader = leader
+	if leader {
+		health.SetRole(health.RoleLeader)
+	} else {
+		health.SetRole(health.RoleFollower)
+	}
+}
+
+// elect waits for the lock, leads while it is held and waits again when it
+// is lost, until stop is closed.  The lock is released when elect returns.
+func (l *leadership) elect(key string, lock interfaces.Locker, stop <-chan struct{}) {
+	for {
+		l.set(false)
+		log.Printf("[INFO] Waiting for the leader lock on %s", key)
+		lost, err := lock.Lock(stop)
+		if err != nil {
+			log.Printf("[WARN] Unable to wait for the leader lock, retrying: %v", err)
+			select {
+			case <-time.After(leaderRetryWait):
+				continue
+			case <-stop:
+				return
+			}
+		}
+		if lost == nil {
+			return
+		}
+
+		log.Print("[INFO] Acquired the leader lock, taking backups")
+		l.set(true)
+		select {
+		case <-lost:
+			log.Print("[WARN] Lost the leader lock, leaving backups to the new leader")
+			// the lock still counts itself as held and renews its session
+			// until it is unlocked, it could not be taken again otherwise
+			if err := lock.Unlock(); err != nil && err != consulapi.ErrLockNotHeld {
+				log.Printf("[DEBUG] Unable to release the lost leader lock: %v", err)
+			}
+		case <-stop:
+			l.set(false)
+			if err := lock.Unlock(); err != nil {
+				log.Printf("[WARN] Unable to release the leader lock: %v", err)
+			}
+			return
+		}
+	}
+}
+
+// guard only lets the leader take backups.  A backup already running when
+// the lock is lost still finishes, the new leader's next backup follows it.
+func (l *leadership) guard(backup func(*config.Config) error) func(*config.Config) error {
+	return func(conf *config.Config) error {
+		if !l.isLeader() {
+			log.Print("[INFO] Not the leader, skipping the backup")
+			return nil
+		}
+		return backup(conf)
+	}
+}
+
+// startElection starts taking part in the leader election on the lock key.
+// Stopping the daemon releases the lock so a follower takes over without
+// waiting for the session to expire.
+func startElection(conf *config.Config, client *consul.Consul) *leadership {
+	lock, err := client.Client.NewLock(conf.LockKey, conf.Hostname)
+	if err != nil {
+		log.Fatalf("[ERR] Unable to create the leader lock on %s: %v", conf.LockKey, err)
+	}
+
+	l := &leadership{}
+	l.set(false)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		l.elect(conf.LockKey, lock, stop)
+		close(done)
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Printf("[INFO] Received %v, releasing the leader lock", sig)
+		close(stop)
+		<-done
+		os.Exit(0)
+	}()
+	return l
+}
@@ -0,0 +1,77 @@
+package backup
+
+import (
+	"log"
+	"math/rand"
+	"time"
+
+	"github.com/pshima/consul-snapshot/config"
+)
+
+// scheduledRun is the next run of a schedule
+type scheduledRun struct {
+	schedule *config.Schedule
+	at       time.Time
+}
+
+// nextRun returns when a schedule next runs after now, including its jitter
+func nextRun(s *config.Schedule, now time.Time) time.Time {
+	at := s.Expr.Next(now)
+	if s.Jitter > 0 && !at.IsZero() {
+		at = at.Add(time.Duration(rand.Int63n(int64(s.Jitter))))
+	}
+	return at
+}
+
+// firstDue returns the run that is due first.  Schedules that never run
+// are left out.
+func firstDue(runs []*scheduledRun) *scheduledRun {
+	var first *scheduledRun
+	for _, run := range runs {
+		if run.at.IsZero() {
+			continue
+		}
+		if first == nil || run.at.Before(first.at) {
+			first = run
+		}
+	}
+	return first
+}
+
+// scheduleBackups takes a backup every time one of the schedules runs, with
+// the scope and retention class of that schedule.  Backups run one at a
+// time, a run that is due while another backup is taken starts after it.
+// It never returns.
+func scheduleBackups(conf *config.Config, backup func(*config.Config) error) {
+	now := time.Now()
+	runs := make([]*scheduledRun, 0, len(conf.Schedules))
+	for _, s := range conf.Schedules {
+		run := &scheduledRun{schedule: s, at: nextRun(s, now)}
+		log.Printf("[DEBUG] Schedule %s (%s in %s) next runs at %s",
+			s.Name, s.Expr, s.Expr.Location(), run.at.Format(time.RFC3339))
+		runs = append(runs, run)
+	}
+
+	var lastStart int64
+	for {
+		run := firstDue(runs)
+		if run == nil {
+			log.Fatal("[ERR] None of the backup schedules will ever run")
+		}
+		time.Sleep(time.Until(run.at))
+
+		// backups are named by their start time in seconds, two schedules
+		// running at once must not overwrite each other
+		if time.Now().Unix() <= lastStart {
+			time.Sleep(time.Until(time.Unix(lastStart+1, 0)))
+		}
+		lastStart = time.Now().Unix()
+
+		log.Printf("[INFO] Running backup schedule %s", run.schedule.Name)
+		if err := backup(conf.ForSchedule(run.schedule)); err != nil {
+			log.Fatalf("Error during backup: %s", err.Error())
+		}
+		run.at = nextRun(run.schedule, time.Now())
+		log.Printf("[DEBUG] Schedule %s next runs at %s", run.schedule.Name, run.at.Format(time.RFC3339))
+	}
+}
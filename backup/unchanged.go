@@ -0,0 +1,126 @@
+package backup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// statusPrefix holds the keys consul-snapshot writes about its own backups
+const statusPrefix = "service/consul-snapshot/"
+
+// lastChecksumKey holds the content checksum of the last uploaded backup.
+// Every schedule keeps its own under lastChecksumKey/<schedule name>, so a
+// schedule is only skipped when it uploaded the same content itself.
+const lastChecksumKey = statusPrefix + "lastchecksum"
+
+// checksumKey returns the key holding the content checksum of the last
+// backup of this schedule
+func (b *Backup) checksumKey() string {
+	if b.Config == nil || b.Config.ScheduleName == "" {
+		return lastChecksumKey
+	}
+	return lastChecksumKey + "/" + b.Config.ScheduleName
+}
+
+// putStatus writes a status key in a transaction, which returns the index
+// of the write, and records it so watch mode does not take the write for a
+// change
+func (b *Backup) putStatus(kv *consulapi.KVPair) error {
+	ops := consulapi.KVTxnOps{{Verb: consulapi.KVSet, Key: kv.Key, Value: kv.Value}}
+	ok, resp, err := b.Client.Client.KVTxn(ops)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("transaction writing %s was rolled back", kv.Key)
+	}
+	for _, result := range resp.Results {
+		if result.KV != nil {
+			recordOwnWrite(result.KV.ModifyIndex)
+		}
+	}
+	return nil
+}
+
+// contentChecksum combines the JSON exports in to one checksum.  The keys
+// under statusPrefix change with every backup and are left out, otherwise
+// no two backups would ever be the same.
+func (b *Backup) contentChecksum() (string, error) {
+	keys := consulapi.KVPairs{}
+	for _, kv := range b.Client.KeyData {
+		if !strings.HasPrefix(kv.Key, statusPrefix) {
+			keys = append(keys, kv)
+		}
+	}
+	kvData, err := json.Marshal(keys)
+	if err != nil {
+		return "", fmt.Errorf("Could not encode keys to json: %v", err)
+	}
+
+	calc := sha256.New()
+	for _, data := range [][]byte{
+		[]byte(b.Config.KVFilter.String()),
+		kvData,
+		b.PQJSONData,
+		b.ACLJSONData,
+		b.ACLSystemJSONData,
+		b.ConfigJSONData,
+		b.IntentionsJSONData,
+	} {
+		part := sha256.Sum256(data)
+		calc.Write(part[:])
+	}
+	return hex.EncodeToString(calc.Sum(nil)), nil
+}
+
+// lastChecksum returns the content checksum of the last uploaded backup, or
+// "" when there is none
+func (b *Backup) lastChecksum() (string, error) {
+	key := b.checksumKey()
+	keys, err := b.Client.Client.ListKeys(key)
+	if err != nil {
+		return "", err
+	}
+	for _, kv := range keys {
+		if kv.Key == key {
+			return string(kv.Value), nil
+		}
+	}
+	return "", nil
+}
+
+// unchanged reports whether the backup would hold exactly what the last
+// uploaded one did.  Any doubt means the backup is taken.
+func (b *Backup) unchanged() bool {
+	checksum, err := b.contentChecksum()
+	if err != nil {
+		log.Printf("[WARN] Unable to checksum the backup, it will be uploaded: %v", err)
+		return false
+	}
+	b.ContentChecksum = checksum
+
+	last, err := b.lastChecksum()
+	if err != nil {
+		log.Printf("[WARN] Unable to read the checksum of the last backup, this one will be uploaded: %v", err)
+		return false
+	}
+	return last == checksum
+}
+
+// saveChecksum records the content checksum of the uploaded backup for the
+// next run to compare with
+func (b *Backup) saveChecksum() {
+	if b.ContentChecksum == "" {
+		return
+	}
+	kv := &consulapi.KVPair{Key: b.checksumKey(), Value: []byte(b.ContentChecksum)}
+	if err := b.putStatus(kv); err != nil {
+		log.Printf("[WARN] Unable to save the backup checksum, the next backup will be uploaded: %v", err)
+	}
+}
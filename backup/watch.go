@@ -0,0 +1,177 @@
+package backup
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pshima/consul-snapshot/config"
+	"github.com/pshima/consul-snapshot/consul"
+)
+
+// watchWait is how long a blocking query waits for a change
+var watchWait = 5 * time.Minute
+
+// watchRetryWait is the wait after a failed query, it doubles with every
+// failure up to watchWait
+var watchRetryWait = 10 * time.Second
+
+// watchMinPoll keeps endpoints that answer without blocking from being
+// queried in a tight loop
+var watchMinPoll = time.Second
+
+// indexFunc is a blocking query for the index of some consul data
+type indexFunc func(waitIndex uint64, wait time.Duration) (uint64, error)
+
+// schedule decides when watch mode takes the next backup.  A change is
+// backed up once no further changes came in for the debounce and the
+// minimum interval since the last backup passed.  Without changes a backup
+// is still taken every max age.
+type schedule struct {
+	debounce    time.Duration
+	minInterval time.Duration
+	maxAge      time.Duration
+	lastBackup  time.Time
+	lastChange  time.Time
+	pending     bool
+}
+
+// change records a change in consul
+func (s *schedule) change(now time.Time) {
+	s.pending = true
+	s.lastChange = now
+}
+
+// next returns when the next backup is due
+func (s *schedule) next() time.Time {
+	due := s.lastBackup.Add(s.maxAge)
+	if !s.pending {
+		return due
+	}
+
+	settled := s.lastChange.Add(s.debounce)
+	if spaced := s.lastBackup.Add(s.minInterval); spaced.After(settled) {
+		settled = spaced
+	}
+	if settled.Before(due) {
+		return settled
+	}
+	return due
+}
+
+// done records a backup that started at start, changes before it are in
+// the backup
+func (s *schedule) done(start time.Time) {
+	s.lastBackup = start
+	s.pending = false
+}
+
+// watchIndex runs blocking queries for the index of some consul data and
+// sends name to changes every time it moves.  ignore, if set, can tell
+// changes that do not need a backup apart.  It never returns.
+func watchIndex(name string, index indexFunc, ignore func(index uint64) bool, changes chan<- string) {
+	var last uint64
+	retry := watchRetryWait
+	failing := false
+	for {
+		start := time.Now()
+		next, err := index(last, watchWait)
+		if err != nil {
+			if !failing {
+				log.Printf("[WARN] Unable to watch %s for changes, retrying: %v", name, err)
+			}
+			failing = true
+			time.Sleep(retry)
+			if retry *= 2; retry > watchWait {
+				retry = watchWait
+			}
+			continue
+		}
+		if failing {
+			log.Printf("[INFO] Watching %s for changes again", name)
+		}
+		failing = false
+		retry = watchRetryWait
+
+		// the index going backwards means the data was replaced, e.g. by a
+		// snapshot restore
+		if last != 0 && next != last && (next < last || ignore == nil || !ignore(next)) {
+			select {
+			case changes <- name:
+			default:
+			}
+		}
+		if next == last && time.Since(start) < watchMinPoll {
+			time.Sleep(watchMinPoll - time.Since(start))
+		}
+		last = next
+	}
+}
+
+// ownIndexesKept bounds how many indexes of status writes are remembered
+// for the watch, daemons that do not watch never look them up
+const ownIndexesKept = 16
+
+var (
+	ownMu      sync.Mutex
+	ownIndexes []uint64
+)
+
+// recordOwnWrite remembers the key/value store index of a status key this
+// daemon wrote
+func recordOwnWrite(index uint64) {
+	ownMu.Lock()
+	defer ownMu.Unlock()
+	ownIndexes = append(ownIndexes, index)
+	if len(ownIndexes) > ownIndexesKept {
+		ownIndexes = ownIndexes[len(ownIndexes)-ownIndexesKept:]
+	}
+}
+
+// ownWrite reports whether the key/value store index is exactly that of a
+// status key this daemon wrote after a backup, which would otherwise start
+// the next backup
+func ownWrite(index uint64) bool {
+	ownMu.Lock()
+	defer ownMu.Unlock()
+	for _, own := range ownIndexes {
+		if own == index {
+			return true
+		}
+	}
+	return false
+}
+
+// watchBackups backs up shortly after keys, prepared queries or ACLs change
+// instead of on a fixed interval.  It never returns.
+func watchBackups(conf *config.Config, client *consul.Consul, backup func() error) {
+	changes := make(chan string, 1)
+	go watchIndex("keys", client.Client.KVIndex, ownWrite, changes)
+	go watchIndex("prepared queries", client.Client.PQIndex, nil, changes)
+	go watchIndex("ACLs", client.Client.ACLIndex, nil, changes)
+
+	log.Printf("[DEBUG] Backup watching for changes with a %v debounce, %v minimum interval and %v max age",
+		conf.WatchDebounce, conf.WatchMinInterval, conf.WatchMaxAge)
+	s := &schedule{debounce: conf.WatchDebounce, minInterval: conf.WatchMinInterval, maxAge: conf.WatchMaxAge}
+	for {
+		select {
+		case source := <-changes:
+			log.Printf("[DEBUG] Change detected in %s", source)
+			s.change(time.Now())
+		case <-time.After(time.Until(s.next())):
+			start := time.Now()
+			switch {
+			case s.lastBackup.IsZero():
+				log.Print("[INFO] Taking the first backup")
+			case s.pending:
+				log.Print("[INFO] Backing up changes")
+			default:
+				log.Printf("[INFO] No changes for %v, backing up to keep the backup fresh", conf.WatchMaxAge)
+			}
+			if err := backup(); err != nil {
+				log.Fatalf("Error during backup: %s", err.Error())
+			}
+			s.done(start)
+		}
+	}
+}
@@ -0,0 +1,15 @@
+package command
+
+import "strings"
+
+// stringSliceFlag is a flag.Value for flags that can be given more than once
+type stringSliceFlag []string
+
+func (s *stringSliceFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringSliceFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
@@ -0,0 +1,22 @@
+package command
+
+import (
+	"flag"
+	"testing"
+)
+
+func TestStringSliceFlag(t *testing.T) {
+	var prefixes stringSliceFlag
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.Var(&prefixes, "prefix", "")
+
+	if err := fs.Parse([]string{"-prefix", "service/web/", "-prefix=service/db/"}); err != nil {
+		t.Fatalf("unexpected parse error: %v", err)
+	}
+	if len(prefixes) != 2 || prefixes[0] != "service/web/" || prefixes[1] != "service/db/" {
+		t.Errorf("expected both prefixes to be kept, got %v", prefixes)
+	}
+	if prefixes.String() != "service/web/,service/db/" {
+		t.Errorf("unexpected string value %q", prefixes.String())
+	}
+}
@@ -0,0 +1,138 @@
+package command
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mitchellh/cli"
+	"github.com/pshima/consul-snapshot/config"
+	"github.com/pshima/consul-snapshot/interfaces"
+	"github.com/pshima/consul-snapshot/list"
+)
+
+// ListCommand for listing remote backups
+type ListCommand struct {
+	Meta
+	Version string
+
+	// Storage overrides the storage client from the environment config, it
+	// is set in tests
+	Storage interfaces.StorageClient
+	Config  *config.Config
+}
+
+// Run the list through list.Backups
+func (c *ListCommand) Run(args []string) int {
+	// Set flags
+	var flagSince, flagUntil, flagHost, flagFormat string
+	fs := flag.NewFlagSet("list", flag.ContinueOnError)
+	fs.StringVar(&flagSince, "since", "", "")
+	fs.StringVar(&flagUntil, "until", "", "")
+	fs.StringVar(&flagHost, "host", "", "")
+	fs.StringVar(&flagFormat, "format", "table", "")
+	// Parse flags
+	if err := fs.Parse(args); err != nil {
+		return cli.RunResultHelp
+	}
+
+	if flagFormat != "table" && flagFormat != "json" {
+		c.UI.Error(fmt.Sprintf("Invalid format %q, must be table or json", flagFormat))
+		return 1
+	}
+
+	filter := list.Filter{Host: flagHost}
+	var err error
+	if flagSince != "" {
+		if filter.Since, err = list.ParseTime(flagSince); err != nil {
+			c.UI.Error(err.Error())
+			return 1
+		}
+	}
+	if flagUntil != "" {
+		if filter.Until, err = list.ParseTime(flagUntil); err != nil {
+			c.UI.Error(err.Error())
+			return 1
+		}
+	}
+
+	conf := c.Config
+	if conf == nil {
+		conf = config.ParseConfig(false)
+	}
+
+	storage := c.Storage
+	if storage == nil {
+		if storage, err = list.Storage(conf); err != nil {
+			c.UI.Error(err.Error())
+			return 1
+		}
+	}
+
+	backups, err := list.Backups(storage, list.Bucket(conf), conf.ObjectPrefix, filter)
+	if err != nil {
+		c.UI.Error(err.Error())
+		return 1
+	}
+
+	if flagFormat == "json" {
+		if backups == nil {
+			backups = []list.Backup{}
+		}
+		out, err := json.MarshalIndent(backups, "", "  ")
+		if err != nil {
+			c.UI.Error(fmt.Sprintf("Unable to encode backups to json: %v", err))
+			return 1
+		}
+		c.raw(string(out))
+		return 0
+	}
+
+	if len(backups) == 0 {
+		c.UI.Info("No backups found")
+		return 0
+	}
+
+	var buf bytes.Buffer
+	w := tabwriter.NewWriter(&buf, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "TIMESTAMP\tHOST\tSIZE\tENCRYPTED\tKEY")
+	for _, b := range backups {
+		encrypted := fmt.Sprintf("%v", b.Encrypted)
+		if b.Unreadable != "" {
+			encrypted = "unreadable"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\n", b.Time.Format(time.RFC3339), b.Host, b.Size, encrypted, b.Key)
+	}
+	w.Flush()
+	c.UI.Output(strings.TrimRight(buf.String(), "\n"))
+	return 0
+}
+
+// Synopsis of the command
+func (c *ListCommand) Synopsis() string {
+	return "Lists remote backups"
+}
+
+// Help for the command
+func (c *ListCommand) Help() string {
+	return `
+Usage: consul-snapshot list [options]
+
+Lists the backups under CONSUL_SNAPSHOT_UPLOAD_PREFIX in the configured
+S3 or Google Cloud Storage bucket.
+
+Options:
+  -since=<time>   Only list backups taken at or after this time
+  -until=<time>   Only list backups taken at or before this time
+  -host=<name>    Only list backups taken on this host
+  -format=<fmt>   Output format, table or json (default: table)
+
+Times are unix timestamps, RFC3339 or YYYY-MM-DD[ HH:MM] in local time.
+Every listed backup is read to tell whether it is encrypted, narrow large
+buckets down with the options above.
+`
+}
@@ -0,0 +1,105 @@
+package command
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/mitchellh/cli"
+	"github.com/pshima/consul-snapshot/config"
+	"github.com/pshima/consul-snapshot/list"
+	"github.com/pshima/consul-snapshot/mocks"
+)
+
+func testingListCommand() (*ListCommand, *cli.BasicUi) {
+	ui := &cli.BasicUi{Writer: &bytes.Buffer{}, ErrorWriter: &bytes.Buffer{}}
+	storage := mocks.NewMockStorageClient()
+	storage.Data["bucket/backups/2017/8/16/web1.consul.snapshot.1502901220.tar.gz"] = []byte("v0:encrypted")
+	storage.Data["bucket/backups/2017/8/17/web2.consul.snapshot.1502987620.tar.gz"] = []byte("plain")
+	c := &ListCommand{
+		Meta:    Meta{UI: ui},
+		Version: "test",
+		Storage: storage,
+		Config:  &config.Config{S3Bucket: "bucket", ObjectPrefix: "backups"},
+	}
+	return c, ui
+}
+
+func TestListCommand_Synopsis(t *testing.T) {
+	c := &ListCommand{}
+	if c.Synopsis() != "Lists remote backups" {
+		t.Errorf("unexpected synopsis %q", c.Synopsis())
+	}
+	if !strings.Contains(c.Help(), "Usage: consul-snapshot list") {
+		t.Error("expected help to contain usage information")
+	}
+}
+
+func TestListCommand_RunTable(t *testing.T) {
+	c, ui := testingListCommand()
+
+	if code := c.Run([]string{"-host", "web1"}); code != 0 {
+		t.Fatalf("expected exit code 0, got %d", code)
+	}
+
+	output := ui.Writer.(*bytes.Buffer).String()
+	if !strings.Contains(output, "TIMESTAMP") || !strings.Contains(output, "web1.consul.snapshot.1502901220.tar.gz") {
+		t.Errorf("expected table output with the web1 backup, got %q", output)
+	}
+	if strings.Contains(output, "web2") {
+		t.Errorf("expected web2 to be filtered out, got %q", output)
+	}
+}
+
+func TestListCommand_RunJSON(t *testing.T) {
+	c, ui := testingListCommand()
+
+	if code := c.Run([]string{"-format=json", "-since=1502901221"}); code != 0 {
+		t.Fatalf("expected exit code 0, got %d", code)
+	}
+
+	var backups []list.Backup
+	if err := json.Unmarshal(ui.Writer.(*bytes.Buffer).Bytes(), &backups); err != nil {
+		t.Fatalf("expected json output: %v", err)
+	}
+	if len(backups) != 1 || backups[0].Host != "web2" || backups[0].Encrypted {
+		t.Errorf("unexpected backups %+v", backups)
+	}
+}
+
+func TestListCommand_RunJSONUnprefixed(t *testing.T) {
+	c, ui := testingListCommand()
+	c.UI = &cli.PrefixedUi{OutputPrefix: "[INFO] ", InfoPrefix: "[INFO] ", Ui: ui}
+	stdout := &bytes.Buffer{}
+	c.Stdout = stdout
+
+	if code := c.Run([]string{"-format=json"}); code != 0 {
+		t.Fatalf("expected exit code 0, got %d", code)
+	}
+	var backups []list.Backup
+	if err := json.Unmarshal(stdout.Bytes(), &backups); err != nil {
+		t.Fatalf("expected json output without the UI prefix: %v", err)
+	}
+
+	if code := c.Run([]string{}); code != 0 {
+		t.Fatalf("expected exit code 0, got %d", code)
+	}
+	if !strings.HasPrefix(ui.Writer.(*bytes.Buffer).String(), "[INFO] TIMESTAMP") {
+		t.Errorf("expected table output to keep the UI prefix, got %q", ui.Writer.(*bytes.Buffer).String())
+	}
+}
+
+func TestListCommand_RunBadFlags(t *testing.T) {
+	c, ui := testingListCommand()
+
+	if code := c.Run([]string{"-format=xml"}); code != 1 {
+		t.Errorf("expected exit code 1 for a bad format, got %d", code)
+	}
+	if code := c.Run([]string{"-until=yesterday"}); code != 1 {
+		t.Errorf("expected exit code 1 for a bad time, got %d", code)
+	}
+	if !strings.Contains(ui.ErrorWriter.(*bytes.Buffer).String(), "Unable to parse time") {
+		t.Error("expected an error about the unparsable time")
+	}
+}
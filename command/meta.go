@@ -1,8 +1,26 @@
 package command
 
-import "github.com/mitchellh/cli"
+import (
+	"fmt"
+	"io"
+
+	"github.com/mitchellh/cli"
+)
 
 // Meta for command metadata
 type Meta struct {
 	UI cli.Ui
+	// Stdout receives machine readable output, such as -format=json, which
+	// has to be written without the UI prefixes.  The UI is used when it is
+	// not set.
+	Stdout io.Writer
+}
+
+// raw writes machine readable output
+func (m *Meta) raw(out string) {
+	if m.Stdout == nil {
+		m.UI.Output(out)
+		return
+	}
+	fmt.Fprintln(m.Stdout, out)
 }
@@ -1,28 +1,232 @@
 package command
 
 import (
+	"flag"
 	"fmt"
+	"log"
+	"time"
+
+	"github.com/mitchellh/cli"
+	"github.com/pshima/consul-snapshot/config"
+	"github.com/pshima/consul-snapshot/filter"
+	"github.com/pshima/consul-snapshot/interfaces"
+	"github.com/pshima/consul-snapshot/list"
 	"github.com/pshima/consul-snapshot/restore"
+	"github.com/pshima/consul-snapshot/rewrite"
 )
 
 // RestoreCommand for running restores
 type RestoreCommand struct {
 	Meta
 	Version string
+
+	// Storage overrides the storage client used to find backups, it is set
+	// in tests
+	Storage interfaces.StorageClient
+	Config  *config.Config
+
+	// quiet sends status messages to the log instead of the UI so only the
+	// report is written to stdout
+	quiet bool
 }
 
 // Run the restore through restore.Runner
 func (c *RestoreCommand) Run(args []string) int {
+	// Set flags
+	var opts restore.Options
+	var flagBefore, flagHost string
+	var flagPrefixes, flagExcludePrefixes, flagRewrites stringSliceFlag
+	var flagRewriteFile string
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	fs.BoolVar(&opts.Native, "native", false, "")
+	fs.StringVar(&flagBefore, "before", "", "")
+	fs.StringVar(&flagHost, "host", "", "")
+	fs.BoolVar(&opts.DryRun, "dry-run", false, "")
+	fs.StringVar(&opts.Format, "format", "text", "")
+	fs.BoolVar(&opts.Force, "force", false, "")
+	fs.BoolVar(&opts.AllowDatacenterMismatch, "allow-datacenter-mismatch", false, "")
+	fs.StringVar(&opts.Mode, "mode", restore.ModeMerge, "")
+	fs.BoolVar(&opts.Txn, "txn", true, "")
+	fs.StringVar(&opts.OnConflict, "on-conflict", restore.ConflictOverwrite, "")
+	fs.BoolVar(&opts.WarnLocks, "warn-locks", false, "")
+	fs.IntVar(&opts.Concurrency, "concurrency", 4, "")
+	fs.IntVar(&opts.Rate, "rate", 0, "")
+	fs.StringVar(&opts.Resume, "resume", "", "")
+	fs.BoolVar(&opts.Verify, "verify", true, "")
+	fs.Var(&flagRewrites, "rewrite", "")
+	fs.StringVar(&flagRewriteFile, "rewrite-file", "", "")
+	fs.Var(&flagPrefixes, "prefix", "")
+	fs.Var(&flagExcludePrefixes, "exclude-prefix", "")
+	// Parse flags, allowing them after the path as in "restore latest -host web1"
+	args, err := parseInterspersed(fs, args)
+	if err != nil {
+		return cli.RunResultHelp
+	}
+
+	// -before and -host on their own select the latest matching backup
+	if len(args) == 0 && (flagBefore != "" || flagHost != "") {
+		args = []string{"latest"}
+	}
+
+	// a journal knows which backup it was restoring
+	if len(args) == 0 && opts.Resume != "" {
+		restorePath, err := restore.JournalRestorePath(opts.Resume)
+		if err != nil {
+			c.UI.Error(err.Error())
+			return 1
+		}
+		args = []string{restorePath}
+	}
+
 	if len(args) != 1 {
 		c.UI.Error("You need to specify a restore file path from base of bucket")
 		return 1
 	}
 
-	c.UI.Info(fmt.Sprintf("v%v: Starting Consul Snapshot", c.Version))
-	response := restore.Runner(args[0])
+	if opts.Format != "text" && opts.Format != "json" {
+		c.UI.Error(fmt.Sprintf("Invalid format %q, must be text or json", opts.Format))
+		return 1
+	}
+	if opts.Mode != restore.ModeMerge && opts.Mode != restore.ModeMirror {
+		c.UI.Error(fmt.Sprintf("Invalid mode %q, must be merge or mirror", opts.Mode))
+		return 1
+	}
+	switch opts.OnConflict {
+	case restore.ConflictOverwrite, restore.ConflictSkipExisting, restore.ConflictSkipIfNewer, restore.ConflictFail:
+	default:
+		c.UI.Error(fmt.Sprintf("Invalid conflict policy %q, must be overwrite, skip-existing, skip-if-newer or fail", opts.OnConflict))
+		return 1
+	}
+	if opts.Native && opts.Resume != "" {
+		c.UI.Error("Native snapshot restores can not be resumed")
+		return 1
+	}
+	if opts.Concurrency < 1 || opts.Rate < 0 {
+		c.UI.Error("-concurrency must be at least 1 and -rate can not be negative")
+		return 1
+	}
+	if opts.DryRun && opts.Native {
+		c.UI.Error("Dry runs are not supported for native snapshot restores")
+		return 1
+	}
+	if opts.Native && opts.Mode == restore.ModeMirror {
+		c.UI.Error("Mirror mode is not supported for native snapshot restores, they already replace all cluster state")
+		return 1
+	}
+	for _, prefix := range flagPrefixes {
+		opts.KVFilter.IncludePrefixes = append(opts.KVFilter.IncludePrefixes, filter.NormalizePrefix(prefix))
+	}
+	for _, prefix := range flagExcludePrefixes {
+		opts.KVFilter.ExcludePrefixes = append(opts.KVFilter.ExcludePrefixes, filter.NormalizePrefix(prefix))
+	}
+	if opts.Native && !opts.KVFilter.Empty() {
+		c.UI.Error("Prefix filters are not supported for native snapshot restores")
+		return 1
+	}
+	for _, value := range flagRewrites {
+		rule, err := rewrite.ParseRule(value)
+		if err != nil {
+			c.UI.Error(err.Error())
+			return 1
+		}
+		opts.Rewrite = append(opts.Rewrite, rule)
+	}
+	if flagRewriteFile != "" {
+		rules, err := rewrite.ParseFile(flagRewriteFile)
+		if err != nil {
+			c.UI.Error(err.Error())
+			return 1
+		}
+		opts.Rewrite = append(opts.Rewrite, rules...)
+	}
+	if len(opts.Rewrite) > 0 && (opts.Native || opts.Mode == restore.ModeMirror) {
+		c.UI.Error("Key rewrites can not be combined with -native or -mode=mirror")
+		return 1
+	}
+	c.quiet = opts.DryRun && opts.Format == "json"
+	opts.UI = c.UI
+	opts.Stdout = c.Stdout
+
+	restorePath := args[0]
+	if restorePath == "latest" || flagBefore != "" || flagHost != "" {
+		if restorePath != "latest" {
+			c.UI.Error("-before and -host select a backup, use them with latest instead of a file path")
+			return 1
+		}
+
+		restorePath, err = c.selectBackup(flagBefore, flagHost)
+		if err != nil {
+			c.UI.Error(err.Error())
+			return 1
+		}
+	}
+
+	c.status(fmt.Sprintf("v%v: Starting Consul Snapshot", c.Version))
+	response := restore.Runner(restorePath, opts)
 	return response
 }
 
+// selectBackup finds the newest backup taken at or before a time and on a
+// host, either of which may be empty
+func (c *RestoreCommand) selectBackup(before, host string) (string, error) {
+	filter := list.Filter{Host: host}
+	if before != "" {
+		until, err := list.ParseTime(before)
+		if err != nil {
+			return "", err
+		}
+		filter.Until = until
+	}
+
+	conf := c.Config
+	if conf == nil {
+		conf = config.ParseConfig(false)
+	}
+
+	storage := c.Storage
+	if storage == nil {
+		var err error
+		if storage, err = list.Storage(conf); err != nil {
+			return "", err
+		}
+	}
+
+	backup, err := list.Latest(storage, list.Bucket(conf), conf.ObjectPrefix, filter)
+	if err != nil {
+		return "", err
+	}
+
+	c.status(fmt.Sprintf("Selected backup %s taken on %s at %s",
+		backup.Key, backup.Host, backup.Time.Format(time.RFC3339)))
+	return backup.Key, nil
+}
+
+// status writes a progress message for the operator
+func (c *RestoreCommand) status(message string) {
+	if c.quiet {
+		log.Printf("[INFO] %s", message)
+		return
+	}
+	c.UI.Info(message)
+}
+
+// parseInterspersed parses flags that come before or after positional
+// arguments and returns the positional arguments
+func parseInterspersed(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
 // Synopsis of the command
 func (c *RestoreCommand) Synopsis() string {
 	return "Starts a Restore"
@@ -31,8 +235,91 @@ func (c *RestoreCommand) Synopsis() string {
 // Help for the command
 func (c *RestoreCommand) Help() string {
 	return `
-Usage: consul-snapshot restore filename.backup
+Usage: consul-snapshot restore [options] filename.backup
+       consul-snapshot restore [options] latest
+       consul-snapshot restore [options] -resume=<journal>
+
+Starts a restore process from a backup path relative to the base of the
+bucket, or from the newest backup when latest is given.
+
+Before anything is written the restore shows the target cluster, the backup
+host and age and how many keys will be overwritten, and asks for
+confirmation.
 
-Starts a restore process
+Options:
+  -allow-datacenter-mismatch
+                  Restore a backup taken in a different datacenter than the
+                  target cluster, or when the datacenter of the target
+                  cluster can not be determined, which is refused otherwise
+  -before=<time>  With latest, restore the newest backup taken at or before
+                  this time. Times are unix timestamps, RFC3339 or
+                  YYYY-MM-DD[ HH:MM] in local time.
+  -concurrency=<n>
+                  Number of keys, or transactions with -txn, written at
+                  once (default: 4)
+  -dry-run        Download and parse the backup and report which keys,
+                  prepared queries and ACLs would be created, updated or left
+                  unchanged, without writing anything
+  -exclude-prefix=<prefix>
+                  Do not restore keys under this prefix, can be repeated.
+                  The rest of the backup is restored as usual.
+  -force          Restore without asking for confirmation, for automation
+  -format=<fmt>   Dry run report format, text or json (default: text)
+  -host=<name>    With latest, only consider backups taken on this host
+  -mode=<mode>    merge writes the keys in the backup and leaves other keys
+                  alone. mirror also deletes live keys that are not in the
+                  backup, limited to the restored prefixes and to what the
+                  backup captured. (default: merge)
+  -native         Restore the native consul snapshot in the backup instead of
+                  the JSON data. This replaces all of the cluster state.
+                  Backups taken with CONSUL_SNAPSHOT_BACKUP_MODE=native are
+                  always restored this way.
+  -on-conflict=<policy>
+                  What to do with keys whose value or flags in the cluster
+                  differ from the backup. overwrite writes the backup,
+                  skip-existing only creates missing keys, skip-if-newer
+                  leaves keys that changed since the backup alone and fail
+                  refuses to restore. skip-if-newer compares key indexes, so
+                  it only works for backups of the same cluster.
+                  Keys are written with check-and-set, so keys changed while
+                  the restore runs are never overwritten. Every conflicting
+                  key is reported. (default: overwrite)
+  -prefix=<prefix>
+                  Only restore keys under this prefix, can be repeated.
+                  Partial restores only restore keys, prepared queries, ACLs
+                  and service mesh data in the backup are left alone.
+  -rate=<n>       Write at most this many keys, or transactions with -txn,
+                  per second, to avoid overloading a freshly recovered
+                  leader. 0 is unlimited. (default: 0)
+  -resume=<journal>
+                  Continue an interrupted restore from its journal. Restores
+                  record the keys they wrote in a journal in
+                  SNAPSHOT_TMP_DIR, which is kept when a restore does not
+                  finish. The backup is taken from the journal when no path
+                  is given and has to match the one the journal was written
+                  for.
+  -rewrite=<from>=<to>
+                  Restore the keys under the prefix from under the prefix to
+                  instead, e.g. -rewrite prod/=staging/. Can be repeated,
+                  the first rule that matches a key is used. Prefix filters
+                  select keys by their names in the backup.
+  -rewrite-file=<path>
+                  Read rewrite rules from a file, one per line, either
+                  "from => to" or "drop <prefix>" to leave the keys under a
+                  prefix out. Rules in the file come after -rewrite rules.
+                  Dry runs list every renamed and dropped key.
+  -txn            Write keys in transactions of up to 64 keys, retrying a
+                  transaction that fails. Every batch is written completely
+                  or not at all and the restore reports which batches
+                  committed. Use -txn=false to write keys one by one.
+                  (default: true)
+  -verify         After writing, list the restored keys again and compare
+                  them with the backup. Keys that are missing or differ, and
+                  with -mode=mirror keys that are not in the backup, are
+                  reported and the restore exits non-zero. Keys left alone by
+                  the conflict policy are not checked. (default: true)
+  -warn-locks     Warn about keys that were held by a session lock when the
+                  backup was taken. Sessions are not restored, so those keys
+                  are written unlocked.
 `
 }
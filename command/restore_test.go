@@ -6,6 +6,8 @@ import (
 	"testing"
 
 	"github.com/mitchellh/cli"
+	"github.com/pshima/consul-snapshot/config"
+	"github.com/pshima/consul-snapshot/mocks"
 )
 
 func TestRestoreCommand_Synopsis(t *testing.T) {
@@ -81,4 +83,177 @@ func TestRestoreCommand_Run_WithValidArg(t *testing.T) {
 	
 	// The command will likely fail due to missing S3 config, but that's expected in test
 	// We're just testing the command structure, not the full restore process
-}
\ No newline at end of file
+}
+
+func TestRestoreCommand_Run_NativeFlagNeedsPath(t *testing.T) {
+	ui := &cli.BasicUi{Writer: &bytes.Buffer{}, ErrorWriter: &bytes.Buffer{}}
+	c := &RestoreCommand{
+		Meta:    Meta{UI: ui},
+		Version: "test",
+	}
+
+	code := c.Run([]string{"-native"})
+	if code != 1 {
+		t.Errorf("expected exit code 1 for -native without a path, got %d", code)
+	}
+
+	if !strings.Contains(c.Help(), "-native") {
+		t.Error("expected help to document the -native flag")
+	}
+}
+
+func testingRestoreCommand() (*RestoreCommand, *cli.BasicUi) {
+	ui := &cli.BasicUi{Writer: &bytes.Buffer{}, ErrorWriter: &bytes.Buffer{}}
+	storage := mocks.NewMockStorageClient()
+	storage.Data["bucket/backups/2017/8/15/web1.consul.snapshot.1502814820.tar.gz"] = []byte("plain")
+	storage.Data["bucket/backups/2017/8/16/web2.consul.snapshot.1502901220.tar.gz"] = []byte("plain")
+	storage.Data["bucket/backups/2017/8/17/web1.consul.snapshot.1502987620.tar.gz"] = []byte("plain")
+	c := &RestoreCommand{
+		Meta:    Meta{UI: ui},
+		Version: "test",
+		Storage: storage,
+		Config:  &config.Config{S3Bucket: "bucket", ObjectPrefix: "backups"},
+	}
+	return c, ui
+}
+
+func TestRestoreCommand_SelectBackup(t *testing.T) {
+	c, _ := testingRestoreCommand()
+
+	cases := []struct {
+		before, host, expected string
+	}{
+		{"", "", "backups/2017/8/17/web1.consul.snapshot.1502987620.tar.gz"},
+		{"1502901220", "", "backups/2017/8/16/web2.consul.snapshot.1502901220.tar.gz"},
+		{"1502987619", "web1", "backups/2017/8/15/web1.consul.snapshot.1502814820.tar.gz"},
+		{"", "web2", "backups/2017/8/16/web2.consul.snapshot.1502901220.tar.gz"},
+	}
+
+	for _, tc := range cases {
+		path, err := c.selectBackup(tc.before, tc.host)
+		if err != nil {
+			t.Errorf("selectBackup(%q, %q) failed: %v", tc.before, tc.host, err)
+			continue
+		}
+		if path != tc.expected {
+			t.Errorf("selectBackup(%q, %q) = %s, expected %s", tc.before, tc.host, path, tc.expected)
+		}
+	}
+
+	if _, err := c.selectBackup("1502000000", ""); err == nil {
+		t.Error("expected an error when no backup is old enough")
+	}
+	if _, err := c.selectBackup("", "db1"); err == nil {
+		t.Error("expected an error when no backup matches the host")
+	}
+}
+
+func TestRestoreCommand_Run_LatestErrors(t *testing.T) {
+	c, ui := testingRestoreCommand()
+
+	if code := c.Run([]string{"latest", "-host", "db1"}); code != 1 {
+		t.Errorf("expected exit code 1 when no backup matches, got %d", code)
+	}
+	if !strings.Contains(ui.ErrorWriter.(*bytes.Buffer).String(), "No backups found") {
+		t.Error("expected an error about no matching backups")
+	}
+
+	if code := c.Run([]string{"-before", "2017-08-16", "backups/some.tar.gz"}); code != 1 {
+		t.Errorf("expected exit code 1 for -before with a file path, got %d", code)
+	}
+	if code := c.Run([]string{"-before", "whenever"}); code != 1 {
+		t.Errorf("expected exit code 1 for a bad time, got %d", code)
+	}
+}
+
+func TestRestoreCommand_Run_DryRunFlags(t *testing.T) {
+	c, ui := testingRestoreCommand()
+
+	if code := c.Run([]string{"-dry-run", "-format=yaml", "latest"}); code != 1 {
+		t.Errorf("expected exit code 1 for a bad format, got %d", code)
+	}
+	if code := c.Run([]string{"-dry-run", "-native", "latest"}); code != 1 {
+		t.Errorf("expected exit code 1 for a native dry run, got %d", code)
+	}
+	if !strings.Contains(ui.ErrorWriter.(*bytes.Buffer).String(), "not supported for native") {
+		t.Error("expected an error about native dry runs")
+	}
+	if !strings.Contains(c.Help(), "-dry-run") {
+		t.Error("expected help to document the -dry-run flag")
+	}
+}
+
+func TestRestoreCommand_Run_ModeFlag(t *testing.T) {
+	c, ui := testingRestoreCommand()
+
+	if code := c.Run([]string{"-mode=replace", "latest"}); code != 1 {
+		t.Errorf("expected exit code 1 for a bad mode, got %d", code)
+	}
+	if code := c.Run([]string{"-mode=mirror", "-native", "latest"}); code != 1 {
+		t.Errorf("expected exit code 1 for a native mirror restore, got %d", code)
+	}
+	errors := ui.ErrorWriter.(*bytes.Buffer).String()
+	if !strings.Contains(errors, "must be merge or mirror") || !strings.Contains(errors, "Mirror mode is not supported") {
+		t.Errorf("unexpected errors %q", errors)
+	}
+}
+
+func TestRestoreCommand_Run_OnConflictFlag(t *testing.T) {
+	c, ui := testingRestoreCommand()
+
+	if code := c.Run([]string{"-on-conflict=ignore", "latest"}); code != 1 {
+		t.Errorf("expected exit code 1 for a bad conflict policy, got %d", code)
+	}
+	if !strings.Contains(ui.ErrorWriter.(*bytes.Buffer).String(), "Invalid conflict policy") {
+		t.Error("expected an error about the conflict policy")
+	}
+}
+
+func TestRestoreCommand_Run_RewriteFlags(t *testing.T) {
+	c, ui := testingRestoreCommand()
+
+	if code := c.Run([]string{"-rewrite", "prod/", "latest"}); code != 1 {
+		t.Errorf("expected exit code 1 for a bad rewrite, got %d", code)
+	}
+	if code := c.Run([]string{"-rewrite-file", "/nonexistent/rules", "latest"}); code != 1 {
+		t.Errorf("expected exit code 1 for a missing rewrite file, got %d", code)
+	}
+	if code := c.Run([]string{"-rewrite", "prod/=staging/", "-mode=mirror", "latest"}); code != 1 {
+		t.Errorf("expected exit code 1 for a mirror restore with rewrites, got %d", code)
+	}
+	errors := ui.ErrorWriter.(*bytes.Buffer).String()
+	for _, expected := range []string{"must be from=to", "Unable to open rewrite file", "can not be combined"} {
+		if !strings.Contains(errors, expected) {
+			t.Errorf("expected errors to contain %q, got %q", expected, errors)
+		}
+	}
+}
+
+func TestRestoreCommand_Run_ConcurrencyFlags(t *testing.T) {
+	c, ui := testingRestoreCommand()
+
+	if code := c.Run([]string{"-concurrency=0", "latest"}); code != 1 {
+		t.Errorf("expected exit code 1 for no concurrency, got %d", code)
+	}
+	if code := c.Run([]string{"-rate=-1", "latest"}); code != 1 {
+		t.Errorf("expected exit code 1 for a negative rate, got %d", code)
+	}
+	if !strings.Contains(ui.ErrorWriter.(*bytes.Buffer).String(), "-concurrency must be at least 1") {
+		t.Error("expected an error about the concurrency flags")
+	}
+}
+
+func TestRestoreCommand_Run_ResumeFlag(t *testing.T) {
+	c, ui := testingRestoreCommand()
+
+	if code := c.Run([]string{"-resume", "/nonexistent/journal"}); code != 1 {
+		t.Errorf("expected exit code 1 for a missing journal, got %d", code)
+	}
+	if code := c.Run([]string{"-resume", "/nonexistent/journal", "-native", "backups/test.tar.gz"}); code != 1 {
+		t.Errorf("expected exit code 1 for a native resume, got %d", code)
+	}
+	errors := ui.ErrorWriter.(*bytes.Buffer).String()
+	if !strings.Contains(errors, "Unable to open restore journal") || !strings.Contains(errors, "can not be resumed") {
+		t.Errorf("unexpected errors %q", errors)
+	}
+}
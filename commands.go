@@ -40,11 +40,13 @@ func init() {
 	}
 
 	meta := command.Meta{
-		UI: UI,
+		UI:     UI,
+		Stdout: os.Stdout,
 	}
 
 	CommandsInclude = []string{
 		"backup",
+		"list",
 		"restore",
 		"version",
 	}
@@ -57,6 +59,13 @@ func init() {
 			}, nil
 		},
 
+		"list": func() (cli.Command, error) {
+			return &command.ListCommand{
+				Meta:    meta,
+				Version: formattedVersion(),
+			}, nil
+		},
+
 		"restore": func() (cli.Command, error) {
 			return &command.RestoreCommand{
 				Meta:    meta,
@@ -13,7 +13,7 @@ func TestCommands(t *testing.T) {
 	}
 	
 	// Test that expected commands are present
-	expectedCommands := []string{"backup", "restore", "version"}
+	expectedCommands := []string{"backup", "list", "restore", "version"}
 	
 	for _, cmd := range expectedCommands {
 		if _, exists := Commands[cmd]; !exists {
@@ -28,7 +28,7 @@ func TestCommandsInclude(t *testing.T) {
 		t.Fatal("CommandsInclude should not be nil")
 	}
 	
-	expectedCommands := []string{"backup", "restore", "version"}
+	expectedCommands := []string{"backup", "list", "restore", "version"}
 	
 	if len(CommandsInclude) != len(expectedCommands) {
 		t.Errorf("expected %d commands in CommandsInclude, got %d", len(expectedCommands), len(CommandsInclude))
@@ -4,12 +4,28 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"regexp"
 	"strconv"
 	"time"
+
+	"github.com/pshima/consul-snapshot/filter"
 )
 
 var hostname string
 
+// Backup modes select what a backup captures
+const (
+	// BackupModeJSON exports KV, PQ, ACL and service mesh data as JSON
+	BackupModeJSON = "json"
+	// BackupModeNative saves a native consul raft snapshot
+	BackupModeNative = "native"
+	// BackupModeBoth captures the JSON exports and a native snapshot
+	BackupModeBoth = "both"
+)
+
+// DefaultLockKey is the key backup daemons elect their leader on
+const DefaultLockKey = "service/consul-snapshot/leader"
+
 // Config is a struct to hold the backup configuration
 type Config struct {
 	GCSBucket              string
@@ -27,6 +43,55 @@ type Config struct {
 	ObjectPrefix           string
 	S3ServerSideEncryption string
 	S3KmsKeyID             string
+	BackupMode             string
+	KVFilter               filter.KV
+	Incremental            bool
+	FullBackupInterval     time.Duration
+	SkipUnchanged          bool
+	Watch                  bool
+	WatchDebounce          time.Duration
+	WatchMinInterval       time.Duration
+	WatchMaxAge            time.Duration
+	Schedules              []*Schedule
+	RetentionClass         string
+	ForceFullBackup        bool
+	HA                     bool
+	LockKey                string
+	HealthMaxAge           time.Duration
+	ScheduleName           string
+}
+
+// healthGrace is how much older than the longest gap between backups the
+// last backup can be before the health check fails, backups take a while
+const healthGrace = 30 * time.Minute
+
+// backupGap is the longest time the daemon goes without starting a backup
+func (c *Config) backupGap(now time.Time) time.Duration {
+	if c.Watch {
+		return c.WatchMaxAge
+	}
+	if len(c.Schedules) > 0 {
+		// any schedule's backup is fresh, so the gaps are never longer than
+		// those of the schedule that runs most often
+		var gap time.Duration
+		for _, s := range c.Schedules {
+			if g := s.LongestGap(now); g > 0 && (gap == 0 || g < gap) {
+				gap = g
+			}
+		}
+		return gap
+	}
+	return c.BackupInterval
+}
+
+// JSONBackup reports whether backups include the JSON exports
+func (c *Config) JSONBackup() bool {
+	return c.BackupMode != BackupModeNative
+}
+
+// NativeBackup reports whether backups include a native raft snapshot
+func (c *Config) NativeBackup() bool {
+	return c.BackupMode == BackupModeNative || c.BackupMode == BackupModeBoth
 }
 
 // When starting, just set the hostname
@@ -48,6 +113,19 @@ func checkEmpty(s []string) bool {
 	return true
 }
 
+// envSeconds reads a duration in seconds from an environment variable
+func envSeconds(name string, defaultSeconds int) (time.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return time.Duration(defaultSeconds) * time.Second, nil
+	}
+	seconds, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("Unable to convert %s environment var to integer: %v", name, err)
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
 // Set the environment variables that are required
 func setEnvVars(conf *Config, tests bool) error {
 	conf.GCSBucket = os.Getenv("GCSBUCKET")
@@ -63,6 +141,21 @@ func setEnvVars(conf *Config, tests bool) error {
 	conf.ObjectPrefix = os.Getenv("CONSUL_SNAPSHOT_UPLOAD_PREFIX")
 	conf.S3ServerSideEncryption = os.Getenv("CONSUL_SNAPSHOT_S3_SSE")
 	conf.S3KmsKeyID = os.Getenv("CONSUL_SNAPSHOT_S3_SSE_KMS_KEY_ID")
+	conf.BackupMode = os.Getenv("CONSUL_SNAPSHOT_BACKUP_MODE")
+	conf.KVFilter = filter.KV{
+		IncludePrefixes: filter.ParsePrefixes(os.Getenv("CONSUL_SNAPSHOT_INCLUDE_PREFIXES")),
+		ExcludePrefixes: filter.ParsePrefixes(os.Getenv("CONSUL_SNAPSHOT_EXCLUDE_PREFIXES")),
+	}
+	includeRegex := os.Getenv("CONSUL_SNAPSHOT_INCLUDE_REGEX")
+	excludeRegex := os.Getenv("CONSUL_SNAPSHOT_EXCLUDE_REGEX")
+	incremental := os.Getenv("CONSUL_SNAPSHOT_INCREMENTAL")
+	fullBackupInterval := os.Getenv("CONSUL_SNAPSHOT_FULL_BACKUP_INTERVAL")
+	skipUnchanged := os.Getenv("CONSUL_SNAPSHOT_SKIP_UNCHANGED")
+	watch := os.Getenv("CONSUL_SNAPSHOT_WATCH")
+	schedules := os.Getenv("CONSUL_SNAPSHOT_SCHEDULES")
+	ha := os.Getenv("CONSUL_SNAPSHOT_HA")
+	conf.LockKey = os.Getenv("CONSUL_SNAPSHOT_LOCK_KEY")
+	healthMaxAge := os.Getenv("CONSUL_SNAPSHOT_HEALTH_MAX_AGE")
 
 	// if the environment variable isn't set, just set the dir to /tmp
 	if conf.TmpDir == "" {
@@ -74,6 +167,127 @@ func setEnvVars(conf *Config, tests bool) error {
 		conf.ObjectPrefix = "backups"
 	}
 
+	// If no backup mode is set, keep the JSON exports consul-snapshot has
+	// always taken
+	switch conf.BackupMode {
+	case "":
+		conf.BackupMode = BackupModeJSON
+	case BackupModeJSON, BackupModeNative, BackupModeBoth:
+	default:
+		return fmt.Errorf("Invalid CONSUL_SNAPSHOT_BACKUP_MODE %q, must be one of json, native or both", conf.BackupMode)
+	}
+
+	// Key regexes narrow the prefixes further, so a bad one has to stop the
+	// backup rather than silently capture the wrong keys
+	if includeRegex != "" {
+		re, err := regexp.Compile(includeRegex)
+		if err != nil {
+			return fmt.Errorf("Unable to parse CONSUL_SNAPSHOT_INCLUDE_REGEX: %v", err)
+		}
+		conf.KVFilter.IncludeRegex = re
+	}
+	if excludeRegex != "" {
+		re, err := regexp.Compile(excludeRegex)
+		if err != nil {
+			return fmt.Errorf("Unable to parse CONSUL_SNAPSHOT_EXCLUDE_REGEX: %v", err)
+		}
+		conf.KVFilter.ExcludeRegex = re
+	}
+
+	// Incremental backups only capture the keys that changed since the
+	// previous backup, with a full backup every FullBackupInterval
+	conf.Incremental = false
+	if incremental != "" {
+		enabled, err := strconv.ParseBool(incremental)
+		if err != nil {
+			return fmt.Errorf("Unable to parse CONSUL_SNAPSHOT_INCREMENTAL: %v", err)
+		}
+		conf.Incremental = enabled
+	}
+	if conf.Incremental && !conf.JSONBackup() {
+		return fmt.Errorf("CONSUL_SNAPSHOT_INCREMENTAL needs the json or both backup mode, native snapshots are always full")
+	}
+
+	// Skipping unchanged backups compares the JSON exports, a native snapshot
+	// changes with every raft write and would never be skipped
+	conf.SkipUnchanged = false
+	if skipUnchanged != "" {
+		enabled, err := strconv.ParseBool(skipUnchanged)
+		if err != nil {
+			return fmt.Errorf("Unable to parse CONSUL_SNAPSHOT_SKIP_UNCHANGED: %v", err)
+		}
+		conf.SkipUnchanged = enabled
+	}
+	if conf.SkipUnchanged && conf.BackupMode != BackupModeJSON {
+		return fmt.Errorf("CONSUL_SNAPSHOT_SKIP_UNCHANGED needs the json backup mode, native snapshots change with every raft write")
+	}
+
+	// If no full backup interval is set, take a full backup every day
+	if fullBackupInterval == "" {
+		fullBackupInterval = "86400"
+	}
+	fullStrToInt, err := strconv.Atoi(fullBackupInterval)
+	if err != nil {
+		return fmt.Errorf("Unable to convert CONSUL_SNAPSHOT_FULL_BACKUP_INTERVAL environment var to integer: %v", err)
+	}
+	conf.FullBackupInterval = time.Duration(fullStrToInt) * time.Second
+
+	// Watch mode backs up shortly after consul data changes instead of on
+	// BACKUPINTERVAL.  A backup waits for changes to settle for the debounce,
+	// runs at most once per minimum interval and at least once per max age.
+	conf.Watch = false
+	if watch != "" {
+		enabled, err := strconv.ParseBool(watch)
+		if err != nil {
+			return fmt.Errorf("Unable to parse CONSUL_SNAPSHOT_WATCH: %v", err)
+		}
+		conf.Watch = enabled
+	}
+	if conf.WatchDebounce, err = envSeconds("CONSUL_SNAPSHOT_WATCH_DEBOUNCE", 10); err != nil {
+		return err
+	}
+	if conf.WatchMinInterval, err = envSeconds("CONSUL_SNAPSHOT_WATCH_MIN_INTERVAL", 60); err != nil {
+		return err
+	}
+	if conf.WatchMaxAge, err = envSeconds("CONSUL_SNAPSHOT_WATCH_MAX_AGE", 1800); err != nil {
+		return err
+	}
+	if conf.Watch && conf.WatchMaxAge < conf.WatchMinInterval {
+		return fmt.Errorf("CONSUL_SNAPSHOT_WATCH_MAX_AGE can not be shorter than CONSUL_SNAPSHOT_WATCH_MIN_INTERVAL")
+	}
+
+	// Schedules replace BACKUPINTERVAL with named cron schedules
+	conf.Schedules = nil
+	if schedules != "" {
+		if conf.Watch {
+			return fmt.Errorf("CONSUL_SNAPSHOT_SCHEDULES can not be combined with CONSUL_SNAPSHOT_WATCH")
+		}
+		conf.Schedules, err = ParseSchedules(schedules)
+		if err != nil {
+			return err
+		}
+		for _, s := range conf.Schedules {
+			if s.Type != "" && !conf.JSONBackup() {
+				return fmt.Errorf("Schedule %s: full and incremental schedules need the json or both backup mode", s.Name)
+			}
+		}
+	}
+
+	// HA runs several backup daemons, only the one holding the lock on
+	// LockKey takes backups
+	conf.HA = false
+	if ha != "" {
+		enabled, err := strconv.ParseBool(ha)
+		if err != nil {
+			return fmt.Errorf("Unable to parse CONSUL_SNAPSHOT_HA: %v", err)
+		}
+		conf.HA = enabled
+	}
+	if conf.LockKey == "" {
+		conf.LockKey = DefaultLockKey
+	}
+	conf.LockKey = filter.NormalizePrefix(conf.LockKey)
+
 	// If no backup interval is set, set it to 60s as a string which is converted
 	// to a time.Duration
 	if backupInterval == "" {
@@ -105,6 +319,21 @@ func setEnvVars(conf *Config, tests bool) error {
 		conf.BackupInterval = 60 * time.Second
 	}
 
+	// the health check allows the longest gap between backups and some,
+	// but never less than an hour
+	conf.HealthMaxAge = conf.backupGap(time.Now()) + healthGrace
+	if conf.HealthMaxAge < time.Hour {
+		conf.HealthMaxAge = time.Hour
+	}
+	if healthMaxAge != "" {
+		if conf.HealthMaxAge, err = envSeconds("CONSUL_SNAPSHOT_HEALTH_MAX_AGE", 0); err != nil {
+			return err
+		}
+		if conf.HealthMaxAge <= 0 {
+			return fmt.Errorf("CONSUL_SNAPSHOT_HEALTH_MAX_AGE must be above 0")
+		}
+	}
+
 	return nil
 }
 
@@ -1,7 +1,9 @@
 package config
 
 import (
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 )
@@ -132,3 +134,300 @@ func TestS3Endpoint(t *testing.T) {
 		t.Errorf("Expected S3ENDPOINT to be 'https://minio.example.com:9000', got %v", c.S3Endpoint)
 	}
 }
+
+func TestBackupMode(t *testing.T) {
+	var c Config
+	os.Clearenv()
+	_ = setEnvVars(&c, true)
+	if c.BackupMode != BackupModeJSON {
+		t.Errorf("Expected default backup mode to be %v, got %v", BackupModeJSON, c.BackupMode)
+	}
+
+	os.Setenv("CONSUL_SNAPSHOT_BACKUP_MODE", "native")
+	if err := setEnvVars(&c, true); err != nil {
+		t.Errorf("Unexpected error for native backup mode: %v", err)
+	}
+	if c.BackupMode != BackupModeNative {
+		t.Errorf("Expected backup mode to be %v, got %v", BackupModeNative, c.BackupMode)
+	}
+
+	os.Setenv("CONSUL_SNAPSHOT_BACKUP_MODE", "raft")
+	if err := setEnvVars(&c, true); err == nil {
+		t.Error("Expected an error for an invalid backup mode")
+	}
+}
+
+func TestKVFilter(t *testing.T) {
+	var c Config
+	os.Clearenv()
+	_ = setEnvVars(&c, true)
+	if !c.KVFilter.Empty() {
+		t.Errorf("Expected no key filter by default, got %v", c.KVFilter.String())
+	}
+
+	os.Setenv("CONSUL_SNAPSHOT_INCLUDE_PREFIXES", "service/web/, /service/db/")
+	os.Setenv("CONSUL_SNAPSHOT_EXCLUDE_PREFIXES", "service/web/tmp/")
+	os.Setenv("CONSUL_SNAPSHOT_INCLUDE_REGEX", "/config$")
+	if err := setEnvVars(&c, true); err != nil {
+		t.Fatalf("Unexpected error for key filters: %v", err)
+	}
+	if len(c.KVFilter.IncludePrefixes) != 2 || c.KVFilter.IncludePrefixes[1] != "service/db/" {
+		t.Errorf("Unexpected include prefixes %v", c.KVFilter.IncludePrefixes)
+	}
+	if len(c.KVFilter.ExcludePrefixes) != 1 {
+		t.Errorf("Unexpected exclude prefixes %v", c.KVFilter.ExcludePrefixes)
+	}
+	if !c.KVFilter.Match("service/db/config") || c.KVFilter.Match("service/db/other") {
+		t.Error("Expected the include regex to be applied")
+	}
+
+	os.Setenv("CONSUL_SNAPSHOT_EXCLUDE_REGEX", "([")
+	if err := setEnvVars(&c, true); err == nil {
+		t.Error("Expected an error for an invalid exclude regex")
+	}
+	os.Clearenv()
+}
+
+func TestIncremental(t *testing.T) {
+	var c Config
+	os.Clearenv()
+	_ = setEnvVars(&c, true)
+	if c.Incremental {
+		t.Error("Expected incremental backups to be off by default")
+	}
+	if c.FullBackupInterval != 24*time.Hour {
+		t.Errorf("Expected a daily full backup by default, got %v", c.FullBackupInterval)
+	}
+
+	os.Setenv("CONSUL_SNAPSHOT_INCREMENTAL", "true")
+	os.Setenv("CONSUL_SNAPSHOT_FULL_BACKUP_INTERVAL", "3600")
+	if err := setEnvVars(&c, true); err != nil {
+		t.Fatalf("Unexpected error for incremental backups: %v", err)
+	}
+	if !c.Incremental || c.FullBackupInterval != time.Hour {
+		t.Errorf("Expected hourly full backups, got %v %v", c.Incremental, c.FullBackupInterval)
+	}
+
+	os.Setenv("CONSUL_SNAPSHOT_BACKUP_MODE", "native")
+	if err := setEnvVars(&c, true); err == nil {
+		t.Error("Expected an error for incremental native backups")
+	}
+	os.Setenv("CONSUL_SNAPSHOT_BACKUP_MODE", "json")
+
+	os.Setenv("CONSUL_SNAPSHOT_INCREMENTAL", "sometimes")
+	if err := setEnvVars(&c, true); err == nil {
+		t.Error("Expected an error for an invalid CONSUL_SNAPSHOT_INCREMENTAL")
+	}
+	os.Clearenv()
+}
+
+func TestSkipUnchanged(t *testing.T) {
+	var c Config
+	os.Clearenv()
+	_ = setEnvVars(&c, true)
+	if c.SkipUnchanged {
+		t.Error("Expected unchanged backups to be uploaded by default")
+	}
+
+	os.Setenv("CONSUL_SNAPSHOT_SKIP_UNCHANGED", "1")
+	if err := setEnvVars(&c, true); err != nil {
+		t.Fatalf("Unexpected error for skipping unchanged backups: %v", err)
+	}
+	if !c.SkipUnchanged {
+		t.Error("Expected unchanged backups to be skipped")
+	}
+
+	os.Setenv("CONSUL_SNAPSHOT_BACKUP_MODE", "both")
+	if err := setEnvVars(&c, true); err == nil {
+		t.Error("Expected an error for skipping unchanged native snapshots")
+	}
+	os.Clearenv()
+}
+
+func TestWatch(t *testing.T) {
+	var c Config
+	os.Clearenv()
+	_ = setEnvVars(&c, true)
+	if c.Watch {
+		t.Error("Expected watch mode to be off by default")
+	}
+	if c.WatchDebounce != 10*time.Second || c.WatchMinInterval != time.Minute || c.WatchMaxAge != 30*time.Minute {
+		t.Errorf("Unexpected watch defaults %v %v %v", c.WatchDebounce, c.WatchMinInterval, c.WatchMaxAge)
+	}
+
+	os.Setenv("CONSUL_SNAPSHOT_WATCH", "true")
+	os.Setenv("CONSUL_SNAPSHOT_WATCH_DEBOUNCE", "5")
+	os.Setenv("CONSUL_SNAPSHOT_WATCH_MAX_AGE", "600")
+	if err := setEnvVars(&c, true); err != nil {
+		t.Fatalf("Unexpected error for watch mode: %v", err)
+	}
+	if !c.Watch || c.WatchDebounce != 5*time.Second || c.WatchMaxAge != 10*time.Minute {
+		t.Errorf("Unexpected watch settings %v %v %v", c.Watch, c.WatchDebounce, c.WatchMaxAge)
+	}
+
+	os.Setenv("CONSUL_SNAPSHOT_WATCH_MAX_AGE", "30")
+	if err := setEnvVars(&c, true); err == nil {
+		t.Error("Expected an error for a max age shorter than the minimum interval")
+	}
+
+	os.Setenv("CONSUL_SNAPSHOT_WATCH_DEBOUNCE", "soon")
+	if err := setEnvVars(&c, true); err == nil {
+		t.Error("Expected an error for an invalid debounce")
+	}
+	os.Clearenv()
+}
+
+func TestSchedules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "schedules")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "schedules.json")
+	data := `[
+  {"Name": "hourly", "Cron": "5 * * * *", "Jitter": "2m", "Type": "incremental", "RetentionClass": "short"},
+  {"Name": "nightly", "Cron": "0 2 * * *", "TimeZone": "Europe/Berlin", "Type": "full", "RetentionClass": "long"},
+  {"Name": "payments", "Cron": "@daily", "IncludePrefixes": ["/service/payments/"]}
+]`
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatalf("Unable to write schedules: %v", err)
+	}
+
+	var c Config
+	os.Clearenv()
+	os.Setenv("CONSUL_SNAPSHOT_SCHEDULES", path)
+	if err := setEnvVars(&c, true); err != nil {
+		t.Fatalf("Unexpected error for schedules: %v", err)
+	}
+	if len(c.Schedules) != 3 {
+		t.Fatalf("Expected 3 schedules, got %v", len(c.Schedules))
+	}
+	hourly, nightly, payments := c.Schedules[0], c.Schedules[1], c.Schedules[2]
+	if hourly.Jitter != 2*time.Minute || hourly.Expr == nil {
+		t.Errorf("Unexpected hourly schedule %+v", hourly)
+	}
+	if nightly.Expr.Location().String() != "Europe/Berlin" {
+		t.Errorf("Expected the nightly schedule in Europe/Berlin, got %v", nightly.Expr.Location())
+	}
+
+	conf := c.ForSchedule(nightly)
+	if !conf.Incremental || !conf.ForceFullBackup || conf.RetentionClass != "long" || conf.ScheduleName != "nightly" {
+		t.Errorf("Unexpected nightly config %v %v %v %v", conf.Incremental, conf.ForceFullBackup, conf.RetentionClass, conf.ScheduleName)
+	}
+	conf = c.ForSchedule(payments)
+	if conf.Incremental || len(conf.KVFilter.IncludePrefixes) != 1 || conf.KVFilter.IncludePrefixes[0] != "service/payments/" {
+		t.Errorf("Unexpected payments config %v %v", conf.Incremental, conf.KVFilter.IncludePrefixes)
+	}
+	if c.ForceFullBackup || c.RetentionClass != "" {
+		t.Error("Expected ForSchedule to leave the daemon config alone")
+	}
+
+	invalid := []string{
+		`[]`,
+		`[{"Cron": "@daily"}]`,
+		`[{"Name": "a", "Cron": "@daily"}, {"Name": "a", "Cron": "@hourly"}]`,
+		`[{"Name": "a", "Cron": "61 * * * *"}]`,
+		`[{"Name": "a", "Cron": "@daily", "TimeZone": "Mars/Olympus"}]`,
+		`[{"Name": "a", "Cron": "@daily", "Jitter": "soon"}]`,
+		`[{"Name": "a", "Cron": "@daily", "Type": "differential"}]`,
+	}
+	for _, data := range invalid {
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatalf("Unable to write schedules: %v", err)
+		}
+		if err := setEnvVars(&c, true); err == nil {
+			t.Errorf("Expected an error for schedules %s", data)
+		}
+	}
+
+	os.Setenv("CONSUL_SNAPSHOT_SCHEDULES", filepath.Join(dir, "missing.json"))
+	if err := setEnvVars(&c, true); err == nil {
+		t.Error("Expected an error for a missing schedules file")
+	}
+	os.Clearenv()
+}
+
+func TestHealthMaxAge(t *testing.T) {
+	var c Config
+	os.Clearenv()
+	if err := setEnvVars(&c, true); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if c.HealthMaxAge != time.Hour {
+		t.Errorf("Expected backups every minute to go stale after an hour, got %v", c.HealthMaxAge)
+	}
+
+	os.Setenv("BACKUPINTERVAL", "86400")
+	_ = setEnvVars(&c, true)
+	if c.HealthMaxAge != 24*time.Hour+healthGrace {
+		t.Errorf("Expected daily backups to go stale after a day and the grace, got %v", c.HealthMaxAge)
+	}
+
+	os.Setenv("CONSUL_SNAPSHOT_HEALTH_MAX_AGE", "7200")
+	_ = setEnvVars(&c, true)
+	if c.HealthMaxAge != 2*time.Hour {
+		t.Errorf("Expected the configured max age, got %v", c.HealthMaxAge)
+	}
+	os.Setenv("CONSUL_SNAPSHOT_HEALTH_MAX_AGE", "0")
+	if err := setEnvVars(&c, true); err == nil {
+		t.Error("Expected an error for a max age of 0")
+	}
+	os.Clearenv()
+}
+
+func TestScheduleGaps(t *testing.T) {
+	hourly := &Schedule{Cron: "5 * * * *"}
+	nightly := &Schedule{Cron: "0 2 * * *"}
+	weekdays := &Schedule{Cron: "0 2 * * 1-5"}
+	for _, s := range []*Schedule{hourly, nightly, weekdays} {
+		if err := s.parse(""); err != nil {
+			t.Fatalf("Unable to parse %s: %v", s.Cron, err)
+		}
+	}
+	hourly.Jitter = 2 * time.Minute
+
+	now := time.Date(2017, 8, 16, 9, 33, 40, 0, time.UTC)
+	if gap := hourly.LongestGap(now); gap != time.Hour+2*time.Minute {
+		t.Errorf("Expected an hour and the jitter between hourly runs, got %v", gap)
+	}
+	if gap := weekdays.LongestGap(now); gap != 72*time.Hour {
+		t.Errorf("Expected the weekend between weekday runs, got %v", gap)
+	}
+
+	c := &Config{Schedules: []*Schedule{nightly, hourly}}
+	if gap := c.backupGap(now); gap != time.Hour+2*time.Minute {
+		t.Errorf("Expected the gaps of the schedule that runs most often, got %v", gap)
+	}
+	c.Watch, c.WatchMaxAge = true, 30*time.Minute
+	if gap := c.backupGap(now); gap != 30*time.Minute {
+		t.Errorf("Expected the watch max age, got %v", gap)
+	}
+}
+
+func TestHA(t *testing.T) {
+	var c Config
+	os.Clearenv()
+	_ = setEnvVars(&c, true)
+	if c.HA {
+		t.Error("Expected leader election to be off by default")
+	}
+	if c.LockKey != DefaultLockKey {
+		t.Errorf("Expected lock key %s, got %s", DefaultLockKey, c.LockKey)
+	}
+
+	os.Setenv("CONSUL_SNAPSHOT_HA", "true")
+	os.Setenv("CONSUL_SNAPSHOT_LOCK_KEY", "/locks/consul-snapshot")
+	if err := setEnvVars(&c, true); err != nil {
+		t.Fatalf("Unexpected error for leader election: %v", err)
+	}
+	if !c.HA || c.LockKey != "locks/consul-snapshot" {
+		t.Errorf("Unexpected leader election settings %v %s", c.HA, c.LockKey)
+	}
+
+	os.Setenv("CONSUL_SNAPSHOT_HA", "sometimes")
+	if err := setEnvVars(&c, true); err == nil {
+		t.Error("Expected an error for an invalid CONSUL_SNAPSHOT_HA")
+	}
+	os.Clearenv()
+}
@@ -0,0 +1,162 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+	// containers often ship without a zoneinfo database
+	_ "time/tzdata"
+
+	"github.com/pshima/consul-snapshot/cron"
+	"github.com/pshima/consul-snapshot/filter"
+)
+
+// Schedule types select what a scheduled backup captures
+const (
+	// ScheduleFull always takes a full backup, incremental backups of the
+	// same keys build on it
+	ScheduleFull = "full"
+	// ScheduleIncremental takes incremental backups
+	ScheduleIncremental = "incremental"
+)
+
+// Schedule is a named cron schedule of the backup daemon
+type Schedule struct {
+	Name string
+	// Cron is a five field cron expression or a macro such as @hourly
+	Cron string
+	// TimeZone the cron expression is read in, UTC by default
+	TimeZone string
+	// Jitter delays every run by a random time up to this long
+	Jitter time.Duration
+	// Type is ScheduleFull, ScheduleIncremental, or empty for the backup
+	// type of the daemon
+	Type string
+	// IncludePrefixes and ExcludePrefixes replace the key filter of the
+	// daemon when either is set
+	IncludePrefixes []string
+	ExcludePrefixes []string
+	// RetentionClass is recorded with the backup for bucket lifecycle rules
+	RetentionClass string
+
+	Expr *cron.Schedule `json:"-"`
+}
+
+// scheduleFile is a Schedule as it is written in a schedules file
+type scheduleFile struct {
+	Schedule
+	Jitter string
+}
+
+// ParseSchedules reads a JSON list of schedules from a file and checks
+// every schedule in it
+func ParseSchedules(path string) ([]*Schedule, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read schedules file: %v", err)
+	}
+
+	var entries []scheduleFile
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("Unable to parse schedules file %s: %v", path, err)
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("Schedules file %s does not contain any schedules", path)
+	}
+
+	names := make(map[string]bool)
+	var schedules []*Schedule
+	for i, entry := range entries {
+		s := entry.Schedule
+		if s.Name == "" {
+			return nil, fmt.Errorf("Schedule %v in %s has no name", i+1, path)
+		}
+		if names[s.Name] {
+			return nil, fmt.Errorf("Schedule %s is in %s more than once", s.Name, path)
+		}
+		names[s.Name] = true
+
+		if err := s.parse(entry.Jitter); err != nil {
+			return nil, fmt.Errorf("Schedule %s: %v", s.Name, err)
+		}
+		schedules = append(schedules, &s)
+	}
+	return schedules, nil
+}
+
+// LongestGap returns the longest time between two runs of the schedule in
+// the year after now, or its next thousand runs, including the jitter.  It
+// is 0 for a schedule that never runs twice.
+func (s *Schedule) LongestGap(now time.Time) time.Duration {
+	var longest time.Duration
+	end := now.AddDate(1, 0, 0)
+	prev := s.Expr.Next(now)
+	for i := 0; i < 1000 && !prev.IsZero() && prev.Before(end); i++ {
+		next := s.Expr.Next(prev)
+		if next.IsZero() {
+			break
+		}
+		if gap := next.Sub(prev); gap > longest {
+			longest = gap
+		}
+		prev = next
+	}
+	if longest == 0 {
+		return 0
+	}
+	return longest + s.Jitter
+}
+
+func (s *Schedule) parse(jitter string) error {
+	location := time.UTC
+	if s.TimeZone != "" {
+		var err error
+		if location, err = time.LoadLocation(s.TimeZone); err != nil {
+			return fmt.Errorf("Unable to load time zone %q: %v", s.TimeZone, err)
+		}
+	}
+	expr, err := cron.Parse(s.Cron, location)
+	if err != nil {
+		return err
+	}
+	s.Expr = expr
+
+	if jitter != "" {
+		if s.Jitter, err = time.ParseDuration(jitter); err != nil || s.Jitter < 0 {
+			return fmt.Errorf("Invalid jitter %q", jitter)
+		}
+	}
+
+	switch s.Type {
+	case "", ScheduleFull, ScheduleIncremental:
+	default:
+		return fmt.Errorf("Invalid type %q, must be full or incremental", s.Type)
+	}
+
+	for i, prefix := range s.IncludePrefixes {
+		s.IncludePrefixes[i] = filter.NormalizePrefix(prefix)
+	}
+	for i, prefix := range s.ExcludePrefixes {
+		s.ExcludePrefixes[i] = filter.NormalizePrefix(prefix)
+	}
+	return nil
+}
+
+// ForSchedule returns the configuration a backup of a schedule runs with
+func (c *Config) ForSchedule(s *Schedule) *Config {
+	conf := *c
+	conf.ScheduleName = s.Name
+	conf.RetentionClass = s.RetentionClass
+	switch s.Type {
+	case ScheduleFull:
+		conf.Incremental = true
+		conf.ForceFullBackup = true
+	case ScheduleIncremental:
+		conf.Incremental = true
+	}
+	if len(s.IncludePrefixes) > 0 || len(s.ExcludePrefixes) > 0 {
+		conf.KVFilter = filter.KV{IncludePrefixes: s.IncludePrefixes, ExcludePrefixes: s.ExcludePrefixes}
+	}
+	return &conf
+}
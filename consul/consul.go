@@ -1,7 +1,12 @@
 package consul
 
 import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
 	consulapi "github.com/hashicorp/consul/api"
+	"github.com/pshima/consul-snapshot/filter"
 	"github.com/pshima/consul-snapshot/interfaces"
 )
 
@@ -15,6 +20,73 @@ type Consul struct {
 	PQDataLen  int
 	ACLData    []*consulapi.ACLEntry
 	ACLDataLen int
+	ACLSystem  *ACLSystem
+
+	ConfigEntryData    ConfigEntries
+	ConfigEntryDataLen int
+	IntentionData      []*consulapi.ServiceIntentionsConfigEntry
+	IntentionDataLen   int
+}
+
+// ACLSystem holds the token based ACL system that replaced legacy ACLs
+// in consul 1.4.
+type ACLSystem struct {
+	Tokens       []*consulapi.ACLToken
+	Policies     []*consulapi.ACLPolicy
+	Roles        []*consulapi.ACLRole
+	AuthMethods  []*consulapi.ACLAuthMethod
+	BindingRules []*consulapi.ACLBindingRule
+}
+
+// ConfigEntryKinds lists the config entry kinds that are backed up, in the
+// order they have to be restored for consul to accept them: defaults first,
+// then the discovery chain, then gateways and routes that reference it.
+// service-intentions are handled separately and bound-api-gateway entries
+// are managed by consul itself.
+var ConfigEntryKinds = []string{
+	consulapi.ProxyDefaults,
+	consulapi.MeshConfig,
+	consulapi.JWTProvider,
+	consulapi.RateLimitIPConfig,
+	consulapi.SamenessGroup,
+	consulapi.ServiceDefaults,
+	consulapi.ServiceResolver,
+	consulapi.ServiceSplitter,
+	consulapi.ServiceRouter,
+	consulapi.InlineCertificate,
+	consulapi.FileSystemCertificate,
+	consulapi.APIGateway,
+	consulapi.HTTPRoute,
+	consulapi.TCPRoute,
+	consulapi.IngressGateway,
+	consulapi.TerminatingGateway,
+	consulapi.ExportedServices,
+}
+
+// ConfigEntries holds config entries grouped by kind.  Entries are grouped
+// because some kinds, such as mesh, do not carry their kind in their JSON.
+type ConfigEntries map[string][]consulapi.ConfigEntry
+
+// UnmarshalJSON decodes config entries into their concrete types
+func (c *ConfigEntries) UnmarshalJSON(data []byte) error {
+	raw := make(map[string][]map[string]interface{})
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	entries := make(ConfigEntries)
+	for kind, rawEntries := range raw {
+		for _, rawEntry := range rawEntries {
+			rawEntry["Kind"] = kind
+			entry, err := consulapi.DecodeConfigEntry(rawEntry)
+			if err != nil {
+				return fmt.Errorf("unable to decode %s config entry: %v", kind, err)
+			}
+			entries[kind] = append(entries[kind], entry)
+		}
+	}
+	*c = entries
+	return nil
 }
 
 // NewConsul creates a consul instance with the given client
@@ -35,10 +107,37 @@ func Client() *consulapi.Client {
 
 // ListKeys lists all the keys from consul with no prefix.
 func (c *Consul) ListKeys() error {
-	keys, err := c.Client.ListKeys()
-	if err != nil {
-		return err
+	return c.ListFilteredKeys(&filter.KV{})
+}
+
+// ListFilteredKeys lists the keys selected by a filter.  Only the include
+// prefixes are listed from consul, so a backup of a small subtree does not
+// read the whole KV store.
+func (c *Consul) ListFilteredKeys(f *filter.KV) error {
+	prefixes := f.IncludePrefixes
+	if len(prefixes) == 0 {
+		prefixes = []string{""}
+	}
+
+	var keys consulapi.KVPairs
+	seen := make(map[string]bool)
+	for _, prefix := range prefixes {
+		prefixKeys, err := c.Client.ListKeys(prefix)
+		if err != nil {
+			return err
+		}
+		// Nested include prefixes list the same keys more than once
+		for _, kv := range f.Apply(prefixKeys) {
+			if !seen[kv.Key] {
+				seen[kv.Key] = true
+				keys = append(keys, kv)
+			}
+		}
+	}
+	if len(f.IncludePrefixes) > 1 {
+		sort.Slice(keys, func(i, j int) bool { return keys[i].Key < keys[j].Key })
 	}
+
 	c.KeyData = keys
 	c.KeyDataLen = len(keys)
 	return nil
@@ -66,10 +165,72 @@ func (c *Consul) ListACLs() error {
 	return nil
 }
 
+// ListACLSystem lists the ACL tokens, policies, roles, auth methods and
+// binding rules from consul
+func (c *Consul) ListACLSystem() error {
+	var err error
+	system := &ACLSystem{}
+
+	if system.Tokens, err = c.Client.ListACLTokens(); err != nil {
+		return err
+	}
+	if system.Policies, err = c.Client.ListACLPolicies(); err != nil {
+		return err
+	}
+	if system.Roles, err = c.Client.ListACLRoles(); err != nil {
+		return err
+	}
+	if system.AuthMethods, err = c.Client.ListACLAuthMethods(); err != nil {
+		return err
+	}
+	if system.BindingRules, err = c.Client.ListACLBindingRules(); err != nil {
+		return err
+	}
+
+	c.ACLSystem = system
+	return nil
+}
+
+// ListConfigEntries lists the config entries of every kind from consul
+func (c *Consul) ListConfigEntries() error {
+	entries := make(ConfigEntries)
+	total := 0
+	for _, kind := range ConfigEntryKinds {
+		kindEntries, err := c.Client.ListConfigEntries(kind)
+		if err != nil {
+			return fmt.Errorf("unable to list %s config entries: %v", kind, err)
+		}
+		if len(kindEntries) > 0 {
+			entries[kind] = kindEntries
+			total += len(kindEntries)
+		}
+	}
+	c.ConfigEntryData = entries
+	c.ConfigEntryDataLen = total
+	return nil
+}
+
+// ListIntentions lists the service intentions from consul, one entry per
+// destination service.
+func (c *Consul) ListIntentions() error {
+	intentions, err := c.Client.ListIntentions()
+	if err != nil {
+		return err
+	}
+
+	total := 0
+	for _, entry := range intentions {
+		total += len(entry.Sources)
+	}
+	c.IntentionData = intentions
+	c.IntentionDataLen = total
+	return nil
+}
+
 // RestoreKeys restores keys to consul
 func (c *Consul) RestoreKeys(keys consulapi.KVPairs) error {
 	for _, kv := range keys {
-		if err := c.Client.PutKV(kv.Key, kv.Value); err != nil {
+		if err := c.Client.PutKV(kv); err != nil {
 			return err
 		}
 	}
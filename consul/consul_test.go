@@ -1,11 +1,14 @@
 package consul
 
 import (
+	"encoding/json"
 	"fmt"
+	"regexp"
 	"strings"
 	"testing"
 
 	consulapi "github.com/hashicorp/consul/api"
+	"github.com/pshima/consul-snapshot/filter"
 	"github.com/pshima/consul-snapshot/mocks"
 )
 
@@ -255,6 +258,32 @@ func TestListKeysError(t *testing.T) {
 	}
 }
 
+func TestListFilteredKeys(t *testing.T) {
+	mockClient := mocks.NewMockConsulClient()
+	mockClient.KeyData = consulapi.KVPairs{
+		&consulapi.KVPair{Key: "service/db/config", Value: []byte("db")},
+		&consulapi.KVPair{Key: "service/web/config", Value: []byte("web")},
+		&consulapi.KVPair{Key: "service/web/tmp/lock", Value: []byte("lock")},
+		&consulapi.KVPair{Key: "team/other", Value: []byte("other")},
+	}
+
+	consul := NewConsul(mockClient)
+	f := &filter.KV{
+		IncludePrefixes: []string{"service/web/", "service/"},
+		ExcludeRegex:    regexp.MustCompile(`/tmp/`),
+	}
+	if err := consul.ListFilteredKeys(f); err != nil {
+		t.Fatalf("ListFilteredKeys failed: %v", err)
+	}
+
+	if consul.KeyDataLen != 2 {
+		t.Fatalf("expected 2 keys, got %d", consul.KeyDataLen)
+	}
+	if consul.KeyData[0].Key != "service/db/config" || consul.KeyData[1].Key != "service/web/config" {
+		t.Errorf("unexpected keys %v, %v", consul.KeyData[0].Key, consul.KeyData[1].Key)
+	}
+}
+
 func TestListPQsWithMock(t *testing.T) {
 	mockClient := mocks.NewMockConsulClient()
 	mockClient.PQData = []*consulapi.PreparedQueryDefinition{
@@ -304,7 +333,7 @@ func TestRestoreKeys(t *testing.T) {
 	consul := NewConsul(mockClient)
 	
 	keys := consulapi.KVPairs{
-		&consulapi.KVPair{Key: "test1", Value: []byte("value1")},
+		&consulapi.KVPair{Key: "test1", Value: []byte("value1"), Flags: 42},
 		&consulapi.KVPair{Key: "test2", Value: []byte("value2")},
 	}
 	
@@ -317,6 +346,9 @@ func TestRestoreKeys(t *testing.T) {
 	if len(mockClient.KeyData) != 2 {
 		t.Errorf("expected 2 keys in mock, got %d", len(mockClient.KeyData))
 	}
+	if mockClient.KeyData[0].Flags != 42 {
+		t.Errorf("expected flags to be restored, got %d", mockClient.KeyData[0].Flags)
+	}
 }
 
 func TestRestorePQs(t *testing.T) {
@@ -357,4 +389,124 @@ func TestRestoreACLs(t *testing.T) {
 	if len(mockClient.ACLData) != 2 {
 		t.Errorf("expected 2 ACLs in mock, got %d", len(mockClient.ACLData))
 	}
-}
\ No newline at end of file
+}
+
+func TestListACLSystem(t *testing.T) {
+	mockClient := mocks.NewMockConsulClient()
+	mockClient.ACLTokenData = []*consulapi.ACLToken{{AccessorID: "a1", SecretID: "s1"}}
+	mockClient.ACLPolicyData = []*consulapi.ACLPolicy{{ID: "p1", Name: "policy"}}
+	mockClient.ACLRoleData = []*consulapi.ACLRole{{ID: "r1", Name: "role"}}
+	mockClient.ACLAuthMethodData = []*consulapi.ACLAuthMethod{{Name: "k8s", Type: "kubernetes"}}
+	mockClient.ACLBindingRuleData = []*consulapi.ACLBindingRule{{ID: "b1", AuthMethod: "k8s"}}
+
+	consul := NewConsul(mockClient)
+	if err := consul.ListACLSystem(); err != nil {
+		t.Fatalf("ListACLSystem failed: %v", err)
+	}
+
+	system := consul.ACLSystem
+	if len(system.Tokens) != 1 || len(system.Policies) != 1 || len(system.Roles) != 1 ||
+		len(system.AuthMethods) != 1 || len(system.BindingRules) != 1 {
+		t.Errorf("expected one of every ACL object, got %+v", system)
+	}
+}
+
+func TestListACLSystemError(t *testing.T) {
+	mockClient := mocks.NewMockConsulClient()
+	mockClient.ACLSystemError = fmt.Errorf("permission denied")
+
+	consul := NewConsul(mockClient)
+	if err := consul.ListACLSystem(); err == nil {
+		t.Fatal("expected error when listing the ACL system fails")
+	}
+	if consul.ACLSystem != nil {
+		t.Error("expected ACL system to stay unset after an error")
+	}
+}
+
+func TestListConfigEntries(t *testing.T) {
+	mockClient := mocks.NewMockConsulClient()
+	mockClient.ConfigEntryData = map[string][]consulapi.ConfigEntry{
+		consulapi.ServiceDefaults: {
+			&consulapi.ServiceConfigEntry{Kind: consulapi.ServiceDefaults, Name: "web", Protocol: "http"},
+			&consulapi.ServiceConfigEntry{Kind: consulapi.ServiceDefaults, Name: "api", Protocol: "grpc"},
+		},
+		consulapi.ProxyDefaults: {
+			&consulapi.ProxyConfigEntry{Kind: consulapi.ProxyDefaults, Name: consulapi.ProxyConfigGlobal},
+		},
+	}
+
+	consul := NewConsul(mockClient)
+	if err := consul.ListConfigEntries(); err != nil {
+		t.Fatalf("ListConfigEntries failed: %v", err)
+	}
+	if consul.ConfigEntryDataLen != 3 {
+		t.Errorf("expected 3 config entries, got %d", consul.ConfigEntryDataLen)
+	}
+	if len(consul.ConfigEntryData[consulapi.ServiceDefaults]) != 2 {
+		t.Errorf("expected 2 service-defaults entries, got %+v", consul.ConfigEntryData)
+	}
+
+	mockClient.ConfigEntryError = fmt.Errorf("permission denied")
+	if err := consul.ListConfigEntries(); err == nil {
+		t.Error("expected error when listing config entries fails")
+	}
+}
+
+func TestConfigEntriesJSON(t *testing.T) {
+	entries := ConfigEntries{
+		consulapi.ServiceDefaults: {
+			&consulapi.ServiceConfigEntry{Kind: consulapi.ServiceDefaults, Name: "web", Protocol: "http"},
+		},
+		consulapi.MeshConfig: {
+			&consulapi.MeshConfigEntry{TransparentProxy: consulapi.TransparentProxyMeshConfig{MeshDestinationsOnly: true}},
+		},
+	}
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		t.Fatalf("Unable to marshal config entries: %v", err)
+	}
+
+	var decoded ConfigEntries
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Unable to unmarshal config entries: %v", err)
+	}
+
+	service, ok := decoded[consulapi.ServiceDefaults][0].(*consulapi.ServiceConfigEntry)
+	if !ok || service.Name != "web" || service.Protocol != "http" {
+		t.Errorf("expected service-defaults entry to round trip, got %+v", decoded[consulapi.ServiceDefaults])
+	}
+
+	mesh, ok := decoded[consulapi.MeshConfig][0].(*consulapi.MeshConfigEntry)
+	if !ok || !mesh.TransparentProxy.MeshDestinationsOnly {
+		t.Errorf("expected mesh entry to round trip, got %+v", decoded[consulapi.MeshConfig])
+	}
+}
+
+func TestListIntentions(t *testing.T) {
+	mockClient := mocks.NewMockConsulClient()
+	mockClient.IntentionData = []*consulapi.ServiceIntentionsConfigEntry{
+		{
+			Kind: consulapi.ServiceIntentions,
+			Name: "db",
+			Sources: []*consulapi.SourceIntention{
+				{Name: "web", Action: consulapi.IntentionActionAllow},
+				{Name: "*", Action: consulapi.IntentionActionDeny},
+			},
+		},
+	}
+
+	consul := NewConsul(mockClient)
+	if err := consul.ListIntentions(); err != nil {
+		t.Fatalf("ListIntentions failed: %v", err)
+	}
+	if len(consul.IntentionData) != 1 || consul.IntentionDataLen != 2 {
+		t.Errorf("expected 1 destination with 2 intentions, got %d/%d", len(consul.IntentionData), consul.IntentionDataLen)
+	}
+
+	mockClient.IntentionError = fmt.Errorf("permission denied")
+	if err := consul.ListIntentions(); err == nil {
+		t.Error("expected error when listing intentions fails")
+	}
+}
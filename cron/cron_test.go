@@ -0,0 +1,67 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	valid := []string{"5 * * * *", "0 2 * * *", "*/15 9-17 * * mon-fri", "0 0 1,15 jan-jun *", "@hourly", "30 4 * * 7"}
+	for _, expr := range valid {
+		if _, err := Parse(expr, nil); err != nil {
+			t.Errorf("expected %q to parse, got %v", expr, err)
+		}
+	}
+
+	invalid := []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "@often", "x * * * *"}
+	for _, expr := range invalid {
+		if _, err := Parse(expr, nil); err == nil {
+			t.Errorf("expected an error for %q", expr)
+		}
+	}
+}
+
+func TestNext(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatalf("Unable to load time zone: %v", err)
+	}
+	from := time.Date(2017, 8, 16, 9, 33, 40, 0, time.UTC)
+
+	cases := []struct {
+		expr     string
+		location *time.Location
+		next     time.Time
+	}{
+		{"5 * * * *", nil, time.Date(2017, 8, 16, 10, 5, 0, 0, time.UTC)},
+		{"0 2 * * *", nil, time.Date(2017, 8, 17, 2, 0, 0, 0, time.UTC)},
+		{"0 2 * * *", berlin, time.Date(2017, 8, 17, 0, 0, 0, 0, time.UTC)},
+		{"*/15 * * * *", nil, time.Date(2017, 8, 16, 9, 45, 0, 0, time.UTC)},
+		{"0 0 * * sat", nil, time.Date(2017, 8, 19, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 * *", nil, time.Date(2017, 9, 1, 0, 0, 0, 0, time.UTC)},
+		// either day field matches when both are restricted
+		{"0 0 20 * 4", nil, time.Date(2017, 8, 17, 0, 0, 0, 0, time.UTC)},
+		{"@yearly", nil, time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, c := range cases {
+		s, err := Parse(c.expr, c.location)
+		if err != nil {
+			t.Fatalf("Unable to parse %q: %v", c.expr, err)
+		}
+		if next := s.Next(from); !next.Equal(c.next) {
+			t.Errorf("expected %q to run next at %v, got %v", c.expr, c.next, next.UTC())
+		}
+	}
+
+	// runs are strictly after the given time
+	s, _ := Parse("5 * * * *", nil)
+	run := time.Date(2017, 8, 16, 10, 5, 0, 0, time.UTC)
+	if next := s.Next(run); !next.Equal(run.Add(time.Hour)) {
+		t.Errorf("expected the run after %v to be an hour later, got %v", run, next)
+	}
+
+	never, _ := Parse("0 0 31 2 *", nil)
+	if next := never.Next(from); !next.IsZero() {
+		t.Errorf("expected the 31st of February to never run, got %v", next)
+	}
+}
@@ -17,6 +17,9 @@ const (
 	encryptionPrefix  = "v0:"
 )
 
+// PrefixLength is how much of the start of a backup HasEncryptionPrefix needs
+const PrefixLength = len(encryptionPrefix)
+
 // CheckEncryption peeks into the backup to see if it encrypted
 // if it is, then we need to have the CRYPTO_PASSWORD env var
 // or we cant restore it at all
@@ -26,10 +29,13 @@ func CheckEncryption(source string) (bool, error) {
 		return false, fmt.Errorf("[ERR] Unable to read backupfile: %v", err)
 	}
 	// try and peek in to see if we have an encrypted backup
-	if bytes.HasPrefix(backupData, []byte(encryptionPrefix)) {
-		return true, nil
-	}
-	return false, nil
+	return HasEncryptionPrefix(backupData), nil
+}
+
+// HasEncryptionPrefix reports whether the start of a backup shows it is
+// encrypted.  Only the first few bytes of the backup are needed.
+func HasEncryptionPrefix(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(encryptionPrefix))
 }
 
 // EncryptFile takes a file input and encrypts it with a passphrase
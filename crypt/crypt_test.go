@@ -50,3 +50,12 @@ func TestEncryptDecrypt(t *testing.T) {
 		t.Errorf("Encrypt Decrypt returned bad results!\n Expected: %v \n Got: %v", filecontents, data)
 	}
 }
+
+func TestHasEncryptionPrefix(t *testing.T) {
+	if !HasEncryptionPrefix([]byte("v0:")) {
+		t.Error("expected encryption prefix to be detected")
+	}
+	if HasEncryptionPrefix([]byte{0x1f, 0x8b, 0x08}) {
+		t.Error("expected gzip data not to be detected as encrypted")
+	}
+}
@@ -0,0 +1,103 @@
+package filter
+
+import (
+	"regexp"
+	"strings"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// KV selects keys by prefix and regular expression.  A key is selected when
+// it starts with one of the include prefixes, or there are none, matches the
+// include regex if one is set, and is not excluded by an exclude prefix or
+// the exclude regex.
+type KV struct {
+	IncludePrefixes []string       `json:",omitempty"`
+	ExcludePrefixes []string       `json:",omitempty"`
+	IncludeRegex    *regexp.Regexp `json:",omitempty"`
+	ExcludeRegex    *regexp.Regexp `json:",omitempty"`
+}
+
+// Empty reports whether the filter selects every key
+func (f *KV) Empty() bool {
+	return len(f.IncludePrefixes) == 0 && len(f.ExcludePrefixes) == 0 &&
+		f.IncludeRegex == nil && f.ExcludeRegex == nil
+}
+
+// Match reports whether a key is selected by the filter
+func (f *KV) Match(key string) bool {
+	if len(f.IncludePrefixes) > 0 && !hasAnyPrefix(key, f.IncludePrefixes) {
+		return false
+	}
+	if f.IncludeRegex != nil && !f.IncludeRegex.MatchString(key) {
+		return false
+	}
+	if hasAnyPrefix(key, f.ExcludePrefixes) {
+		return false
+	}
+	return f.ExcludeRegex == nil || !f.ExcludeRegex.MatchString(key)
+}
+
+// Apply returns the pairs selected by the filter
+func (f *KV) Apply(pairs consulapi.KVPairs) consulapi.KVPairs {
+	if f.Empty() {
+		return pairs
+	}
+
+	selected := consulapi.KVPairs{}
+	for _, kv := range pairs {
+		if f.Match(kv.Key) {
+			selected = append(selected, kv)
+		}
+	}
+	return selected
+}
+
+// String describes the filter for log lines
+func (f *KV) String() string {
+	if f.Empty() {
+		return "all keys"
+	}
+
+	var parts []string
+	if len(f.IncludePrefixes) > 0 {
+		parts = append(parts, "prefixes "+strings.Join(f.IncludePrefixes, ", "))
+	}
+	if f.IncludeRegex != nil {
+		parts = append(parts, "matching "+f.IncludeRegex.String())
+	}
+	if len(f.ExcludePrefixes) > 0 {
+		parts = append(parts, "excluding "+strings.Join(f.ExcludePrefixes, ", "))
+	}
+	if f.ExcludeRegex != nil {
+		parts = append(parts, "excluding matches of "+f.ExcludeRegex.String())
+	}
+	return strings.Join(parts, " ")
+}
+
+// ParsePrefixes splits a comma separated list of prefixes, as used in
+// environment variables
+func ParsePrefixes(value string) []string {
+	var prefixes []string
+	for _, prefix := range strings.Split(value, ",") {
+		prefix = NormalizePrefix(strings.TrimSpace(prefix))
+		if prefix != "" {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	return prefixes
+}
+
+// NormalizePrefix strips the leading slash consul does not store on keys
+func NormalizePrefix(prefix string) string {
+	return strings.TrimLeft(prefix, "/")
+}
+
+func hasAnyPrefix(key string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
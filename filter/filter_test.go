@@ -0,0 +1,117 @@
+package filter
+
+import (
+	"encoding/json"
+	"regexp"
+	"testing"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+var testPairs = consulapi.KVPairs{
+	{Key: "service/payments/config"},
+	{Key: "service/payments/secret/key"},
+	{Key: "service/web/config"},
+	{Key: "global"},
+}
+
+func TestApplyEmpty(t *testing.T) {
+	f := &KV{}
+	if !f.Empty() || len(f.Apply(testPairs)) != len(testPairs) {
+		t.Error("expected an empty filter to select every key")
+	}
+}
+
+func TestApplyInclude(t *testing.T) {
+	f := &KV{IncludePrefixes: []string{"service/payments/", "global"}}
+	selected := f.Apply(testPairs)
+	if len(selected) != 3 {
+		t.Errorf("expected 3 keys, got %d", len(selected))
+	}
+	if f.Match("service/web/config") {
+		t.Error("expected keys outside the include prefixes not to match")
+	}
+}
+
+func TestApplyExclude(t *testing.T) {
+	f := &KV{
+		IncludePrefixes: []string{"service/"},
+		ExcludePrefixes: []string{"service/payments/secret/"},
+	}
+	selected := f.Apply(testPairs)
+	if len(selected) != 2 {
+		t.Errorf("expected 2 keys, got %d", len(selected))
+	}
+	for _, kv := range selected {
+		if kv.Key == "service/payments/secret/key" {
+			t.Error("expected excluded key to be filtered out")
+		}
+	}
+
+	f = &KV{ExcludePrefixes: []string{"service/"}}
+	if selected := f.Apply(testPairs); len(selected) != 1 || selected[0].Key != "global" {
+		t.Errorf("expected only the key outside the excluded prefix, got %+v", selected)
+	}
+}
+
+func TestString(t *testing.T) {
+	f := &KV{IncludePrefixes: []string{"a/", "b/"}, ExcludePrefixes: []string{"a/x/"}}
+	if f.String() != "prefixes a/, b/ excluding a/x/" {
+		t.Errorf("unexpected description %q", f.String())
+	}
+	if (&KV{}).String() != "all keys" {
+		t.Error("expected empty filter to describe all keys")
+	}
+}
+
+func TestNormalizePrefix(t *testing.T) {
+	if NormalizePrefix("/service/web/") != "service/web/" {
+		t.Error("expected leading slash to be stripped")
+	}
+}
+
+func TestApplyRegex(t *testing.T) {
+	f := &KV{
+		IncludeRegex: regexp.MustCompile(`/config$`),
+		ExcludeRegex: regexp.MustCompile(`^service/web/`),
+	}
+	selected := f.Apply(testPairs)
+	if len(selected) != 1 || selected[0].Key != "service/payments/config" {
+		t.Errorf("expected only service/payments/config, got %+v", selected)
+	}
+	if f.Empty() {
+		t.Error("expected a regex filter not to be empty")
+	}
+}
+
+func TestKVJSON(t *testing.T) {
+	f := &KV{
+		IncludePrefixes: []string{"service/"},
+		ExcludeRegex:    regexp.MustCompile(`secret`),
+	}
+	data, err := json.Marshal(f)
+	if err != nil {
+		t.Fatalf("Unable to marshal filter: %v", err)
+	}
+
+	decoded := &KV{}
+	if err := json.Unmarshal(data, decoded); err != nil {
+		t.Fatalf("Unable to unmarshal filter: %v", err)
+	}
+	if decoded.ExcludeRegex == nil || decoded.ExcludeRegex.String() != "secret" || decoded.IncludeRegex != nil {
+		t.Errorf("expected regexes to round trip, got %s", data)
+	}
+	if decoded.Match("service/secret") || !decoded.Match("service/web") {
+		t.Error("expected decoded filter to match like the original")
+	}
+}
+
+func TestParsePrefixes(t *testing.T) {
+	prefixes := ParsePrefixes(" service/web/, /service/db/,,")
+	if len(prefixes) != 2 || prefixes[0] != "service/web/" || prefixes[1] != "service/db/" {
+		t.Errorf("unexpected prefixes %v", prefixes)
+	}
+	if ParsePrefixes("") != nil {
+		t.Error("expected no prefixes from an empty string")
+	}
+}
@@ -4,11 +4,75 @@ import (
 	"fmt"
 	"net/http"
 	"strconv"
+	"sync"
 	"time"
 
 	consulapi "github.com/hashicorp/consul/api"
 )
 
+// Roles of a backup daemon taking part in leader election
+const (
+	// RoleLeader holds the lock and takes backups
+	RoleLeader = "leader"
+	// RoleFollower waits for the lock and takes over when the leader goes
+	RoleFollower = "follower"
+)
+
+var (
+	roleMu sync.RWMutex
+	role   string
+
+	// maxBackupAge is how old the last backup can be before the check
+	// fails.  Followers only fail after twice as long, so the leader is the
+	// first to be restarted, but a cluster nobody takes backups of is
+	// noticed.
+	maxBackupAge = time.Hour
+	maxAgeMu     sync.RWMutex
+)
+
+// SetMaxAge sets how old the last backup can be before the check fails,
+// the backup schedule decides how often backups are taken
+func SetMaxAge(age time.Duration) {
+	maxAgeMu.Lock()
+	defer maxAgeMu.Unlock()
+	maxBackupAge = age
+}
+
+// SetRole records the role of the daemon, empty without leader election
+func SetRole(r string) {
+	roleMu.Lock()
+	defer roleMu.Unlock()
+	role = r
+}
+
+// Role returns the role of the daemon, empty without leader election
+func Role() string {
+	roleMu.RLock()
+	defer roleMu.RUnlock()
+	return role
+}
+
+// maxAge returns how old the last backup can be for a role
+func maxAge(r string) time.Duration {
+	maxAgeMu.RLock()
+	defer maxAgeMu.RUnlock()
+	if r == RoleFollower {
+		return 2 * maxBackupAge
+	}
+	return maxBackupAge
+}
+
+// ageText describes a maximum age for the health check response
+func ageText(age time.Duration) string {
+	switch {
+	case age == time.Hour:
+		return "1 hour"
+	case age%time.Hour == 0:
+		return fmt.Sprintf("%v hours", int64(age/time.Hour))
+	}
+	return age.String()
+}
+
 func handler(resp http.ResponseWriter, req *http.Request) {
 	consul, err := consulapi.NewClient(consulapi.DefaultNonPooledConfig())
 	if err != nil {
@@ -34,12 +98,19 @@ func handler(resp http.ResponseWriter, req *http.Request) {
 
 	timediff := nowtime - timestampInt
 
-	if timediff > 3600 {
-		http.Error(resp, "[ERR] Backup older than 1 hour", 500)
+	currentRole := Role()
+	if currentRole != "" {
+		resp.Header().Set("X-Consul-Snapshot-Role", currentRole)
+	}
+	if limit := maxAge(currentRole); time.Duration(timediff)*time.Second > limit {
+		http.Error(resp, fmt.Sprintf("[ERR] Backup older than %s", ageText(limit)), 500)
 		return
 	}
 
 	msg := fmt.Sprintf("Last backup %v seconds ago", timediff)
+	if currentRole != "" {
+		msg = fmt.Sprintf("%s (%s)", msg, currentRole)
+	}
 	resp.Write([]byte(msg))
 
 }
@@ -105,4 +105,37 @@ func TestTimestampParsing(t *testing.T) {
 	if err == nil {
 		t.Error("expected error when parsing invalid timestamp")
 	}
-}
\ No newline at end of file
+}
+
+func TestRole(t *testing.T) {
+	if Role() != "" {
+		t.Errorf("Expected no role without leader election, got %s", Role())
+	}
+	SetRole(RoleFollower)
+	if Role() != RoleFollower {
+		t.Errorf("Expected role %s, got %s", RoleFollower, Role())
+	}
+	SetRole(RoleLeader)
+	if Role() != RoleLeader {
+		t.Errorf("Expected role %s, got %s", RoleLeader, Role())
+	}
+	SetRole("")
+}
+
+func TestMaxAge(t *testing.T) {
+	if maxAge("") != time.Hour || maxAge(RoleLeader) != time.Hour {
+		t.Errorf("Expected backups to go stale after an hour, got %v and %v", maxAge(""), maxAge(RoleLeader))
+	}
+	if maxAge(RoleFollower) != 2*time.Hour {
+		t.Errorf("Expected followers to fail on stale backups after two hours, got %v", maxAge(RoleFollower))
+	}
+
+	SetMaxAge(25 * time.Hour)
+	defer SetMaxAge(time.Hour)
+	if maxAge(RoleLeader) != 25*time.Hour || maxAge(RoleFollower) != 50*time.Hour {
+		t.Errorf("Expected the max age of the schedule, got %v and %v", maxAge(RoleLeader), maxAge(RoleFollower))
+	}
+	if ageText(time.Hour) != "1 hour" || ageText(50*time.Hour) != "50 hours" || ageText(90*time.Minute) != "1h30m0s" {
+		t.Errorf("Unexpected age texts %q %q %q", ageText(time.Hour), ageText(50*time.Hour), ageText(90*time.Minute))
+	}
+}
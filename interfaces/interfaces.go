@@ -1,23 +1,74 @@
 package interfaces
 
 import (
+	"io"
+	"time"
+
 	consulapi "github.com/hashicorp/consul/api"
 )
 
 // ConsulClient interface for mocking consul operations
 type ConsulClient interface {
-	ListKeys() (consulapi.KVPairs, error)
+	ListKeys(prefix string) (consulapi.KVPairs, error)
 	ListPQs() ([]*consulapi.PreparedQueryDefinition, error)
 	ListACLs() ([]*consulapi.ACLEntry, error)
-	PutKV(key string, value []byte) error
+	ListACLTokens() ([]*consulapi.ACLToken, error)
+	ListACLPolicies() ([]*consulapi.ACLPolicy, error)
+	ListACLRoles() ([]*consulapi.ACLRole, error)
+	ListACLAuthMethods() ([]*consulapi.ACLAuthMethod, error)
+	ListACLBindingRules() ([]*consulapi.ACLBindingRule, error)
+	ListConfigEntries(kind string) ([]consulapi.ConfigEntry, error)
+	ListIntentions() ([]*consulapi.ServiceIntentionsConfigEntry, error)
+	PutKV(kv *consulapi.KVPair) error
+	CASKV(kv *consulapi.KVPair) (bool, error)
+	DeleteCASKV(kv *consulapi.KVPair) (bool, error)
+	KVTxn(ops consulapi.KVTxnOps) (bool, *consulapi.TxnResponse, error)
 	CreatePQ(pq *consulapi.PreparedQueryDefinition) error
+	UpdatePQ(pq *consulapi.PreparedQueryDefinition) error
 	CreateACL(acl *consulapi.ACLEntry) error
+	UpdateACL(acl *consulapi.ACLEntry) error
+	CreateACLToken(token *consulapi.ACLToken) error
+	UpdateACLToken(token *consulapi.ACLToken) error
+	CreateACLPolicy(policy *consulapi.ACLPolicy) (*consulapi.ACLPolicy, error)
+	UpdateACLPolicy(policy *consulapi.ACLPolicy) (*consulapi.ACLPolicy, error)
+	CreateACLRole(role *consulapi.ACLRole) (*consulapi.ACLRole, error)
+	UpdateACLRole(role *consulapi.ACLRole) (*consulapi.ACLRole, error)
+	CreateACLAuthMethod(method *consulapi.ACLAuthMethod) error
+	UpdateACLAuthMethod(method *consulapi.ACLAuthMethod) error
+	CreateACLBindingRule(rule *consulapi.ACLBindingRule) error
+	UpdateACLBindingRule(rule *consulapi.ACLBindingRule) error
+	SetConfigEntry(entry consulapi.ConfigEntry) error
+	SetIntentions(entry *consulapi.ServiceIntentionsConfigEntry) error
+	Datacenter() (string, error)
+	SaveSnapshot() (io.ReadCloser, error)
+	RestoreSnapshot(snapshot io.Reader) error
+	KVIndex(waitIndex uint64, wait time.Duration) (uint64, error)
+	PQIndex(waitIndex uint64, wait time.Duration) (uint64, error)
+	ACLIndex(waitIndex uint64, wait time.Duration) (uint64, error)
+	NewLock(key, value string) (Locker, error)
+}
+
+// Locker is a lock on a consul key held through a session, as used for
+// leader election
+type Locker interface {
+	Lock(stopCh <-chan struct{}) (<-chan struct{}, error)
+	Unlock() error
 }
 
 // StorageClient interface for mocking cloud storage operations
 type StorageClient interface {
 	Upload(bucket, key string, data []byte) error
 	Download(bucket, key string) ([]byte, error)
+	List(bucket, prefix string) ([]StorageObject, error)
+	ListPrefixes(bucket, prefix string) ([]string, error)
+	Peek(bucket, key string, length int64) ([]byte, error)
+}
+
+// StorageObject describes an object found when listing a bucket
+type StorageObject struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
 }
 
 // FileSystem interface for mocking file operations
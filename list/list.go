@@ -0,0 +1,318 @@
+package list
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pshima/consul-snapshot/adapters"
+	"github.com/pshima/consul-snapshot/config"
+	"github.com/pshima/consul-snapshot/crypt"
+	"github.com/pshima/consul-snapshot/interfaces"
+)
+
+// backupName matches the object names written by backup.writeBackupRemote,
+// <host>.consul.snapshot.<unix timestamp>.tar.gz
+var backupName = regexp.MustCompile(`^(.*)\.consul\.snapshot\.(\d+)\.tar\.gz$`)
+
+// timeFormats are the layouts accepted by ParseTime after unix timestamps
+var timeFormats = []string{
+	time.RFC3339,
+	"2006-01-02T15:04",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// Backup describes a single backup found in a bucket
+type Backup struct {
+	Key       string
+	Host      string
+	Time      time.Time
+	Size      int64
+	Encrypted bool
+	// Unreadable says why the backup could not be read, e.g. because the
+	// object is empty or truncated
+	Unreadable string `json:",omitempty"`
+}
+
+// Filter limits which backups are listed, empty fields match everything
+type Filter struct {
+	Since time.Time
+	Until time.Time
+	Host  string
+}
+
+func (f Filter) matches(b Backup) bool {
+	if !f.Since.IsZero() && b.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && b.Time.After(f.Until) {
+		return false
+	}
+	if f.Host != "" && b.Host != f.Host {
+		return false
+	}
+	return true
+}
+
+// mayHold reports whether a date directory for the days from start up to
+// end can hold backups matching the filter.  Directories are named after
+// the date on the host that took the backup, which can be a day off from
+// UTC.
+func (f Filter) mayHold(start, end time.Time) bool {
+	if !f.Since.IsZero() && !end.Add(24*time.Hour).After(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && start.Add(-24*time.Hour).After(f.Until) {
+		return false
+	}
+	return true
+}
+
+// Bucket returns the bucket backups are kept in.  Like restore, Google Cloud
+// Storage is used when GCSBUCKET is set and S3 otherwise.
+func Bucket(conf *config.Config) string {
+	if len(conf.GCSBucket) > 0 {
+		return conf.GCSBucket
+	}
+	return conf.S3Bucket
+}
+
+// Storage returns the storage client for the bucket backups are kept in
+func Storage(conf *config.Config) (interfaces.StorageClient, error) {
+	if len(conf.GCSBucket) > 0 {
+		client, err := adapters.NewGCSAdapter()
+		if err != nil {
+			return nil, fmt.Errorf("Could not initialize connection with Google Cloud Storage: %v", err)
+		}
+		return client, nil
+	}
+	return adapters.NewS3Adapter(conf.S3Region, conf.S3Endpoint, conf.S3ServerSideEncryption, conf.S3KmsKeyID), nil
+}
+
+// Backups lists the backups stored in a bucket under prefix that match the
+// filter, oldest first.  Objects that were not written by consul-snapshot
+// are ignored, backups that can not be read are listed as unreadable.
+// Telling encrypted backups apart reads the start of every backup, so the
+// filter is applied first.
+func Backups(client interfaces.StorageClient, bucket, prefix string, filter Filter) ([]Backup, error) {
+	backups, err := find(client, bucket, prefix, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range backups {
+		// S3 refuses range reads of empty objects
+		if backups[i].Size == 0 {
+			backups[i].Unreadable = "empty object"
+			continue
+		}
+		head, err := client.Peek(bucket, backups[i].Key, int64(crypt.PrefixLength))
+		if err != nil {
+			backups[i].Unreadable = err.Error()
+			continue
+		}
+		backups[i].Encrypted = crypt.HasEncryptionPrefix(head)
+	}
+	return backups, nil
+}
+
+// Latest returns the newest backup under prefix that matches the filter.
+// It walks the date directories newest first and stops after the first one
+// with a match, and the day before it, as the hosts taking backups can be a
+// day apart.
+func Latest(client interfaces.StorageClient, bucket, prefix string, filter Filter) (Backup, error) {
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix = prefix + "/"
+	}
+
+	var latest *Backup
+	daysAfterMatch := 1
+	err := walkDays(client, bucket, prefix, filter, func(day string) (bool, error) {
+		if latest != nil {
+			if daysAfterMatch == 0 {
+				return true, nil
+			}
+			daysAfterMatch--
+		}
+		backups, err := findIn(client, bucket, day, filter)
+		for i := range backups {
+			if latest == nil || backups[i].Time.After(latest.Time) {
+				latest = &backups[i]
+			}
+		}
+		return false, err
+	})
+	if err != nil {
+		return Backup{}, err
+	}
+	if latest == nil {
+		return Backup{}, fmt.Errorf("No backups found in %s/%s matching the selection", bucket, prefix)
+	}
+	return *latest, nil
+}
+
+// find lists and parses the backups under prefix without reading them.
+// With a time range only the date directories in the range are listed.
+func find(client interfaces.StorageClient, bucket, prefix string, filter Filter) ([]Backup, error) {
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix = prefix + "/"
+	}
+
+	var backups []Backup
+	if filter.Since.IsZero() && filter.Until.IsZero() {
+		found, err := findIn(client, bucket, prefix, filter)
+		if err != nil {
+			return nil, err
+		}
+		backups = found
+	} else {
+		err := walkDays(client, bucket, prefix, filter, func(day string) (bool, error) {
+			found, err := findIn(client, bucket, day, filter)
+			backups = append(backups, found...)
+			return false, err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sort.SliceStable(backups, func(i, j int) bool {
+		return backups[i].Time.Before(backups[j].Time)
+	})
+	return backups, nil
+}
+
+// findIn lists the objects under prefix and parses the backups among them
+// that match the filter
+func findIn(client interfaces.StorageClient, bucket, prefix string, filter Filter) ([]Backup, error) {
+	objects, err := client.List(bucket, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list %s/%s: %v", bucket, prefix, err)
+	}
+
+	var backups []Backup
+	for _, obj := range objects {
+		host, backupTime, ok := ParseBackupName(obj.Key)
+		if !ok {
+			continue
+		}
+		b := Backup{
+			Key:  obj.Key,
+			Host: host,
+			Time: backupTime,
+			Size: obj.Size,
+		}
+		if filter.matches(b) {
+			backups = append(backups, b)
+		}
+	}
+	return backups, nil
+}
+
+// walkDays calls fn with the <year>/<month>/<day>/ directories under prefix
+// that backups are uploaded to, newest first, skipping the ones outside the
+// time range of the filter.  fn returns true to stop the walk.
+func walkDays(client interfaces.StorageClient, bucket, prefix string, filter Filter, fn func(day string) (bool, error)) error {
+	years, err := numberedDirs(client, bucket, prefix)
+	if err != nil {
+		return err
+	}
+	for _, year := range years {
+		start := time.Date(year.number, 1, 1, 0, 0, 0, 0, time.UTC)
+		if !filter.mayHold(start, start.AddDate(1, 0, 0)) {
+			continue
+		}
+		months, err := numberedDirs(client, bucket, year.prefix)
+		if err != nil {
+			return err
+		}
+		for _, month := range months {
+			start := time.Date(year.number, time.Month(month.number), 1, 0, 0, 0, 0, time.UTC)
+			if !filter.mayHold(start, start.AddDate(0, 1, 0)) {
+				continue
+			}
+			days, err := numberedDirs(client, bucket, month.prefix)
+			if err != nil {
+				return err
+			}
+			for _, day := range days {
+				start := time.Date(year.number, time.Month(month.number), day.number, 0, 0, 0, 0, time.UTC)
+				if !filter.mayHold(start, start.AddDate(0, 0, 1)) {
+					continue
+				}
+				stop, err := fn(day.prefix)
+				if err != nil || stop {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// numberedDir is a directory named with a number, like the year, month and
+// day directories backups are uploaded to
+type numberedDir struct {
+	prefix string
+	number int
+}
+
+// numberedDirs lists the numbered directories directly under prefix,
+// highest first.  Other directories are skipped.
+func numberedDirs(client interfaces.StorageClient, bucket, prefix string) ([]numberedDir, error) {
+	prefixes, err := client.ListPrefixes(bucket, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list %s/%s: %v", bucket, prefix, err)
+	}
+
+	var dirs []numberedDir
+	for _, p := range prefixes {
+		number, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(p, prefix), "/"))
+		if err != nil {
+			continue
+		}
+		dirs = append(dirs, numberedDir{prefix: p, number: number})
+	}
+	sort.Slice(dirs, func(i, j int) bool { return dirs[i].number > dirs[j].number })
+	return dirs, nil
+}
+
+// ParseBackupName pulls the host and start time out of a backup object key
+func ParseBackupName(key string) (string, time.Time, bool) {
+	name := key
+	if i := strings.LastIndex(key, "/"); i >= 0 {
+		name = key[i+1:]
+	}
+
+	match := backupName.FindStringSubmatch(name)
+	if match == nil {
+		return "", time.Time{}, false
+	}
+
+	timestamp, err := strconv.ParseInt(match[2], 10, 64)
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	return match[1], time.Unix(timestamp, 0), true
+}
+
+// ParseTime parses a time given on the command line, either a unix
+// timestamp or a date in one of the timeFormats.  Dates without a zone are
+// read as local time.
+func ParseTime(value string) (time.Time, error) {
+	if timestamp, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(timestamp, 0), nil
+	}
+
+	for _, layout := range timeFormats {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("Unable to parse time %q, use a unix timestamp, RFC3339 or YYYY-MM-DD", value)
+}
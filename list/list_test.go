@@ -0,0 +1,188 @@
+package list
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pshima/consul-snapshot/config"
+	"github.com/pshima/consul-snapshot/mocks"
+)
+
+const testBucket = "consul-backup-testing"
+
+func testingStorage() *mocks.MockStorageClient {
+	storage := mocks.NewMockStorageClient()
+	storage.Data[testBucket+"/backups/2017/8/16/web1.consul.snapshot.1502901220.tar.gz"] = []byte("v0:encrypted")
+	storage.Data[testBucket+"/backups/2017/8/17/web2.consul.snapshot.1502987620.tar.gz"] = []byte("plain gzip data")
+	storage.Data[testBucket+"/backups/2017/8/15/web1.consul.snapshot.1502814820.tar.gz"] = []byte("plain gzip data")
+	storage.Data[testBucket+"/backups/README.txt"] = []byte("not a backup")
+	storage.Data[testBucket+"/other/2017/8/16/web1.consul.snapshot.1502901220.tar.gz"] = []byte("other prefix")
+	return storage
+}
+
+func TestBackups(t *testing.T) {
+	backups, err := Backups(testingStorage(), testBucket, "backups", Filter{})
+	if err != nil {
+		t.Fatalf("Backups failed: %v", err)
+	}
+
+	if len(backups) != 3 {
+		t.Fatalf("expected 3 backups, got %d: %+v", len(backups), backups)
+	}
+	if backups[0].Time.Unix() != 1502814820 || backups[2].Time.Unix() != 1502987620 {
+		t.Errorf("expected backups sorted oldest first, got %+v", backups)
+	}
+
+	b := backups[1]
+	if b.Host != "web1" || b.Size != int64(len("v0:encrypted")) || !b.Encrypted {
+		t.Errorf("unexpected backup details %+v", b)
+	}
+	if backups[0].Encrypted {
+		t.Error("expected plain backup not to be reported as encrypted")
+	}
+}
+
+func TestBackupsUnreadable(t *testing.T) {
+	storage := testingStorage()
+	storage.Data[testBucket+"/backups/2017/8/18/web1.consul.snapshot.1503074020.tar.gz"] = []byte{}
+	storage.PeekErrors = map[string]error{
+		testBucket + "/backups/2017/8/17/web2.consul.snapshot.1502987620.tar.gz": fmt.Errorf("InvalidRange"),
+	}
+
+	backups, err := Backups(storage, testBucket, "backups", Filter{})
+	if err != nil {
+		t.Fatalf("Backups failed: %v", err)
+	}
+	if len(backups) != 4 {
+		t.Fatalf("expected 4 backups, got %d: %+v", len(backups), backups)
+	}
+	if backups[0].Unreadable != "" || backups[1].Unreadable != "" || !backups[1].Encrypted {
+		t.Errorf("expected readable backups to be listed as before, got %+v", backups[:2])
+	}
+	if backups[2].Unreadable != "InvalidRange" {
+		t.Errorf("expected the failed read to be reported, got %+v", backups[2])
+	}
+	if backups[3].Unreadable != "empty object" {
+		t.Errorf("expected the empty backup to be reported, got %+v", backups[3])
+	}
+}
+
+func TestBackupsFilter(t *testing.T) {
+	storage := testingStorage()
+
+	backups, err := Backups(storage, testBucket, "backups/", Filter{Host: "web1"})
+	if err != nil {
+		t.Fatalf("Backups failed: %v", err)
+	}
+	if len(backups) != 2 {
+		t.Errorf("expected 2 backups for web1, got %d", len(backups))
+	}
+
+	filter := Filter{Since: time.Unix(1502901220, 0), Until: time.Unix(1502901220, 0)}
+	backups, err = Backups(storage, testBucket, "backups", filter)
+	if err != nil {
+		t.Fatalf("Backups failed: %v", err)
+	}
+	if len(backups) != 1 || backups[0].Time.Unix() != 1502901220 {
+		t.Errorf("expected only the backup inside the time range, got %+v", backups)
+	}
+
+	storage.ListError = fmt.Errorf("access denied")
+	if _, err := Backups(storage, testBucket, "backups", Filter{}); err == nil {
+		t.Error("expected an error when listing the bucket fails")
+	}
+}
+
+func TestBackupsListsOnlyMatchingDays(t *testing.T) {
+	storage := testingStorage()
+	storage.Data[testBucket+"/backups/2017/8/20/web1.consul.snapshot.1503246820.tar.gz"] = []byte("plain gzip data")
+	storage.Data[testBucket+"/backups/2016/12/31/web1.consul.snapshot.1483185600.tar.gz"] = []byte("plain gzip data")
+
+	filter := Filter{Since: time.Unix(1502901220, 0), Until: time.Unix(1502901220, 0), Host: "web1"}
+	backups, err := Backups(storage, testBucket, "backups", filter)
+	if err != nil {
+		t.Fatalf("Backups failed: %v", err)
+	}
+	if len(backups) != 1 || backups[0].Time.Unix() != 1502901220 {
+		t.Errorf("expected only the backup inside the time range, got %+v", backups)
+	}
+
+	// the days around the range are listed as a host can be a day off
+	// from UTC, but not the ones further away
+	if !reflect.DeepEqual(storage.ListCalls, []string{"backups/2017/8/17/", "backups/2017/8/16/", "backups/2017/8/15/"}) {
+		t.Errorf("expected only the days around the range to be listed, got %v", storage.ListCalls)
+	}
+	if !reflect.DeepEqual(storage.PeekCalls, []string{"backups/2017/8/16/web1.consul.snapshot.1502901220.tar.gz"}) {
+		t.Errorf("expected only the matching backup to be read, got %v", storage.PeekCalls)
+	}
+}
+
+func TestLatest(t *testing.T) {
+	storage := testingStorage()
+	storage.Data[testBucket+"/backups/2017/8/14/web2.consul.snapshot.1502728420.tar.gz"] = []byte("plain gzip data")
+	storage.Data[testBucket+"/backups/2016/12/31/web2.consul.snapshot.1483185600.tar.gz"] = []byte("plain gzip data")
+
+	latest, err := Latest(storage, testBucket, "backups", Filter{})
+	if err != nil || latest.Time.Unix() != 1502987620 {
+		t.Errorf("expected the newest backup, got %+v %v", latest, err)
+	}
+
+	// the walk stops a day after the first match and at the time range
+	storage.ListCalls = nil
+	latest, err = Latest(storage, testBucket, "backups", Filter{Until: time.Unix(1502901220, 0), Host: "web1"})
+	if err != nil || latest.Time.Unix() != 1502901220 {
+		t.Errorf("expected the newest web1 backup before the time, got %+v %v", latest, err)
+	}
+	if !reflect.DeepEqual(storage.ListCalls, []string{"backups/2017/8/17/", "backups/2017/8/16/", "backups/2017/8/15/"}) {
+		t.Errorf("expected the walk to stop after the match, listed %v", storage.ListCalls)
+	}
+
+	if _, err := Latest(storage, testBucket, "backups", Filter{Host: "web3"}); err == nil {
+		t.Error("expected an error when no backup matches")
+	}
+}
+
+func TestParseBackupName(t *testing.T) {
+	host, backupTime, ok := ParseBackupName("backups/2017/8/16/macbook.local.consul.snapshot.1502901220.tar.gz")
+	if !ok || host != "macbook.local" || backupTime.Unix() != 1502901220 {
+		t.Errorf("unexpected parse result %v %v %v", host, backupTime, ok)
+	}
+
+	for _, key := range []string{"backups/acceptancetest.tar.gz", "backups/host.consul.snapshot.abc.tar.gz", "meta.json"} {
+		if _, _, ok := ParseBackupName(key); ok {
+			t.Errorf("expected %s not to parse as a backup", key)
+		}
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	parsed, err := ParseTime("1502901220")
+	if err != nil || parsed.Unix() != 1502901220 {
+		t.Errorf("expected unix timestamp to parse, got %v %v", parsed, err)
+	}
+
+	parsed, err = ParseTime("2017-08-16T16:33:40Z")
+	if err != nil || parsed.Unix() != 1502901220 {
+		t.Errorf("expected RFC3339 time to parse, got %v %v", parsed, err)
+	}
+
+	parsed, err = ParseTime("2017-08-16")
+	if err != nil || parsed.Year() != 2017 || parsed.Month() != 8 || parsed.Day() != 16 {
+		t.Errorf("expected date to parse, got %v %v", parsed, err)
+	}
+
+	if _, err := ParseTime("last tuesday"); err == nil {
+		t.Error("expected an error for an unparsable time")
+	}
+}
+
+func TestBucket(t *testing.T) {
+	if Bucket(&config.Config{S3Bucket: "s3", GCSBucket: "gcs"}) != "gcs" {
+		t.Error("expected GCS bucket to be preferred")
+	}
+	if Bucket(&config.Config{S3Bucket: "s3"}) != "s3" {
+		t.Error("expected S3 bucket when GCS is not set")
+	}
+}
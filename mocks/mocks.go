@@ -1,23 +1,66 @@
 package mocks
 
 import (
+	"bytes"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	consulapi "github.com/hashicorp/consul/api"
+	"github.com/pshima/consul-snapshot/interfaces"
 )
 
 // MockConsulClient implements ConsulClient for testing
 type MockConsulClient struct {
-	KeyData       consulapi.KVPairs
-	PQData        []*consulapi.PreparedQueryDefinition
-	ACLData       []*consulapi.ACLEntry
-	KeyError      error
-	PQError       error
-	ACLError      error
-	ACLDisabled   bool
-	PutKVError    error
-	CreatePQError error
-	CreateACLError error
+	KeyData              consulapi.KVPairs
+	PQData               []*consulapi.PreparedQueryDefinition
+	ACLData              []*consulapi.ACLEntry
+	ACLTokenData         []*consulapi.ACLToken
+	ACLPolicyData        []*consulapi.ACLPolicy
+	ACLRoleData          []*consulapi.ACLRole
+	ACLAuthMethodData    []*consulapi.ACLAuthMethod
+	ACLBindingRuleData   []*consulapi.ACLBindingRule
+	ConfigEntryData      map[string][]consulapi.ConfigEntry
+	IntentionData        []*consulapi.ServiceIntentionsConfigEntry
+	SnapshotData         []byte
+	RestoredSnapshot     []byte
+	DatacenterName       string
+	DeletedKeys          []string
+	Txns                 []consulapi.KVTxnOps
+	KeyError             error
+	PQError              error
+	ACLError             error
+	ACLDisabled          bool
+	PutKVError           error
+	DeleteKVError        error
+	TxnError             error
+	TxnFailures          int
+	TxnRollback          *consulapi.TxnResponse
+	CreatePQError        error
+	UpdatePQError        error
+	CreateACLError       error
+	UpdateACLError       error
+	ACLSystemError       error
+	ACLSystemWriteError  error
+	ConfigEntryError     error
+	SetConfigEntryError  error
+	IntentionError       error
+	SetIntentionsError   error
+	SnapshotError        error
+	RestoreSnapshotError error
+	DatacenterError      error
+	WatchIndex           uint64
+	WatchError           error
+	Lock                 *MockLocker
+	LockError            error
+
+	lastIndex uint64
+	// mu guards the key data against restores writing from several workers
+	mu sync.Mutex
 }
 
 // NewMockConsulClient creates a new mock consul client
@@ -25,12 +68,21 @@ func NewMockConsulClient() *MockConsulClient {
 	return &MockConsulClient{}
 }
 
-// ListKeys returns mock key data
-func (m *MockConsulClient) ListKeys() (consulapi.KVPairs, error) {
+// ListKeys returns the mock key data under a prefix
+func (m *MockConsulClient) ListKeys(prefix string) (consulapi.KVPairs, error) {
 	if m.KeyError != nil {
 		return nil, m.KeyError
 	}
-	return m.KeyData, nil
+	if prefix == "" {
+		return m.KeyData, nil
+	}
+	var keys consulapi.KVPairs
+	for _, kv := range m.KeyData {
+		if strings.HasPrefix(kv.Key, prefix) {
+			keys = append(keys, kv)
+		}
+	}
+	return keys, nil
 }
 
 // ListPQs returns mock prepared query data
@@ -53,15 +105,118 @@ func (m *MockConsulClient) ListACLs() ([]*consulapi.ACLEntry, error) {
 }
 
 // PutKV mocks putting a key-value pair
-func (m *MockConsulClient) PutKV(key string, value []byte) error {
+func (m *MockConsulClient) PutKV(kv *consulapi.KVPair) error {
 	if m.PutKVError != nil {
 		return m.PutKVError
 	}
 	// Add to mock data
-	m.KeyData = append(m.KeyData, &consulapi.KVPair{Key: key, Value: value})
+	m.KeyData = append(m.KeyData, &consulapi.KVPair{Key: kv.Key, Value: kv.Value, Flags: kv.Flags})
 	return nil
 }
 
+// CASKV mocks a check-and-set write against the ModifyIndex of the mock
+// key data
+func (m *MockConsulClient) CASKV(kv *consulapi.KVPair) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.PutKVError != nil {
+		return false, m.PutKVError
+	}
+	if !m.casMatches(kv.Key, kv.ModifyIndex) {
+		return false, nil
+	}
+	m.setKey(kv)
+	return true, nil
+}
+
+// casMatches reports whether a check-and-set with index would succeed
+func (m *MockConsulClient) casMatches(key string, index uint64) bool {
+	for _, existing := range m.KeyData {
+		if existing.Key == key {
+			return existing.ModifyIndex == index
+		}
+	}
+	return index == 0
+}
+
+// setKey replaces or adds a key and bumps its ModifyIndex
+func (m *MockConsulClient) setKey(kv *consulapi.KVPair) *consulapi.KVPair {
+	m.lastIndex++
+	written := &consulapi.KVPair{Key: kv.Key, Value: kv.Value, Flags: kv.Flags, ModifyIndex: m.lastIndex}
+	m.removeKeys(func(k string) bool { return k == kv.Key })
+	m.KeyData = append(m.KeyData, written)
+	return written
+}
+
+// DeleteCASKV mocks deleting a key with check-and-set
+func (m *MockConsulClient) DeleteCASKV(kv *consulapi.KVPair) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.DeleteKVError != nil {
+		return false, m.DeleteKVError
+	}
+	if !m.casMatches(kv.Key, kv.ModifyIndex) {
+		return false, nil
+	}
+	m.DeletedKeys = append(m.DeletedKeys, kv.Key)
+	m.removeKeys(func(k string) bool { return k == kv.Key })
+	return true, nil
+}
+
+// KVTxn mocks a KV transaction.  The first TxnFailures calls fail with
+// TxnError, after that set operations are applied to the mock key data.
+// Every transaction is rolled back with TxnRollback when it is set.
+func (m *MockConsulClient) KVTxn(ops consulapi.KVTxnOps) (bool, *consulapi.TxnResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Txns = append(m.Txns, ops)
+	if m.TxnFailures > 0 {
+		m.TxnFailures--
+		return false, nil, m.TxnError
+	}
+	if m.TxnRollback != nil {
+		return false, m.TxnRollback, nil
+	}
+
+	// check every operation first so a failed transaction writes nothing
+	rollback := &consulapi.TxnResponse{}
+	for i, op := range ops {
+		switch op.Verb {
+		case consulapi.KVSet:
+		case consulapi.KVCAS:
+			if !m.casMatches(op.Key, op.Index) {
+				rollback.Errors = append(rollback.Errors, &consulapi.TxnError{
+					OpIndex: i, What: fmt.Sprintf("failed to set key %q, index is stale", op.Key),
+				})
+			}
+		default:
+			rollback.Errors = append(rollback.Errors, &consulapi.TxnError{
+				OpIndex: i, What: fmt.Sprintf("unsupported verb %s", op.Verb),
+			})
+		}
+	}
+	if len(rollback.Errors) > 0 {
+		return false, rollback, nil
+	}
+
+	resp := &consulapi.TxnResponse{}
+	for _, op := range ops {
+		kv := m.setKey(&consulapi.KVPair{Key: op.Key, Value: op.Value, Flags: op.Flags})
+		resp.Results = append(resp.Results, &consulapi.TxnResult{KV: kv})
+	}
+	return true, resp, nil
+}
+
+func (m *MockConsulClient) removeKeys(match func(string) bool) {
+	var kept consulapi.KVPairs
+	for _, kv := range m.KeyData {
+		if !match(kv.Key) {
+			kept = append(kept, kv)
+		}
+	}
+	m.KeyData = kept
+}
+
 // CreatePQ mocks creating a prepared query
 func (m *MockConsulClient) CreatePQ(pq *consulapi.PreparedQueryDefinition) error {
 	if m.CreatePQError != nil {
@@ -71,6 +226,20 @@ func (m *MockConsulClient) CreatePQ(pq *consulapi.PreparedQueryDefinition) error
 	return nil
 }
 
+// UpdatePQ mocks updating a prepared query, replacing the one with the same ID
+func (m *MockConsulClient) UpdatePQ(pq *consulapi.PreparedQueryDefinition) error {
+	if m.UpdatePQError != nil {
+		return m.UpdatePQError
+	}
+	for i, existing := range m.PQData {
+		if existing.ID == pq.ID {
+			m.PQData[i] = pq
+			return nil
+		}
+	}
+	return fmt.Errorf("prepared query not found: %s", pq.ID)
+}
+
 // CreateACL mocks creating an ACL
 func (m *MockConsulClient) CreateACL(acl *consulapi.ACLEntry) error {
 	if m.CreateACLError != nil {
@@ -80,6 +249,350 @@ func (m *MockConsulClient) CreateACL(acl *consulapi.ACLEntry) error {
 	return nil
 }
 
+// UpdateACL mocks updating an ACL, replacing the one with the same ID
+func (m *MockConsulClient) UpdateACL(acl *consulapi.ACLEntry) error {
+	if m.UpdateACLError != nil {
+		return m.UpdateACLError
+	}
+	for i, existing := range m.ACLData {
+		if existing.ID == acl.ID {
+			m.ACLData[i] = acl
+			return nil
+		}
+	}
+	return fmt.Errorf("acl not found: %s", acl.ID)
+}
+
+// ListACLTokens returns mock ACL token data
+func (m *MockConsulClient) ListACLTokens() ([]*consulapi.ACLToken, error) {
+	if m.ACLSystemError != nil {
+		return nil, m.ACLSystemError
+	}
+	return m.ACLTokenData, nil
+}
+
+// ListACLPolicies returns mock ACL policy data
+func (m *MockConsulClient) ListACLPolicies() ([]*consulapi.ACLPolicy, error) {
+	if m.ACLSystemError != nil {
+		return nil, m.ACLSystemError
+	}
+	return m.ACLPolicyData, nil
+}
+
+// ListACLRoles returns mock ACL role data
+func (m *MockConsulClient) ListACLRoles() ([]*consulapi.ACLRole, error) {
+	if m.ACLSystemError != nil {
+		return nil, m.ACLSystemError
+	}
+	return m.ACLRoleData, nil
+}
+
+// ListACLAuthMethods returns mock ACL auth method data
+func (m *MockConsulClient) ListACLAuthMethods() ([]*consulapi.ACLAuthMethod, error) {
+	if m.ACLSystemError != nil {
+		return nil, m.ACLSystemError
+	}
+	return m.ACLAuthMethodData, nil
+}
+
+// ListACLBindingRules returns mock ACL binding rule data
+func (m *MockConsulClient) ListACLBindingRules() ([]*consulapi.ACLBindingRule, error) {
+	if m.ACLSystemError != nil {
+		return nil, m.ACLSystemError
+	}
+	return m.ACLBindingRuleData, nil
+}
+
+// CreateACLToken mocks creating an ACL token
+func (m *MockConsulClient) CreateACLToken(token *consulapi.ACLToken) error {
+	if m.ACLSystemWriteError != nil {
+		return m.ACLSystemWriteError
+	}
+	m.ACLTokenData = append(m.ACLTokenData, token)
+	return nil
+}
+
+// UpdateACLToken mocks updating an ACL token, replacing the one with the same accessor ID
+func (m *MockConsulClient) UpdateACLToken(token *consulapi.ACLToken) error {
+	if m.ACLSystemWriteError != nil {
+		return m.ACLSystemWriteError
+	}
+	for i, existing := range m.ACLTokenData {
+		if existing.AccessorID == token.AccessorID {
+			m.ACLTokenData[i] = token
+			return nil
+		}
+	}
+	return fmt.Errorf("acl token not found: %s", token.AccessorID)
+}
+
+// CreateACLPolicy mocks creating an ACL policy, assigning it a new ID
+func (m *MockConsulClient) CreateACLPolicy(policy *consulapi.ACLPolicy) (*consulapi.ACLPolicy, error) {
+	if m.ACLSystemWriteError != nil {
+		return nil, m.ACLSystemWriteError
+	}
+	policy.ID = fmt.Sprintf("mock-policy-%d", len(m.ACLPolicyData))
+	m.ACLPolicyData = append(m.ACLPolicyData, policy)
+	return policy, nil
+}
+
+// UpdateACLPolicy mocks updating an ACL policy, replacing the one with the same ID
+func (m *MockConsulClient) UpdateACLPolicy(policy *consulapi.ACLPolicy) (*consulapi.ACLPolicy, error) {
+	if m.ACLSystemWriteError != nil {
+		return nil, m.ACLSystemWriteError
+	}
+	for i, existing := range m.ACLPolicyData {
+		if existing.ID == policy.ID {
+			m.ACLPolicyData[i] = policy
+			return policy, nil
+		}
+	}
+	return nil, fmt.Errorf("acl policy not found: %s", policy.ID)
+}
+
+// CreateACLRole mocks creating an ACL role, assigning it a new ID
+func (m *MockConsulClient) CreateACLRole(role *consulapi.ACLRole) (*consulapi.ACLRole, error) {
+	if m.ACLSystemWriteError != nil {
+		return nil, m.ACLSystemWriteError
+	}
+	role.ID = fmt.Sprintf("mock-role-%d", len(m.ACLRoleData))
+	m.ACLRoleData = append(m.ACLRoleData, role)
+	return role, nil
+}
+
+// UpdateACLRole mocks updating an ACL role, replacing the one with the same ID
+func (m *MockConsulClient) UpdateACLRole(role *consulapi.ACLRole) (*consulapi.ACLRole, error) {
+	if m.ACLSystemWriteError != nil {
+		return nil, m.ACLSystemWriteError
+	}
+	for i, existing := range m.ACLRoleData {
+		if existing.ID == role.ID {
+			m.ACLRoleData[i] = role
+			return role, nil
+		}
+	}
+	return nil, fmt.Errorf("acl role not found: %s", role.ID)
+}
+
+// CreateACLAuthMethod mocks creating an ACL auth method
+func (m *MockConsulClient) CreateACLAuthMethod(method *consulapi.ACLAuthMethod) error {
+	if m.ACLSystemWriteError != nil {
+		return m.ACLSystemWriteError
+	}
+	m.ACLAuthMethodData = append(m.ACLAuthMethodData, method)
+	return nil
+}
+
+// UpdateACLAuthMethod mocks updating an ACL auth method, replacing the one with the same name
+func (m *MockConsulClient) UpdateACLAuthMethod(method *consulapi.ACLAuthMethod) error {
+	if m.ACLSystemWriteError != nil {
+		return m.ACLSystemWriteError
+	}
+	for i, existing := range m.ACLAuthMethodData {
+		if existing.Name == method.Name {
+			m.ACLAuthMethodData[i] = method
+			return nil
+		}
+	}
+	return fmt.Errorf("acl auth method not found: %s", method.Name)
+}
+
+// CreateACLBindingRule mocks creating an ACL binding rule, assigning it a new ID
+func (m *MockConsulClient) CreateACLBindingRule(rule *consulapi.ACLBindingRule) error {
+	if m.ACLSystemWriteError != nil {
+		return m.ACLSystemWriteError
+	}
+	rule.ID = fmt.Sprintf("mock-binding-rule-%d", len(m.ACLBindingRuleData))
+	m.ACLBindingRuleData = append(m.ACLBindingRuleData, rule)
+	return nil
+}
+
+// UpdateACLBindingRule mocks updating an ACL binding rule, replacing the one with the same ID
+func (m *MockConsulClient) UpdateACLBindingRule(rule *consulapi.ACLBindingRule) error {
+	if m.ACLSystemWriteError != nil {
+		return m.ACLSystemWriteError
+	}
+	for i, existing := range m.ACLBindingRuleData {
+		if existing.ID == rule.ID {
+			m.ACLBindingRuleData[i] = rule
+			return nil
+		}
+	}
+	return fmt.Errorf("acl binding rule not found: %s", rule.ID)
+}
+
+// ListConfigEntries returns mock config entries of one kind
+func (m *MockConsulClient) ListConfigEntries(kind string) ([]consulapi.ConfigEntry, error) {
+	if m.ConfigEntryError != nil {
+		return nil, m.ConfigEntryError
+	}
+	return m.ConfigEntryData[kind], nil
+}
+
+// SetConfigEntry mocks writing a config entry, replacing one with the same kind and name
+func (m *MockConsulClient) SetConfigEntry(entry consulapi.ConfigEntry) error {
+	if m.SetConfigEntryError != nil {
+		return m.SetConfigEntryError
+	}
+	if m.ConfigEntryData == nil {
+		m.ConfigEntryData = make(map[string][]consulapi.ConfigEntry)
+	}
+	kind := entry.GetKind()
+	for i, existing := range m.ConfigEntryData[kind] {
+		if existing.GetName() == entry.GetName() {
+			m.ConfigEntryData[kind][i] = entry
+			return nil
+		}
+	}
+	m.ConfigEntryData[kind] = append(m.ConfigEntryData[kind], entry)
+	return nil
+}
+
+// ListIntentions returns mock service intentions
+func (m *MockConsulClient) ListIntentions() ([]*consulapi.ServiceIntentionsConfigEntry, error) {
+	if m.IntentionError != nil {
+		return nil, m.IntentionError
+	}
+	return m.IntentionData, nil
+}
+
+// SetIntentions mocks writing the intentions for a destination, replacing any with the same name
+func (m *MockConsulClient) SetIntentions(entry *consulapi.ServiceIntentionsConfigEntry) error {
+	if m.SetIntentionsError != nil {
+		return m.SetIntentionsError
+	}
+	for i, existing := range m.IntentionData {
+		if existing.Name == entry.Name && existing.Namespace == entry.Namespace {
+			m.IntentionData[i] = entry
+			return nil
+		}
+	}
+	m.IntentionData = append(m.IntentionData, entry)
+	return nil
+}
+
+// Datacenter returns the mock datacenter name
+func (m *MockConsulClient) Datacenter() (string, error) {
+	if m.DatacenterError != nil {
+		return "", m.DatacenterError
+	}
+	return m.DatacenterName, nil
+}
+
+// SaveSnapshot returns the mock snapshot data
+func (m *MockConsulClient) SaveSnapshot() (io.ReadCloser, error) {
+	if m.SnapshotError != nil {
+		return nil, m.SnapshotError
+	}
+	return ioutil.NopCloser(bytes.NewReader(m.SnapshotData)), nil
+}
+
+// RestoreSnapshot mocks a native snapshot restore, keeping what was restored
+func (m *MockConsulClient) RestoreSnapshot(snapshot io.Reader) error {
+	if m.RestoreSnapshotError != nil {
+		return m.RestoreSnapshotError
+	}
+	data, err := ioutil.ReadAll(snapshot)
+	if err != nil {
+		return err
+	}
+	m.RestoredSnapshot = data
+	return nil
+}
+
+// KVIndex returns the mock watch index
+func (m *MockConsulClient) KVIndex(waitIndex uint64, wait time.Duration) (uint64, error) {
+	return m.WatchIndex, m.WatchError
+}
+
+// PQIndex returns the mock watch index
+func (m *MockConsulClient) PQIndex(waitIndex uint64, wait time.Duration) (uint64, error) {
+	return m.WatchIndex, m.WatchError
+}
+
+// ACLIndex returns the mock watch index
+func (m *MockConsulClient) ACLIndex(waitIndex uint64, wait time.Duration) (uint64, error) {
+	return m.WatchIndex, m.WatchError
+}
+
+// NewLock returns the mock lock, creating one on first use
+func (m *MockConsulClient) NewLock(key, value string) (interfaces.Locker, error) {
+	if m.LockError != nil {
+		return nil, m.LockError
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Lock == nil {
+		m.Lock = NewMockLocker()
+	}
+	return m.Lock, nil
+}
+
+// MockLocker implements Locker for testing.  Lock takes the lock straight
+// away unless LockError is set, sending on Lost makes it lose the lock.
+// Like consul's lock it counts as held until it is unlocked, even once it
+// was lost.
+type MockLocker struct {
+	Lost      chan struct{}
+	LockError error
+	Locks     int
+	Unlocks   int
+
+	held bool
+	mu   sync.Mutex
+}
+
+// NewMockLocker creates a new mock lock
+func NewMockLocker() *MockLocker {
+	return &MockLocker{Lost: make(chan struct{})}
+}
+
+// Lock takes the mock lock and returns a channel closed when Lost fires
+func (l *MockLocker) Lock(stopCh <-chan struct{}) (<-chan struct{}, error) {
+	l.mu.Lock()
+	l.Locks++
+	err := l.LockError
+	if err == nil && l.held {
+		err = consulapi.ErrLockHeld
+	}
+	if err == nil {
+		l.held = true
+	}
+	l.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	lost := make(chan struct{})
+	go func() {
+		select {
+		case <-l.Lost:
+			close(lost)
+		case <-stopCh:
+		}
+	}()
+	return lost, nil
+}
+
+// Unlock releases the mock lock
+func (l *MockLocker) Unlock() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.held {
+		return consulapi.ErrLockNotHeld
+	}
+	l.held = false
+	l.Unlocks++
+	return nil
+}
+
+// LockCount returns how often the mock lock was taken
+func (l *MockLocker) LockCount() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.Locks
+}
+
 // MockStorageClient implements StorageClient for testing
 type MockStorageClient struct {
 	Data        map[string][]byte
@@ -87,6 +600,11 @@ type MockStorageClient struct {
 	DownloadError error
 	UploadCalls []UploadCall
 	DownloadCalls []DownloadCall
+	ListError     error
+	Modified      map[string]time.Time
+	PeekErrors    map[string]error
+	ListCalls     []string
+	PeekCalls     []string
 }
 
 type UploadCall struct {
@@ -130,6 +648,68 @@ func (m *MockStorageClient) Download(bucket, key string) ([]byte, error) {
 	return data, nil
 }
 
+// List mocks listing objects under a prefix, sorted by key
+func (m *MockStorageClient) List(bucket, prefix string) ([]interfaces.StorageObject, error) {
+	m.ListCalls = append(m.ListCalls, prefix)
+	if m.ListError != nil {
+		return nil, m.ListError
+	}
+	var objects []interfaces.StorageObject
+	for path, data := range m.Data {
+		if !strings.HasPrefix(path, bucket+"/"+prefix) {
+			continue
+		}
+		key := strings.TrimPrefix(path, bucket+"/")
+		objects = append(objects, interfaces.StorageObject{
+			Key:          key,
+			Size:         int64(len(data)),
+			LastModified: m.Modified[path],
+		})
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+// ListPrefixes mocks listing the directories one level below a prefix,
+// sorted
+func (m *MockStorageClient) ListPrefixes(bucket, prefix string) ([]string, error) {
+	if m.ListError != nil {
+		return nil, m.ListError
+	}
+	seen := make(map[string]bool)
+	var prefixes []string
+	for path := range m.Data {
+		if !strings.HasPrefix(path, bucket+"/"+prefix) {
+			continue
+		}
+		rest := strings.TrimPrefix(path, bucket+"/"+prefix)
+		i := strings.Index(rest, "/")
+		if i < 0 || seen[rest[:i]] {
+			continue
+		}
+		seen[rest[:i]] = true
+		prefixes = append(prefixes, prefix+rest[:i+1])
+	}
+	sort.Strings(prefixes)
+	return prefixes, nil
+}
+
+// Peek mocks downloading the first length bytes of an object
+func (m *MockStorageClient) Peek(bucket, key string, length int64) ([]byte, error) {
+	m.PeekCalls = append(m.PeekCalls, key)
+	if err, ok := m.PeekErrors[bucket+"/"+key]; ok {
+		return nil, err
+	}
+	data, err := m.Download(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > length {
+		data = data[:length]
+	}
+	return data, nil
+}
+
 // MockFileSystem implements FileSystem for testing
 type MockFileSystem struct {
 	Files         map[string][]byte
@@ -0,0 +1,421 @@
+package restore
+
+import (
+	"log"
+	"reflect"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/pshima/consul-snapshot/consul"
+)
+
+// aclRestoreCounts tracks the outcome of restoring one kind of ACL object
+type aclRestoreCounts struct {
+	created   int
+	updated   int
+	unchanged int
+	skipped   int
+	errors    int
+}
+
+func (a *aclRestoreCounts) report(kind string) {
+	log.Printf("[INFO] Restored %v ACL %s (%v created, %v updated, %v unchanged, %v skipped) with %v errors",
+		a.created+a.updated, kind, a.created, a.updated, a.unchanged, a.skipped, a.errors)
+}
+
+// aclIDMap maps the IDs of policies and roles in the backup to the IDs they
+// have in the cluster being restored, which consul assigns on create
+type aclIDMap map[string]string
+
+// restoreACLSystem restores the token based ACL system in dependency order:
+// policies, then roles, then tokens, then auth methods and their binding rules.
+func restoreACLSystem(r *Restore, c *consul.Consul) {
+	if r.ACLSystem == nil {
+		return
+	}
+
+	policyIDs := restoreACLPolicies(r.ACLSystem.Policies, c)
+	roleIDs := restoreACLRoles(r.ACLSystem.Roles, policyIDs, c)
+	restoreACLTokens(r.ACLSystem.Tokens, policyIDs, roleIDs, c)
+	restoreACLAuthMethods(r.ACLSystem.AuthMethods, c)
+	restoreACLBindingRules(r.ACLSystem.BindingRules, c)
+}
+
+// restoreACLPolicies restores policies matching live policies by ID and then
+// by name, and returns the mapping of backup IDs to live IDs
+func restoreACLPolicies(policies []*consulapi.ACLPolicy, c *consul.Consul) aclIDMap {
+	ids := aclIDMap{}
+	if len(policies) == 0 {
+		return ids
+	}
+
+	counts := &aclRestoreCounts{}
+	live, err := c.Client.ListACLPolicies()
+	if err != nil {
+		log.Printf("[ERR] Unable to list existing ACL policies, skipping policy restore: %v", err)
+		return ids
+	}
+
+	byID := make(map[string]*consulapi.ACLPolicy)
+	byName := make(map[string]*consulapi.ACLPolicy)
+	for _, policy := range live {
+		byID[policy.ID] = policy
+		byName[policy.Name] = policy
+	}
+
+	for _, data := range policies {
+		policy := &consulapi.ACLPolicy{
+			Name:        data.Name,
+			Description: data.Description,
+			Rules:       data.Rules,
+			Datacenters: data.Datacenters,
+			Namespace:   data.Namespace,
+			Partition:   data.Partition,
+		}
+
+		match, ok := byID[data.ID]
+		if !ok {
+			match, ok = byName[data.Name]
+		}
+
+		if ok {
+			ids[data.ID] = match.ID
+			if match.Name == policy.Name && match.Description == policy.Description &&
+				match.Rules == policy.Rules && reflect.DeepEqual(match.Datacenters, policy.Datacenters) {
+				counts.unchanged++
+				continue
+			}
+
+			policy.ID = match.ID
+			if _, err := c.Client.UpdateACLPolicy(policy); err != nil {
+				counts.errors++
+				log.Printf("Unable to restore ACL policy: %s, %v", data.Name, err)
+				continue
+			}
+			counts.updated++
+			continue
+		}
+
+		created, err := c.Client.CreateACLPolicy(policy)
+		if err != nil {
+			counts.errors++
+			log.Printf("Unable to restore ACL policy: %s, %v", data.Name, err)
+			continue
+		}
+		ids[data.ID] = created.ID
+		counts.created++
+	}
+
+	counts.report("policies")
+	return ids
+}
+
+// restoreACLRoles restores roles matching live roles by ID and then by name,
+// and returns the mapping of backup IDs to live IDs
+func restoreACLRoles(roles []*consulapi.ACLRole, policyIDs aclIDMap, c *consul.Consul) aclIDMap {
+	ids := aclIDMap{}
+	if len(roles) == 0 {
+		return ids
+	}
+
+	counts := &aclRestoreCounts{}
+	live, err := c.Client.ListACLRoles()
+	if err != nil {
+		log.Printf("[ERR] Unable to list existing ACL roles, skipping role restore: %v", err)
+		return ids
+	}
+
+	byID := make(map[string]*consulapi.ACLRole)
+	byName := make(map[string]*consulapi.ACLRole)
+	for _, role := range live {
+		byID[role.ID] = role
+		byName[role.Name] = role
+	}
+
+	for _, data := range roles {
+		role := &consulapi.ACLRole{
+			Name:              data.Name,
+			Description:       data.Description,
+			Policies:          remapACLLinks(data.Policies, policyIDs),
+			ServiceIdentities: data.ServiceIdentities,
+			NodeIdentities:    data.NodeIdentities,
+			TemplatedPolicies: data.TemplatedPolicies,
+			Namespace:         data.Namespace,
+			Partition:         data.Partition,
+		}
+
+		match, ok := byID[data.ID]
+		if !ok {
+			match, ok = byName[data.Name]
+		}
+
+		if ok {
+			ids[data.ID] = match.ID
+			if match.Name == role.Name && match.Description == role.Description &&
+				sameACLLinks(match.Policies, role.Policies) &&
+				reflect.DeepEqual(match.ServiceIdentities, role.ServiceIdentities) &&
+				reflect.DeepEqual(match.NodeIdentities, role.NodeIdentities) {
+				counts.unchanged++
+				continue
+			}
+
+			role.ID = match.ID
+			if _, err := c.Client.UpdateACLRole(role); err != nil {
+				counts.errors++
+				log.Printf("Unable to restore ACL role: %s, %v", data.Name, err)
+				continue
+			}
+			counts.updated++
+			continue
+		}
+
+		created, err := c.Client.CreateACLRole(role)
+		if err != nil {
+			counts.errors++
+			log.Printf("Unable to restore ACL role: %s, %v", data.Name, err)
+			continue
+		}
+		ids[data.ID] = created.ID
+		counts.created++
+	}
+
+	counts.report("roles")
+	return ids
+}
+
+// restoreACLTokens restores tokens with their original accessor and secret
+// IDs.  Tokens issued by an auth method login and tokens that have already
+// expired can not be recreated and are skipped.
+func restoreACLTokens(tokens []*consulapi.ACLToken, policyIDs, roleIDs aclIDMap, c *consul.Consul) {
+	if len(tokens) == 0 {
+		return
+	}
+
+	counts := &aclRestoreCounts{}
+	live, err := c.Client.ListACLTokens()
+	if err != nil {
+		log.Printf("[ERR] Unable to list existing ACL tokens, skipping token restore: %v", err)
+		return
+	}
+
+	byID := make(map[string]*consulapi.ACLToken)
+	for _, token := range live {
+		byID[token.AccessorID] = token
+	}
+
+	now := time.Now()
+	for _, data := range tokens {
+		if data.AuthMethod != "" {
+			counts.skipped++
+			log.Printf("[DEBUG] Skipping ACL token %s issued by auth method %s", data.AccessorID, data.AuthMethod)
+			continue
+		}
+		if data.ExpirationTime != nil && data.ExpirationTime.Before(now) {
+			counts.skipped++
+			log.Printf("[DEBUG] Skipping expired ACL token %s", data.AccessorID)
+			continue
+		}
+
+		token := &consulapi.ACLToken{
+			AccessorID:        data.AccessorID,
+			SecretID:          data.SecretID,
+			Description:       data.Description,
+			Policies:          remapACLLinks(data.Policies, policyIDs),
+			Roles:             remapACLLinks(data.Roles, roleIDs),
+			ServiceIdentities: data.ServiceIdentities,
+			NodeIdentities:    data.NodeIdentities,
+			TemplatedPolicies: data.TemplatedPolicies,
+			Local:             data.Local,
+			ExpirationTime:    data.ExpirationTime,
+			Namespace:         data.Namespace,
+			Partition:         data.Partition,
+		}
+
+		match, ok := byID[data.AccessorID]
+		if ok {
+			if match.SecretID == token.SecretID && match.Description == token.Description &&
+				match.Local == token.Local &&
+				sameACLLinks(match.Policies, token.Policies) && sameACLLinks(match.Roles, token.Roles) &&
+				reflect.DeepEqual(match.ServiceIdentities, token.ServiceIdentities) &&
+				reflect.DeepEqual(match.NodeIdentities, token.NodeIdentities) {
+				counts.unchanged++
+				continue
+			}
+
+			if err := c.Client.UpdateACLToken(token); err != nil {
+				counts.errors++
+				log.Printf("Unable to restore ACL token: %s, %v", data.AccessorID, err)
+				continue
+			}
+			counts.updated++
+			continue
+		}
+
+		if err := c.Client.CreateACLToken(token); err != nil {
+			counts.errors++
+			log.Printf("Unable to restore ACL token: %s, %v", data.AccessorID, err)
+			continue
+		}
+		counts.created++
+	}
+
+	counts.report("tokens")
+}
+
+// restoreACLAuthMethods restores auth methods matching live ones by name
+func restoreACLAuthMethods(methods []*consulapi.ACLAuthMethod, c *consul.Consul) {
+	if len(methods) == 0 {
+		return
+	}
+
+	counts := &aclRestoreCounts{}
+	live, err := c.Client.ListACLAuthMethods()
+	if err != nil {
+		log.Printf("[ERR] Unable to list existing ACL auth methods, skipping auth method restore: %v", err)
+		return
+	}
+
+	byName := make(map[string]*consulapi.ACLAuthMethod)
+	for _, method := range live {
+		byName[method.Name] = method
+	}
+
+	for _, data := range methods {
+		method := *data
+		method.CreateIndex = 0
+		method.ModifyIndex = 0
+
+		match, ok := byName[data.Name]
+		if ok {
+			if match.Type == method.Type && match.DisplayName == method.DisplayName &&
+				match.Description == method.Description && match.MaxTokenTTL == method.MaxTokenTTL &&
+				match.TokenLocality == method.TokenLocality && reflect.DeepEqual(match.Config, method.Config) {
+				counts.unchanged++
+				continue
+			}
+
+			if err := c.Client.UpdateACLAuthMethod(&method); err != nil {
+				counts.errors++
+				log.Printf("Unable to restore ACL auth method: %s, %v", data.Name, err)
+				continue
+			}
+			counts.updated++
+			continue
+		}
+
+		if err := c.Client.CreateACLAuthMethod(&method); err != nil {
+			counts.errors++
+			log.Printf("Unable to restore ACL auth method: %s, %v", data.Name, err)
+			continue
+		}
+		counts.created++
+	}
+
+	counts.report("auth methods")
+}
+
+// restoreACLBindingRules restores binding rules matching live ones by ID and
+// then by what they bind, since consul assigns rule IDs on create
+func restoreACLBindingRules(rules []*consulapi.ACLBindingRule, c *consul.Consul) {
+	if len(rules) == 0 {
+		return
+	}
+
+	counts := &aclRestoreCounts{}
+	live, err := c.Client.ListACLBindingRules()
+	if err != nil {
+		log.Printf("[ERR] Unable to list existing ACL binding rules, skipping binding rule restore: %v", err)
+		return
+	}
+
+	byID := make(map[string]*consulapi.ACLBindingRule)
+	byBinding := make(map[string]*consulapi.ACLBindingRule)
+	for _, rule := range live {
+		byID[rule.ID] = rule
+		byBinding[bindingRuleKey(rule)] = rule
+	}
+
+	for _, data := range rules {
+		rule := *data
+		rule.CreateIndex = 0
+		rule.ModifyIndex = 0
+
+		match, ok := byID[data.ID]
+		if !ok {
+			match, ok = byBinding[bindingRuleKey(data)]
+		}
+
+		if ok {
+			if bindingRuleKey(match) == bindingRuleKey(&rule) && match.Description == rule.Description {
+				counts.unchanged++
+				continue
+			}
+
+			rule.ID = match.ID
+			if err := c.Client.UpdateACLBindingRule(&rule); err != nil {
+				counts.errors++
+				log.Printf("Unable to restore ACL binding rule: %s, %v", data.ID, err)
+				continue
+			}
+			counts.updated++
+			continue
+		}
+
+		rule.ID = ""
+		if err := c.Client.CreateACLBindingRule(&rule); err != nil {
+			counts.errors++
+			log.Printf("Unable to restore ACL binding rule: %s, %v", data.ID, err)
+			continue
+		}
+		counts.created++
+	}
+
+	counts.report("binding rules")
+}
+
+// remapACLLinks points policy and role links at their IDs in the live
+// cluster.  Links to objects that were not restored keep only their name so
+// consul resolves them by name instead of failing on an unknown ID.
+func remapACLLinks(links []*consulapi.ACLLink, ids aclIDMap) []*consulapi.ACLLink {
+	if links == nil {
+		return nil
+	}
+
+	remapped := make([]*consulapi.ACLLink, 0, len(links))
+	for _, link := range links {
+		newLink := &consulapi.ACLLink{Name: link.Name}
+		if id, ok := ids[link.ID]; ok {
+			newLink.ID = id
+		} else if link.Name == "" {
+			newLink.ID = link.ID
+		}
+		remapped = append(remapped, newLink)
+	}
+	return remapped
+}
+
+// sameACLLinks compares two sets of links by name since IDs differ between clusters
+func sameACLLinks(a, b []*consulapi.ACLLink) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	names := make(map[string]int)
+	for _, link := range a {
+		names[link.Name]++
+	}
+	for _, link := range b {
+		names[link.Name]--
+	}
+	for _, count := range names {
+		if count != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// bindingRuleKey identifies a binding rule by what it binds
+func bindingRuleKey(rule *consulapi.ACLBindingRule) string {
+	return rule.AuthMethod + "\x00" + rule.Selector + "\x00" + string(rule.BindType) + "\x00" + rule.BindName
+}
@@ -0,0 +1,108 @@
+package restore
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"sort"
+
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/pshima/consul-snapshot/backup"
+)
+
+// loadTombstones loads the keys an incremental backup records as deleted
+// since its parent
+func (r *Restore) loadTombstones() error {
+	if r.Meta.TombstonesSha256 == "" {
+		r.Tombstones = nil
+		return nil
+	}
+
+	startstring := fmt.Sprintf("%v", r.Meta.StartTime)
+	tombstonesFileName := fmt.Sprintf("consul.tombstones.%s.json", startstring)
+	tombstonesPath := filepath.Join(r.ExtractedPath, tombstonesFileName)
+	tombstonesData, err := ioutil.ReadFile(tombstonesPath)
+	if err != nil {
+		return fmt.Errorf("Unable to read tombstones file at %s: %v", tombstonesPath, err)
+	}
+	if err := json.Unmarshal(tombstonesData, &r.Tombstones); err != nil {
+		return fmt.Errorf("Unable to unmarshal tombstones: %v", err)
+	}
+	log.Printf("[INFO] Loaded %v tombstones of deleted keys", len(r.Tombstones))
+	return nil
+}
+
+// loadIncrementalChain rebuilds the keys as they were when an incremental
+// backup was taken.  It follows ParentBackup back to the full backup, then
+// replays every backup from the full one forward, deleting the tombstoned
+// keys and writing the changed ones.
+func (r *Restore) loadIncrementalChain() error {
+	if r.Config.Acceptance {
+		return fmt.Errorf("Incremental backups can not be restored from a local acceptance test backup")
+	}
+	if err := r.loadTombstones(); err != nil {
+		return err
+	}
+
+	chain := []*Restore{r}
+	seen := map[string]bool{r.RestorePath: true}
+	for current := r; current.Meta.BackupType == backup.BackupTypeIncremental; {
+		parentPath := current.Meta.ParentBackup
+		if parentPath == "" {
+			return fmt.Errorf("Incremental backup %s does not record its parent backup", current.RestorePath)
+		}
+		if seen[parentPath] {
+			return fmt.Errorf("Backup chain of %s loops back to %s", r.RestorePath, parentPath)
+		}
+		seen[parentPath] = true
+
+		log.Printf("[INFO] Fetching parent backup %s", parentPath)
+		parent := &Restore{Config: r.Config, RestorePath: parentPath}
+		parent.fetchBackup()
+		if parent.Meta == nil || parent.Version == "0.0.1" {
+			return fmt.Errorf("Parent backup %s has no metadata, it can not be part of an incremental chain", parentPath)
+		}
+		if parent.Meta.KVSha256 == "" {
+			return fmt.Errorf("Parent backup %s does not contain JSON keys", parentPath)
+		}
+		log.Print("[INFO] Parsing KV Data")
+		parent.loadKVData()
+		if parent.Meta.BackupType == backup.BackupTypeIncremental {
+			if err := parent.loadTombstones(); err != nil {
+				return err
+			}
+		}
+		chain = append(chain, parent)
+		current = parent
+	}
+
+	r.JSONData = replayChain(chain)
+	r.ChainLength = len(chain)
+
+	log.Printf("[INFO] Rebuilt %v keys from full backup %s and %v incremental backups",
+		len(r.JSONData), chain[len(chain)-1].RestorePath, len(chain)-1)
+	return nil
+}
+
+// replayChain merges the keys of a chain of backups, newest first, in to
+// the keys at the time of the newest one
+func replayChain(chain []*Restore) consulapi.KVPairs {
+	keys := make(map[string]*consulapi.KVPair)
+	for i := len(chain) - 1; i >= 0; i-- {
+		for _, key := range chain[i].Tombstones {
+			delete(keys, key)
+		}
+		for _, kv := range chain[i].JSONData {
+			keys[kv.Key] = kv
+		}
+	}
+
+	merged := make(consulapi.KVPairs, 0, len(keys))
+	for _, kv := range keys {
+		merged = append(merged, kv)
+	}
+	sort.Slice(merged, func(i, j int) bool { return merged[i].Key < merged[j].Key })
+	return merged
+}
@@ -0,0 +1,156 @@
+package restore
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/pshima/consul-snapshot/consul"
+	"github.com/pshima/consul-snapshot/list"
+)
+
+// errAborted is returned when the operator does not confirm a restore
+var errAborted = errors.New("Restore aborted, nothing was written")
+
+// confirmRestore shows the operator what is about to be restored and where,
+// refuses to restore a backup from another datacenter unless that was
+// explicitly allowed, and asks for confirmation unless the restore is forced.
+func confirmRestore(r *Restore, c *consul.Consul, opts Options, native bool) error {
+	datacenter, err := c.Client.Datacenter()
+	if err != nil {
+		log.Printf("[WARN] Unable to determine the datacenter of the target cluster: %v", err)
+	}
+
+	backupDatacenter := ""
+	if r.Meta != nil {
+		backupDatacenter = r.Meta.Datacenter
+	}
+	if backupDatacenter == "" {
+		log.Print("[WARN] Backup does not record its datacenter, unable to check it matches the target cluster")
+	} else if datacenter == "" && !opts.AllowDatacenterMismatch {
+		return fmt.Errorf("Backup was taken in datacenter %q but the datacenter of the target cluster could not be determined, use -allow-datacenter-mismatch to restore it anyway",
+			backupDatacenter)
+	} else if datacenter == "" && r.OnConflict == ConflictSkipIfNewer {
+		return fmt.Errorf("-on-conflict=%s compares key indexes, which only works for backups of the same cluster, the datacenter of the target cluster could not be determined",
+			ConflictSkipIfNewer)
+	} else if backupDatacenter != datacenter && !opts.AllowDatacenterMismatch {
+		return fmt.Errorf("Backup was taken in datacenter %q but the target cluster is in %q, use -allow-datacenter-mismatch to restore it anyway",
+			backupDatacenter, datacenter)
+	} else if backupDatacenter != datacenter && r.OnConflict == ConflictSkipIfNewer {
+		return fmt.Errorf("-on-conflict=%s compares key indexes, which only works for backups of the same cluster, the backup was taken in datacenter %q",
+			ConflictSkipIfNewer, backupDatacenter)
+	}
+
+	summary, err := restoreSummary(r, c, datacenter, native)
+	if err != nil {
+		return err
+	}
+
+	if opts.Force || r.Config.Acceptance {
+		log.Print("[INFO] Restore confirmation skipped")
+		log.Print(summary)
+		return nil
+	}
+
+	if opts.UI == nil {
+		return fmt.Errorf("Unable to ask for confirmation, use -force to restore without it")
+	}
+	opts.UI.Output(summary)
+	answer, err := opts.UI.Ask("Do you want to continue with the restore? Only 'yes' will be accepted:")
+	if err != nil {
+		return fmt.Errorf("Unable to read confirmation: %v", err)
+	}
+	if strings.TrimSpace(answer) != "yes" {
+		return errAborted
+	}
+	return nil
+}
+
+// conflictOutcome describes what a conflict policy does with conflicting keys
+func conflictOutcome(policy string) string {
+	switch policy {
+	case ConflictSkipExisting, ConflictSkipIfNewer:
+		return fmt.Sprintf("skipped where the %s policy applies", policy)
+	default:
+		return "overwritten"
+	}
+}
+
+// restoreSummary describes the target cluster, the backup and, for JSON
+// restores, how much of the cluster the restore will change
+func restoreSummary(r *Restore, c *consul.Consul, datacenter string, native bool) (string, error) {
+	if datacenter == "" {
+		datacenter = "unknown"
+	}
+
+	host := ""
+	age := "unknown"
+	if r.Meta != nil {
+		host = r.Meta.NodeName
+		taken := time.Unix(r.Meta.StartTime, 0)
+		age = fmt.Sprintf("%v (taken %s)", time.Since(taken).Round(time.Second), taken.Format(time.RFC3339))
+	}
+	if host == "" {
+		if backupHost, _, ok := list.ParseBackupName(r.RestorePath); ok {
+			host = backupHost
+		} else {
+			host = "unknown"
+		}
+	}
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "About to restore %s\n", r.RestorePath)
+	fmt.Fprintf(&out, "  Target consul:    %s (datacenter %s)\n", consulapi.DefaultConfig().Address, datacenter)
+	fmt.Fprintf(&out, "  Backup host:      %s\n", host)
+	fmt.Fprintf(&out, "  Backup age:       %s\n", age)
+	if r.Meta != nil && r.Meta.KVFilter != nil {
+		fmt.Fprintf(&out, "  Backup scope:     partial, keys matching %s\n", r.Meta.KVFilter)
+	}
+	if r.ChainLength > 1 {
+		fmt.Fprintf(&out, "  Backup chain:     incremental, rebuilt from full backup %s and %v incremental backups\n",
+			r.Meta.FullBackup, r.ChainLength-1)
+	}
+
+	if native {
+		fmt.Fprint(&out, "  Native snapshot:  ALL cluster state will be replaced")
+		return out.String(), nil
+	}
+
+	changes, err := dryRun(r, c)
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprintf(&out, "  Keys:             %v in backup, %v will be overwritten, %v created, %v unchanged",
+		len(r.JSONData), changes.KeyCounts.Update, changes.KeyCounts.Create, changes.KeyCounts.Unchanged)
+	if r.FilteredKeys > 0 {
+		fmt.Fprintf(&out, ", %v filtered out by prefix", r.FilteredKeys)
+	}
+	fmt.Fprint(&out, "\n")
+	if r.ResumedKeys > 0 {
+		fmt.Fprintf(&out, "  Resuming:         %v keys were already restored, %v are left\n", r.ResumedKeys, len(r.KVWrites))
+	}
+	if len(r.Rewrites) > 0 {
+		renamed, dropped := r.rewriteCounts()
+		fmt.Fprintf(&out, "  Rewrites:         %v keys renamed, %v dropped\n", renamed, dropped)
+	}
+	if r.WarnLocks {
+		if locked := len(r.lockedKeys()); locked > 0 {
+			fmt.Fprintf(&out, "  Locked keys:      %v were held by a session at backup time, locks are not restored\n", locked)
+		}
+	}
+	if len(r.Conflicts) > 0 {
+		fmt.Fprintf(&out, "  Conflicts:        %v keys differ from the backup and will be %s\n",
+			len(r.Conflicts), conflictOutcome(r.OnConflict))
+	}
+	if r.Mirror {
+		fmt.Fprintf(&out, "  Mirror mode:      %v keys not in the backup will be DELETED\n", changes.KeyCounts.Delete)
+	}
+	fmt.Fprintf(&out, "  Prepared queries: %v in backup, %v will be overwritten, %v created\n",
+		len(changes.PQs), changes.PQCounts.Update, changes.PQCounts.Create)
+	fmt.Fprintf(&out, "  ACLs:             %v in backup, %v will be overwritten, %v created",
+		len(changes.ACLs), changes.ACLCounts.Update, changes.ACLCounts.Create)
+	return out.String(), nil
+}
@@ -0,0 +1,160 @@
+package restore
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/pshima/consul-snapshot/consul"
+)
+
+// Conflict policies decide what happens to keys that differ in the cluster
+const (
+	// ConflictOverwrite writes the backup over conflicting keys
+	ConflictOverwrite = "overwrite"
+	// ConflictSkipExisting only creates keys that do not exist in the cluster
+	ConflictSkipExisting = "skip-existing"
+	// ConflictSkipIfNewer leaves keys that changed since the backup alone.
+	// ModifyIndexes only compare within one cluster, so it is refused for
+	// backups of another datacenter.
+	ConflictSkipIfNewer = "skip-if-newer"
+	// ConflictFail refuses to restore when any key conflicts
+	ConflictFail = "fail"
+)
+
+// Reasons a key conflicts with the cluster
+const (
+	ReasonDifferent = "exists in the cluster with a different value or flags"
+	ReasonNewer     = "changed in the cluster since the backup"
+	ReasonChanged   = "changed in the cluster during the restore"
+)
+
+// What the restore did with a conflicting key
+const (
+	ConflictOverwritten = "overwritten"
+	ConflictSkipped     = "skipped"
+	ConflictNotWritten  = "not written"
+)
+
+// Conflict is a key in the backup whose live value differs from it
+type Conflict struct {
+	Key         string
+	Reason      string
+	Action      string `json:",omitempty"`
+	BackupIndex uint64
+	LiveIndex   uint64
+}
+
+// keyConflict compares a key in the backup with the live key and returns
+// why they conflict, or "" when the key is missing or has the same value and
+// flags.  A live ModifyIndex above the one in the backup means the key was
+// written after the backup was taken.
+func keyConflict(kv, live *consulapi.KVPair) string {
+	if live == nil || (bytes.Equal(kv.Value, live.Value) && kv.Flags == live.Flags) {
+		return ""
+	}
+	if live.ModifyIndex > kv.ModifyIndex {
+		return ReasonNewer
+	}
+	return ReasonDifferent
+}
+
+// planKV compares the keys in the backup with the cluster and decides which
+// ones to write under the conflict policy.  The keys to write are stored in
+// KVWrites with the ModifyIndex of the live key, so writing them with
+// check-and-set fails if anyone changes a key after it was compared.
+func planKV(r *Restore, c *consul.Consul) error {
+	liveKeys, err := c.Client.ListKeys("")
+	if err != nil {
+		return fmt.Errorf("Unable to list existing keys: %v", err)
+	}
+	live := make(map[string]*consulapi.KVPair)
+	for _, kv := range liveKeys {
+		live[kv.Key] = kv
+	}
+
+	r.KVWrites = consulapi.KVPairs{}
+	r.Conflicts = nil
+	r.SkippedKeys = 0
+	for _, kv := range r.JSONData {
+		existing := live[kv.Key]
+		reason := keyConflict(kv, existing)
+
+		skip := false
+		switch r.OnConflict {
+		case ConflictSkipExisting:
+			skip = existing != nil
+		case ConflictSkipIfNewer:
+			skip = reason == ReasonNewer
+		}
+
+		if reason != "" {
+			conflict := Conflict{Key: kv.Key, Reason: reason, Action: ConflictOverwritten,
+				BackupIndex: kv.ModifyIndex, LiveIndex: existing.ModifyIndex}
+			if skip {
+				conflict.Action = ConflictSkipped
+			}
+			r.Conflicts = append(r.Conflicts, conflict)
+		}
+		if skip {
+			r.SkippedKeys++
+			continue
+		}
+
+		write := *kv
+		write.ModifyIndex = 0
+		if existing != nil {
+			write.ModifyIndex = existing.ModifyIndex
+		}
+		r.KVWrites = append(r.KVWrites, &write)
+	}
+
+	return nil
+}
+
+// checkConflicts refuses the restore under the fail policy when any key
+// conflicts with the cluster
+func checkConflicts(r *Restore) error {
+	if r.OnConflict != ConflictFail || len(r.Conflicts) == 0 {
+		return nil
+	}
+	for _, conflict := range r.Conflicts {
+		log.Printf("[ERR] Conflict on key %s: %s", conflict.Key, conflict.Reason)
+	}
+	return fmt.Errorf("%v keys conflict with the cluster and the conflict policy is fail, nothing was written", len(r.Conflicts))
+}
+
+// changedDuringRestore records a key whose check-and-set write failed
+// because it was changed after planKV compared it
+func changedDuringRestore(r *Restore, write *consulapi.KVPair) {
+	conflict := Conflict{Key: write.Key, Reason: ReasonChanged, Action: ConflictNotWritten, LiveIndex: write.ModifyIndex}
+	for _, kv := range r.JSONData {
+		if kv.Key == write.Key {
+			conflict.BackupIndex = kv.ModifyIndex
+			break
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Conflicts = append(r.Conflicts, conflict)
+}
+
+// reportConflicts logs every key that conflicted with the cluster and what
+// was done with it
+func reportConflicts(r *Restore) {
+	if r.SkippedKeys > 0 {
+		log.Printf("[INFO] Skipped %v keys under the %s conflict policy", r.SkippedKeys, r.OnConflict)
+	}
+	if len(r.Conflicts) == 0 {
+		log.Print("[INFO] No keys conflicted with the cluster")
+		return
+	}
+
+	log.Printf("[WARN] %v keys conflicted with the cluster:", len(r.Conflicts))
+	for _, conflict := range r.Conflicts {
+		log.Printf("[WARN]   %s %s, %s (backup index %v, live index %v)",
+			conflict.Key, conflict.Reason, conflict.Action, conflict.BackupIndex, conflict.LiveIndex)
+	}
+}
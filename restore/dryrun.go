@@ -0,0 +1,316 @@
+package restore
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/pshima/consul-snapshot/consul"
+)
+
+// Actions a dry run reports for each item in the backup
+const (
+	ActionCreate    = "create"
+	ActionUpdate    = "update"
+	ActionUnchanged = "unchanged"
+	ActionDelete    = "delete"
+)
+
+// hashLength is how much of a sha256 is shown in text dry run output
+const hashLength = 12
+
+// DryRun describes what a restore would change in the live cluster.  Keys
+// that a mirror restore would delete are listed in Keys with ActionDelete.
+type DryRun struct {
+	RestorePath  string
+	Mode         string
+	FilteredKeys int
+	Keys         []KeyChange
+	KeyCounts    ChangeCounts
+	PQs          []ItemChange
+	PQCounts     ChangeCounts
+	ACLs         []ItemChange
+	ACLCounts    ChangeCounts
+	Rewrites     []KeyRewrite `json:",omitempty"`
+	OnConflict   string       `json:",omitempty"`
+	Conflicts    []Conflict   `json:",omitempty"`
+}
+
+// ChangeCounts totals the actions in one section of a dry run
+type ChangeCounts struct {
+	Create    int
+	Update    int
+	Unchanged int
+	Delete    int `json:",omitempty"`
+}
+
+// KeyChange is the dry run result for one key in the backup.  Sizes, hashes
+// and flags of the live value are only set when the key exists.
+type KeyChange struct {
+	Key        string
+	Action     string
+	LiveSize   int
+	LiveSha256 string `json:",omitempty"`
+	LiveFlags  uint64 `json:",omitempty"`
+	Size       int
+	Sha256     string
+	Flags      uint64 `json:",omitempty"`
+}
+
+// ItemChange is the dry run result for one prepared query or ACL
+type ItemChange struct {
+	Name   string
+	Action string
+}
+
+func (cc *ChangeCounts) add(action string) {
+	switch action {
+	case ActionCreate:
+		cc.Create++
+	case ActionUpdate:
+		cc.Update++
+	case ActionDelete:
+		cc.Delete++
+	default:
+		cc.Unchanged++
+	}
+}
+
+// dryRun compares the backup with the live cluster without writing anything
+func dryRun(r *Restore, c *consul.Consul) (*DryRun, error) {
+	result := &DryRun{
+		RestorePath:  r.RestorePath,
+		Mode:         ModeMerge,
+		FilteredKeys: r.FilteredKeys,
+		Rewrites:     r.Rewrites,
+		OnConflict:   r.OnConflict,
+		Conflicts:    r.Conflicts,
+	}
+
+	liveKeys, err := c.Client.ListKeys("")
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list existing keys: %v", err)
+	}
+	live := make(map[string]*consulapi.KVPair)
+	for _, kv := range liveKeys {
+		live[kv.Key] = kv
+	}
+
+	for _, kv := range r.JSONData {
+		change := KeyChange{
+			Key:    kv.Key,
+			Action: ActionCreate,
+			Size:   len(kv.Value),
+			Sha256: valueSha256(kv.Value),
+			Flags:  kv.Flags,
+		}
+		if existing, ok := live[kv.Key]; ok {
+			change.LiveSize = len(existing.Value)
+			change.LiveSha256 = valueSha256(existing.Value)
+			change.LiveFlags = existing.Flags
+			change.Action = ActionUpdate
+			if bytes.Equal(existing.Value, kv.Value) && existing.Flags == kv.Flags {
+				change.Action = ActionUnchanged
+			}
+		}
+		result.KeyCounts.add(change.Action)
+		result.Keys = append(result.Keys, change)
+	}
+
+	if r.Mirror {
+		result.Mode = ModeMirror
+		for _, kv := range mirrorDeletes(r, liveKeys) {
+			change := KeyChange{
+				Key:        kv.Key,
+				Action:     ActionDelete,
+				LiveSize:   len(kv.Value),
+				LiveSha256: valueSha256(kv.Value),
+			}
+			result.KeyCounts.add(change.Action)
+			result.Keys = append(result.Keys, change)
+		}
+	}
+
+	livePQs, err := c.Client.ListPQs()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list existing prepared queries: %v", err)
+	}
+	for _, pq := range r.PQData {
+		change := ItemChange{Name: pqLabel(pq), Action: pqAction(pq, livePQs)}
+		result.PQCounts.add(change.Action)
+		result.PQs = append(result.PQs, change)
+	}
+
+	liveACLs, err := c.Client.ListACLs()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list existing ACLs: %v", err)
+	}
+	aclsByID := make(map[string]*consulapi.ACLEntry)
+	for _, acl := range liveACLs {
+		aclsByID[acl.ID] = acl
+	}
+	for _, acl := range r.ACLData {
+		change := ItemChange{Name: aclLabel(acl), Action: ActionCreate}
+		if match, ok := aclsByID[acl.ID]; ok {
+			change.Action = ActionUpdate
+			if match.Name == acl.Name && match.Type == acl.Type && match.Rules == acl.Rules {
+				change.Action = ActionUnchanged
+			}
+		}
+		result.ACLCounts.add(change.Action)
+		result.ACLs = append(result.ACLs, change)
+	}
+
+	return result, nil
+}
+
+// pqAction matches a prepared query the same way restorePQs does and reports
+// whether the live query differs from the backup
+func pqAction(pq *consulapi.PreparedQueryDefinition, live []*consulapi.PreparedQueryDefinition) string {
+	var match *consulapi.PreparedQueryDefinition
+	for _, existing := range live {
+		if existing.ID == pq.ID {
+			match = existing
+			break
+		}
+	}
+	if match == nil && pq.Name != "" {
+		for _, existing := range live {
+			if existing.Name == pq.Name {
+				match = existing
+				break
+			}
+		}
+	}
+	if match == nil {
+		return ActionCreate
+	}
+
+	// restores keep the live token in place of a redacted one
+	restored := *pq
+	if restored.Token == redactedToken {
+		restored.Token = match.Token
+	}
+	if pqDefinition(match) == pqDefinition(&restored) {
+		return ActionUnchanged
+	}
+	return ActionUpdate
+}
+
+// pqDefinition returns a prepared query as JSON without the fields consul
+// assigns, so queries can be compared
+func pqDefinition(pq *consulapi.PreparedQueryDefinition) string {
+	definition := *pq
+	definition.ID = ""
+	if definition.Token == redactedToken {
+		definition.Token = ""
+	}
+	data, _ := json.Marshal(definition)
+	return string(data)
+}
+
+// reportDryRun runs a dry run and writes the report to the UI
+func reportDryRun(r *Restore, c *consul.Consul, opts Options) error {
+	result, err := dryRun(r, c)
+	if err != nil {
+		return err
+	}
+
+	if opts.Format == "json" {
+		data, err := json.MarshalIndent(result, "", "  ")
+		if err != nil {
+			return fmt.Errorf("Unable to encode dry run to json: %v", err)
+		}
+		if opts.Stdout != nil {
+			fmt.Fprintln(opts.Stdout, string(data))
+			return nil
+		}
+		opts.UI.Output(string(data))
+		return nil
+	}
+
+	opts.UI.Output(result.Text())
+	return nil
+}
+
+func valueSha256(value []byte) string {
+	sum := sha256.Sum256(value)
+	return hex.EncodeToString(sum[:])
+}
+
+// Text formats the dry run for people to read.  Unchanged items are only
+// counted.
+func (d *DryRun) Text() string {
+	var out strings.Builder
+	fmt.Fprintf(&out, "Dry run of restore from %s, nothing was written\n", d.RestorePath)
+
+	if len(d.Rewrites) > 0 {
+		fmt.Fprint(&out, "Rewrites:\n")
+		for _, rw := range d.Rewrites {
+			if rw.Dropped {
+				fmt.Fprintf(&out, "  %s dropped\n", rw.Key)
+			} else {
+				fmt.Fprintf(&out, "  %s -> %s\n", rw.Key, rw.NewKey)
+			}
+		}
+	}
+
+	fmt.Fprintf(&out, "Keys: %v to create, %v to update, %v unchanged",
+		d.KeyCounts.Create, d.KeyCounts.Update, d.KeyCounts.Unchanged)
+	if d.Mode == ModeMirror {
+		fmt.Fprintf(&out, ", %v to delete", d.KeyCounts.Delete)
+	}
+	if d.FilteredKeys > 0 {
+		fmt.Fprintf(&out, ", %v filtered out", d.FilteredKeys)
+	}
+	fmt.Fprint(&out, "\n")
+	for _, change := range d.Keys {
+		switch change.Action {
+		case ActionCreate:
+			fmt.Fprintf(&out, "  + %s (%v bytes)\n", change.Key, change.Size)
+		case ActionUpdate:
+			fmt.Fprintf(&out, "  ~ %s (%v -> %v bytes, sha256 %s -> %s", change.Key,
+				change.LiveSize, change.Size, change.LiveSha256[:hashLength], change.Sha256[:hashLength])
+			if change.LiveFlags != change.Flags {
+				fmt.Fprintf(&out, ", flags %v -> %v", change.LiveFlags, change.Flags)
+			}
+			fmt.Fprint(&out, ")\n")
+		case ActionDelete:
+			fmt.Fprintf(&out, "  - %s (%v bytes)\n", change.Key, change.LiveSize)
+		}
+	}
+
+	if len(d.Conflicts) > 0 {
+		fmt.Fprintf(&out, "Conflicts: %v keys, policy %s\n", len(d.Conflicts), d.OnConflict)
+		for _, conflict := range d.Conflicts {
+			fmt.Fprintf(&out, "  ! %s %s, would be %s\n", conflict.Key, conflict.Reason, conflict.Action)
+		}
+	}
+
+	sections := []struct {
+		title  string
+		items  []ItemChange
+		counts ChangeCounts
+	}{
+		{"Prepared queries", d.PQs, d.PQCounts},
+		{"ACLs", d.ACLs, d.ACLCounts},
+	}
+	for _, section := range sections {
+		fmt.Fprintf(&out, "%s: %v to create, %v to update, %v unchanged\n",
+			section.title, section.counts.Create, section.counts.Update, section.counts.Unchanged)
+		for _, item := range section.items {
+			switch item.Action {
+			case ActionCreate:
+				fmt.Fprintf(&out, "  + %s\n", item.Name)
+			case ActionUpdate:
+				fmt.Fprintf(&out, "  ~ %s\n", item.Name)
+			}
+		}
+	}
+
+	return strings.TrimRight(out.String(), "\n")
+}
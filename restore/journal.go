@@ -0,0 +1,179 @@
+package restore
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// journalHeader is the first line of a journal, it ties the journal to the
+// backup it restores
+type journalHeader struct {
+	RestorePath string
+	KVSha256    string
+	StartTime   int64
+}
+
+// journal records the keys a restore has committed, one JSON encoded key
+// per line after the header, so an interrupted restore can be resumed
+type journal struct {
+	path   string
+	file   *os.File
+	mu     sync.Mutex
+	failed bool
+}
+
+// journalPath is where a restore started at startTime keeps its journal
+func journalPath(dir string, startTime int64) string {
+	return filepath.Join(dir, fmt.Sprintf("consul-snapshot.restore.%v.journal", startTime))
+}
+
+// createJournal starts a new journal for a restore
+func createJournal(path string, r *Restore) (*journal, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create restore journal: %v", err)
+	}
+
+	header := journalHeader{RestorePath: r.RestorePath, StartTime: r.StartTime}
+	if r.Meta != nil {
+		header.KVSha256 = r.Meta.KVSha256
+	}
+	data, err := json.Marshal(header)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("Unable to encode restore journal header: %v", err)
+	}
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("Unable to write restore journal: %v", err)
+	}
+	return &journal{path: path, file: file}, nil
+}
+
+// appendJournal reopens the journal of an interrupted restore to add to it
+func appendJournal(path string) (*journal, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open restore journal: %v", err)
+	}
+	return &journal{path: path, file: file}, nil
+}
+
+// readJournal returns the header of a journal and the keys it recorded
+func readJournal(path string) (*journalHeader, map[string]bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Unable to open restore journal: %v", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	if !scanner.Scan() {
+		return nil, nil, fmt.Errorf("Restore journal %s is empty", path)
+	}
+	header := &journalHeader{}
+	if err := json.Unmarshal(scanner.Bytes(), header); err != nil {
+		return nil, nil, fmt.Errorf("Unable to parse restore journal header: %v", err)
+	}
+
+	done := make(map[string]bool)
+	for scanner.Scan() {
+		var key string
+		// a line cut short by the interruption is the last one, the key
+		// on it is simply restored again
+		if err := json.Unmarshal(scanner.Bytes(), &key); err != nil {
+			log.Printf("[WARN] Ignoring unreadable line in restore journal: %v", err)
+			continue
+		}
+		done[key] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, fmt.Errorf("Unable to read restore journal: %v", err)
+	}
+	return header, done, nil
+}
+
+// JournalRestorePath returns the backup a journal belongs to, so a resumed
+// restore does not need to be told again
+func JournalRestorePath(path string) (string, error) {
+	header, _, err := readJournal(path)
+	if err != nil {
+		return "", err
+	}
+	return header.RestorePath, nil
+}
+
+// record adds committed keys to the journal.  A journal that can not be
+// written only loses the ability to resume, so the restore carries on.
+func (j *journal) record(keys ...string) {
+	if j == nil {
+		return
+	}
+
+	var data []byte
+	for _, key := range keys {
+		line, _ := json.Marshal(key)
+		data = append(data, line...)
+		data = append(data, '\n')
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.failed {
+		return
+	}
+	if _, err := j.file.Write(data); err != nil {
+		log.Printf("[WARN] Unable to write restore journal, this restore can not be resumed: %v", err)
+		j.failed = true
+	}
+}
+
+// finish closes the journal.  It is removed when every key was restored
+// and kept for -resume otherwise.
+func (j *journal) finish(failedKeys int) {
+	if j == nil {
+		return
+	}
+
+	j.file.Close()
+	if failedKeys == 0 {
+		os.Remove(j.path)
+		return
+	}
+	log.Printf("[INFO] %v keys were not restored, continue the restore with: consul-snapshot restore -resume %s",
+		failedKeys, j.path)
+}
+
+// resumeJournal checks a journal belongs to the backup being restored and
+// drops the keys it recorded from the planned writes
+func resumeJournal(r *Restore, path string) error {
+	header, done, err := readJournal(path)
+	if err != nil {
+		return err
+	}
+	if r.Meta == nil || r.Meta.KVSha256 == "" {
+		return fmt.Errorf("Backup does not record a key checksum, unable to check it matches the restore journal")
+	}
+	if header.KVSha256 != r.Meta.KVSha256 {
+		return fmt.Errorf("Restore journal %s was written for a backup with key checksum %s, not %s",
+			path, header.KVSha256, r.Meta.KVSha256)
+	}
+
+	remaining := r.KVWrites[:0]
+	for _, kv := range r.KVWrites {
+		if done[kv.Key] {
+			r.ResumedKeys++
+			continue
+		}
+		remaining = append(remaining, kv)
+	}
+	r.KVWrites = remaining
+	log.Printf("[INFO] Resuming restore, %v keys were already restored and %v are left", r.ResumedKeys, len(r.KVWrites))
+	return nil
+}
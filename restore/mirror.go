@@ -0,0 +1,81 @@
+package restore
+
+import (
+	"fmt"
+	"log"
+	"sort"
+
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/pshima/consul-snapshot/consul"
+)
+
+// Restore modes decide what happens to live keys that are not in the backup
+const (
+	// ModeMerge writes the keys in the backup and leaves every other key alone
+	ModeMerge = "merge"
+	// ModeMirror also deletes the keys that are not in the backup, so the
+	// restored prefixes match the backup exactly
+	ModeMirror = "mirror"
+)
+
+// inMirrorScope reports whether a mirror restore owns a live key.  Only keys
+// selected by the restore filter, and by the filter the backup was taken
+// with, can be deleted; keys a partial backup never captured are left alone.
+func (r *Restore) inMirrorScope(key string) bool {
+	if !r.KVFilter.Match(key) {
+		return false
+	}
+	return r.Meta == nil || r.Meta.KVFilter == nil || r.Meta.KVFilter.Match(key)
+}
+
+// mirrorDeletes lists the live keys a mirror restore would delete, sorted
+func mirrorDeletes(r *Restore, live consulapi.KVPairs) consulapi.KVPairs {
+	inBackup := make(map[string]bool, len(r.JSONData))
+	for _, kv := range r.JSONData {
+		inBackup[kv.Key] = true
+	}
+
+	deletes := consulapi.KVPairs{}
+	for _, kv := range live {
+		if !inBackup[kv.Key] && r.inMirrorScope(kv.Key) {
+			deletes = append(deletes, kv)
+		}
+	}
+	sort.Slice(deletes, func(i, j int) bool { return deletes[i].Key < deletes[j].Key })
+	return deletes
+}
+
+// deleteMirroredKeys deletes the live keys that are not in the backup.  It
+// runs after the keys are restored, so a failed restore never leaves a
+// prefix emptied out.  Keys are deleted with check-and-set on the index they
+// were listed with, keys written in the meantime are left alone.
+func deleteMirroredKeys(r *Restore, c *consul.Consul) error {
+	live, err := c.Client.ListKeys("")
+	if err != nil {
+		return fmt.Errorf("Unable to list existing keys for mirror restore: %v", err)
+	}
+
+	deletedCount := 0
+	changedCount := 0
+	errorCount := 0
+	for _, kv := range mirrorDeletes(r, live) {
+		ok, err := c.Client.DeleteCASKV(kv)
+		if err != nil {
+			errorCount++
+			log.Printf("Unable to delete key: %s, %v", kv.Key, err)
+			continue
+		}
+		if !ok {
+			changedCount++
+			log.Printf("[WARN] Key %s changed since it was listed, leaving it alone", kv.Key)
+			continue
+		}
+		deletedCount++
+	}
+	log.Printf("[INFO] Deleted %v keys not in the backup, left %v changed keys alone, with %v errors",
+		deletedCount, changedCount, errorCount)
+	if errorCount > 0 {
+		return fmt.Errorf("Unable to delete %v keys that are not in the backup", errorCount)
+	}
+	return nil
+}
@@ -3,6 +3,8 @@ package restore
 import (
 	"bytes"
 	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"golang.org/x/net/context"
@@ -11,7 +13,10 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"cloud.google.com/go/storage"
@@ -21,13 +26,20 @@ import (
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	consulapi "github.com/hashicorp/consul/api"
 	"github.com/mholt/archives"
+	"github.com/mitchellh/cli"
 	"github.com/pshima/consul-snapshot/adapters"
 	"github.com/pshima/consul-snapshot/backup"
 	"github.com/pshima/consul-snapshot/config"
 	"github.com/pshima/consul-snapshot/consul"
 	"github.com/pshima/consul-snapshot/crypt"
+	"github.com/pshima/consul-snapshot/filter"
+	"github.com/pshima/consul-snapshot/rewrite"
 )
 
+// redactedToken is what consul returns in place of a token the caller
+// is not allowed to read
+const redactedToken = "<hidden>"
+
 // Restore is a struct to hold data about a single restore
 type Restore struct {
 	Config        *config.Config
@@ -35,6 +47,9 @@ type Restore struct {
 	JSONData      consulapi.KVPairs
 	PQData        []*consulapi.PreparedQueryDefinition
 	ACLData       []*consulapi.ACLEntry
+	ACLSystem     *consul.ACLSystem
+	ConfigEntries consul.ConfigEntries
+	Intentions    []*consulapi.ServiceIntentionsConfigEntry
 	LocalFilePath string
 	RestorePath   string
 	RawData       []byte
@@ -42,10 +57,72 @@ type Restore struct {
 	Meta          *backup.Meta
 	ExtractedPath string
 	Version       string
+	FilteredKeys  int
+	KVFilter      filter.KV
+	Mirror        bool
+	OnConflict    string
+	WarnLocks     bool
+	Rewrites      []KeyRewrite
+	Concurrency   int
+	Rate          int
+	KVWrites      consulapi.KVPairs
+	Conflicts     []Conflict
+	SkippedKeys   int
+	ResumedKeys   int
+	Tombstones    []string
+	ChainLength   int
+
+	// mu guards Conflicts while keys are written concurrently
+	mu sync.Mutex
+	// journal records the keys that were written for -resume
+	journal *journal
+}
+
+// Options holds the settings a restore was started with
+type Options struct {
+	// Native restores the raft snapshot in the backup instead of the JSON data
+	Native bool
+	// DryRun compares the backup with the cluster instead of writing to it
+	DryRun bool
+	// Format of the dry run report, text or json
+	Format string
+	// KVFilter limits the restore to keys under some prefixes
+	KVFilter filter.KV
+	// Txn writes keys in transactions of up to 64 keys instead of one by one
+	Txn bool
+	// OnConflict is the policy for keys that differ in the cluster, one of
+	// the Conflict constants
+	OnConflict string
+	// WarnLocks warns about keys that were held by a session when the backup
+	// was taken, their locks are not restored
+	WarnLocks bool
+	// Rewrite renames or drops keys before they are written
+	Rewrite rewrite.Rules
+	// Concurrency is how many keys or transactions are written at once
+	Concurrency int
+	// Rate limits writes to this many requests per second, 0 is unlimited
+	Rate int
+	// Resume is the journal of an interrupted restore to continue
+	Resume string
+	// Mode is ModeMerge or ModeMirror, which also deletes keys that are not
+	// in the backup
+	Mode string
+	// Verify lists the restored keys again afterwards and fails the restore
+	// when they do not match the backup
+	Verify bool
+	// Force skips asking for confirmation before writing
+	Force bool
+	// AllowDatacenterMismatch restores backups taken in another datacenter
+	AllowDatacenterMismatch bool
+	// UI is where dry run reports and the confirmation prompt are written
+	UI cli.Ui
+	// Stdout receives json dry run reports without the UI prefixes, the UI
+	// is used when it is not set
+	Stdout io.Writer
 }
 
 // Runner is the base level to start a restore and is called from command
-func Runner(restorepath string) int {
+func Runner(restorepath string, opts Options) int {
 	adapter, err := adapters.NewConsulAdapter()
 	if err != nil {
 		log.Fatalf("[ERR] Failed to create consul adapter: %v", err)
@@ -55,46 +132,55 @@ func Runner(restorepath string) int {
 	conf := config.ParseConfig(false)
 
 	log.Printf("[DEBUG] Starting restore of %s/%s", conf.S3Bucket, restorepath)
-	doWork(conf, consulClient, restorepath)
+	if err := doWork(conf, consulClient, restorepath, opts); err != nil {
+		log.Printf("[ERR] %v", err)
+		return 1
+	}
 	return 0
 }
 
 // doWork this is the main function to start a restore
-func doWork(conf *config.Config, c *consul.Consul, restorePath string) {
+func doWork(conf *config.Config, c *consul.Consul, restorePath string, opts Options) error {
 	restore := &Restore{}
 	restore.StartTime = time.Now().Unix()
 	restore.RestorePath = restorePath
+	restore.KVFilter = opts.KVFilter
+	restore.Mirror = opts.Mode == ModeMirror
+	restore.OnConflict = opts.OnConflict
+	restore.WarnLocks = opts.WarnLocks
+	restore.Concurrency = opts.Concurrency
+	restore.Rate = opts.Rate
+	if restore.OnConflict == "" {
+		restore.OnConflict = ConflictOverwrite
+	}
 	restore.Config = conf
 
 	var err error
 
-	// if we are running an Acceptance test then we need to restore from local
-	if conf.Acceptance {
-		restore.LocalFilePath = fmt.Sprintf("%v/acceptancetest.tar.gz", conf.TmpDir)
-	} else {
-		getRemoteBackup(restore, conf)
-	}
-
-	log.Print("[INFO] Checking encryption status of backup")
-	restore.Encrypted, err = crypt.CheckEncryption(restore.LocalFilePath)
-	if err != nil {
-		log.Fatalf("[ERR] Unable to check file for encryption status: %v", err)
-	}
+	restore.fetchBackup()
 
-	if restore.Encrypted {
-		log.Print("[INFO] Encrypted backup detected, decrypting")
-		if restore.Config.Encryption == "" {
-			log.Fatal("[ERR] Encrypted backup detected but CRYPTO_PASSWORD is empty, exiting")
+	// backups taken in native mode only have the raft snapshot
+	if opts.Native || (restore.Meta != nil && restore.Meta.BackupMode == config.BackupModeNative) {
+		if opts.DryRun {
+			return fmt.Errorf("Dry runs are not supported for native snapshot restores")
 		}
-		crypt.DecryptFile(restore.LocalFilePath, restore.Config.Encryption)
+		if restore.Mirror {
+			return fmt.Errorf("Mirror mode is not supported for native snapshot restores, they already replace all cluster state")
+		}
+		if len(opts.Rewrite) > 0 {
+			return fmt.Errorf("Key rewrites are not supported for native snapshot restores")
+		}
+		if err := confirmRestore(restore, c, opts, true); err != nil {
+			return err
+		}
+		log.Print("[INFO] Restoring native snapshot")
+		if err := restoreSnapshot(restore, c); err != nil {
+			return err
+		}
+		log.Print("[INFO] Restore completed.")
+		return nil
 	}
 
-	log.Print("[INFO] Extracting backup")
-	restore.extractBackup()
-
-	log.Print("[INFO] Inspecting backup contents")
-	restore.inspectBackup()
-
 	// if during the backup inspection if we found it was v1 we
 	// already have the kv data in the restore struct
 	if restore.Version != "0.0.1" {
@@ -104,14 +190,245 @@ func doWork(conf *config.Config, c *consul.Consul, restorePath string) {
 		restore.loadPQData()
 		log.Print("[INFO] Parsing ACL Data")
 		restore.loadACLData()
+		log.Print("[INFO] Parsing ACL System Data")
+		restore.loadACLSystemData()
+		log.Print("[INFO] Parsing Config Entry Data")
+		restore.loadConfigEntryData()
+		log.Print("[INFO] Parsing Intention Data")
+		restore.loadIntentionData()
+
+		// an incremental backup only holds what changed since its parent
+		if restore.Meta.BackupType == backup.BackupTypeIncremental {
+			if err := restore.loadIncrementalChain(); err != nil {
+				return err
+			}
+		}
+	}
+
+	// keys outside of a filtered backup were never captured, restoring it
+	// leaves them as they are in the cluster
+	if restore.Meta != nil && restore.Meta.KVFilter != nil {
+		log.Printf("[INFO] Backup is partial, it only holds keys matching %s", restore.Meta.KVFilter)
+	}
+
+	if !opts.KVFilter.Empty() {
+		restore.applyKVFilter(&opts.KVFilter)
+	}
+
+	// prefix filters select keys by the names they have in the backup,
+	// rewrites rename them after that
+	if len(opts.Rewrite) > 0 {
+		if restore.Mirror {
+			return fmt.Errorf("Mirror mode can not be combined with key rewrites")
+		}
+		if err := restore.applyRewrite(opts.Rewrite); err != nil {
+			return err
+		}
+	}
+
+	if restore.WarnLocks {
+		warnLockedKeys(restore)
+	}
+
+	log.Print("[INFO] Comparing backup with the cluster")
+	if err := planKV(restore, c); err != nil {
+		return err
+	}
+	if opts.Resume != "" {
+		if err := resumeJournal(restore, opts.Resume); err != nil {
+			return err
+		}
+	}
+
+	if opts.DryRun {
+		return reportDryRun(restore, c, opts)
 	}
 
-	restoreKV(restore, c)
+	if err := checkConflicts(restore); err != nil {
+		return err
+	}
+	if err := confirmRestore(restore, c, opts, false); err != nil {
+		return err
+	}
+
+	if opts.Resume != "" {
+		restore.journal, err = appendJournal(opts.Resume)
+	} else {
+		restore.journal, err = createJournal(journalPath(conf.TmpDir, restore.StartTime), restore)
+	}
+	if err != nil {
+		return err
+	}
+
+	failedKeys := 0
+	if opts.Txn {
+		failedKeys = restoreKVTxn(restore, c)
+	} else {
+		failedKeys = restoreKV(restore, c)
+	}
+	restore.journal.finish(failedKeys)
+	reportConflicts(restore)
+	// the rest of the backup is still restored when deletes fail, the
+	// restore fails at the end
+	var mirrorErr error
+	if restore.Mirror {
+		mirrorErr = deleteMirroredKeys(restore, c)
+	}
+	restoreConfigEntries(restore, c)
+	restoreIntentions(restore, c)
 	restorePQs(restore, c)
+	restoreACLSystem(restore, c)
 	restoreACLs(restore, c)
 
+	if opts.Verify {
+		verification, err := verifyRestore(restore, c)
+		if err != nil {
+			return err
+		}
+		if err := reportVerification(verification); err != nil {
+			return err
+		}
+	}
+
+	if mirrorErr != nil {
+		return mirrorErr
+	}
+
 	log.Print("[INFO] Restore completed.")
+	return nil
+}
+
+// applyKVFilter drops the keys outside of a partial restore.  A restore of
+// some prefixes only restores keys, the other data in the backup is left
+// alone.  Excluding prefixes on their own still restores everything else.
+func (r *Restore) applyKVFilter(f *filter.KV) {
+	total := len(r.JSONData)
+	r.JSONData = f.Apply(r.JSONData)
+	r.FilteredKeys = total - len(r.JSONData)
+	log.Printf("[INFO] Restoring %v of %v keys matching %s", len(r.JSONData), total, f)
+
+	if len(f.IncludePrefixes) == 0 && f.IncludeRegex == nil {
+		return
+	}
+	log.Print("[WARN] Partial restore, skipping prepared queries, ACLs, config entries and intentions")
+	r.PQData = nil
+	r.ACLData = nil
+	r.ACLSystem = nil
+	r.ConfigEntries = nil
+	r.Intentions = nil
+}
 
+// KeyRewrite records a key that a rewrite renamed or dropped.  NewKey is
+// empty for dropped keys.
+type KeyRewrite struct {
+	Key     string
+	NewKey  string `json:",omitempty"`
+	Dropped bool   `json:",omitempty"`
+}
+
+// applyRewrite renames and drops keys by the rewrite rules.  It refuses
+// rules that would write two keys in the backup to the same key.
+func (r *Restore) applyRewrite(rules rewrite.Rules) error {
+	rewritten := consulapi.KVPairs{}
+	sources := make(map[string]string)
+	r.Rewrites = nil
+	for _, kv := range r.JSONData {
+		newKey, keep := rules.Apply(kv.Key)
+		if !keep {
+			r.Rewrites = append(r.Rewrites, KeyRewrite{Key: kv.Key, Dropped: true})
+			continue
+		}
+		if source, ok := sources[newKey]; ok {
+			return fmt.Errorf("Rewrites map both %s and %s to %s", source, kv.Key, newKey)
+		}
+		sources[newKey] = kv.Key
+
+		if newKey != kv.Key {
+			r.Rewrites = append(r.Rewrites, KeyRewrite{Key: kv.Key, NewKey: newKey})
+			renamed := *kv
+			renamed.Key = newKey
+			kv = &renamed
+		}
+		rewritten = append(rewritten, kv)
+	}
+
+	renamed, dropped := r.rewriteCounts()
+	log.Printf("[INFO] Rewrites renamed %v keys and dropped %v keys", renamed, dropped)
+	r.JSONData = rewritten
+	return nil
+}
+
+// rewriteCounts returns how many keys rewrites renamed and dropped
+func (r *Restore) rewriteCounts() (int, int) {
+	renamed, dropped := 0, 0
+	for _, rw := range r.Rewrites {
+		if rw.Dropped {
+			dropped++
+		} else {
+			renamed++
+		}
+	}
+	return renamed, dropped
+}
+
+// lockedKeys returns the keys that were held by a session when the backup
+// was taken
+func (r *Restore) lockedKeys() consulapi.KVPairs {
+	locked := consulapi.KVPairs{}
+	for _, kv := range r.JSONData {
+		if kv.Session != "" {
+			locked = append(locked, kv)
+		}
+	}
+	return locked
+}
+
+// warnLockedKeys warns about keys that were locked at backup time.  Sessions
+// do not survive a restore, so the values are written without their locks
+// and whatever held them has to acquire them again.
+func warnLockedKeys(r *Restore) {
+	locked := r.lockedKeys()
+	if len(locked) == 0 {
+		log.Print("[INFO] No keys were locked by a session at backup time")
+		return
+	}
+
+	log.Printf("[WARN] %v keys were locked by a session at backup time, their locks will not be restored:", len(locked))
+	for _, kv := range locked {
+		log.Printf("[WARN]   %s held by session %s (lock index %v)", kv.Key, kv.Session, kv.LockIndex)
+	}
+}
+
+// fetchBackup downloads, decrypts, extracts and inspects the backup at
+// RestorePath
+func (r *Restore) fetchBackup() {
+	// if we are running an Acceptance test then we need to restore from local
+	if r.Config.Acceptance {
+		r.LocalFilePath = fmt.Sprintf("%v/acceptancetest.tar.gz", r.Config.TmpDir)
+	} else {
+		getRemoteBackup(r, r.Config)
+	}
+
+	var err error
+	log.Print("[INFO] Checking encryption status of backup")
+	r.Encrypted, err = crypt.CheckEncryption(r.LocalFilePath)
+	if err != nil {
+		log.Fatalf("[ERR] Unable to check file for encryption status: %v", err)
+	}
+
+	if r.Encrypted {
+		log.Print("[INFO] Encrypted backup detected, decrypting")
+		if r.Config.Encryption == "" {
+			log.Fatal("[ERR] Encrypted backup detected but CRYPTO_PASSWORD is empty, exiting")
+		}
+		crypt.DecryptFile(r.LocalFilePath, r.Config.Encryption)
+	}
+
+	log.Print("[INFO] Extracting backup")
+	r.extractBackup()
+
+	log.Print("[INFO] Inspecting backup contents")
+	r.inspectBackup()
 }
 
 // getRemoteBackup is used to pull backups from S3
@@ -309,6 +626,43 @@ func (r *Restore) inspectBackup() {
 	r.Meta = metaExtract
 }
 
+// restoreSnapshot feeds the native raft snapshot in the backup back in to
+// consul.  This replaces the whole cluster state, not only what is in the
+// JSON exports.
+func restoreSnapshot(r *Restore, c *consul.Consul) error {
+	if r.Meta == nil || r.Meta.RaftSha256 == "" {
+		return fmt.Errorf("Backup does not contain a native snapshot")
+	}
+
+	startstring := fmt.Sprintf("%v", r.Meta.StartTime)
+	raftFileName := fmt.Sprintf("consul.raft.%s.snap", startstring)
+	raftPath := filepath.Join(r.ExtractedPath, raftFileName)
+	handle, err := os.Open(raftPath)
+	if err != nil {
+		return fmt.Errorf("Unable to read native snapshot at %s: %v", raftPath, err)
+	}
+	defer handle.Close()
+
+	// consul would reject a corrupt snapshot part way through, check it
+	// before anything is sent
+	calc := sha256.New()
+	if _, err := io.Copy(calc, handle); err != nil {
+		return fmt.Errorf("Unable to read native snapshot at %s: %v", raftPath, err)
+	}
+	if checksum := hex.EncodeToString(calc.Sum(nil)); checksum != r.Meta.RaftSha256 {
+		return fmt.Errorf("Native snapshot checksum %s does not match backup metadata %s", checksum, r.Meta.RaftSha256)
+	}
+	if _, err := handle.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("Unable to read native snapshot at %s: %v", raftPath, err)
+	}
+
+	if err := c.Client.RestoreSnapshot(handle); err != nil {
+		return fmt.Errorf("Unable to restore native snapshot: %v", err)
+	}
+	log.Printf("[INFO] Restored native snapshot %s", raftFileName)
+	return nil
+}
+
 // loadKVData loads data from an uncompressed kv backup file into an object
 func (r *Restore) loadKVData() {
 	startstring := fmt.Sprintf("%v", r.Meta.StartTime)
@@ -357,27 +711,341 @@ func (r *Restore) loadACLData() {
 	log.Printf("[INFO] Loaded %v ACLs to restore", len(r.ACLData))
 }
 
-// restoreKV takes the restored kv data and puts it back in to consul
-func restoreKV(r *Restore, c *consul.Consul) {
-	restoredKeyCount := 0
-	errorCount := 0
-	for _, data := range r.JSONData {
-		err := c.Client.PutKV(data.Key, data.Value)
+// loadACLSystemData loads the ACL tokens, policies, roles, auth methods and
+// binding rules from an uncompressed backup file into an object.  Backups
+// taken before the ACL system was captured do not have this file.
+func (r *Restore) loadACLSystemData() {
+	if r.Meta.ACLSystemSha256 == "" {
+		log.Print("[INFO] No ACL system data in backup, skipping")
+		return
+	}
+
+	startstring := fmt.Sprintf("%v", r.Meta.StartTime)
+	aclSystemFileName := fmt.Sprintf("consul.aclsystem.%s.json", startstring)
+	aclSystemPath := filepath.Join(r.ExtractedPath, aclSystemFileName)
+	aclSystemData, err := ioutil.ReadFile(aclSystemPath)
+	if err != nil {
+		log.Fatalf("[ERR] Unable to read acl system backup file at %s: %v", aclSystemPath, err)
+	}
+
+	r.ACLSystem = &consul.ACLSystem{}
+	if err := json.Unmarshal(aclSystemData, r.ACLSystem); err != nil {
+		log.Fatalf("[ERR] Unable to unmarshal acl system data: %v", err)
+	}
+	log.Printf("[INFO] Loaded %v ACL tokens, %v policies, %v roles, %v auth methods and %v binding rules to restore",
+		len(r.ACLSystem.Tokens), len(r.ACLSystem.Policies), len(r.ACLSystem.Roles),
+		len(r.ACLSystem.AuthMethods), len(r.ACLSystem.BindingRules))
+}
+
+// loadConfigEntryData loads config entries from an uncompressed backup file
+// into an object.  Backups taken before config entries were captured do not
+// have this file.
+func (r *Restore) loadConfigEntryData() {
+	if r.Meta.ConfigSha256 == "" {
+		log.Print("[INFO] No config entry data in backup, skipping")
+		return
+	}
+
+	startstring := fmt.Sprintf("%v", r.Meta.StartTime)
+	configFileName := fmt.Sprintf("consul.config.%s.json", startstring)
+	configPath := filepath.Join(r.ExtractedPath, configFileName)
+	configData, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		log.Fatalf("[ERR] Unable to read config entry backup file at %s: %v", configPath, err)
+	}
+
+	if err := json.Unmarshal(configData, &r.ConfigEntries); err != nil {
+		log.Fatalf("[ERR] Unable to unmarshal config entry data: %v", err)
+	}
+
+	total := 0
+	for _, entries := range r.ConfigEntries {
+		total += len(entries)
+	}
+	log.Printf("[INFO] Loaded %v config entries to restore", total)
+}
+
+// loadIntentionData loads service intentions from an uncompressed backup
+// file into an object.  Backups taken before intentions were captured do not
+// have this file.
+func (r *Restore) loadIntentionData() {
+	if r.Meta.IntentionsSha256 == "" {
+		log.Print("[INFO] No intention data in backup, skipping")
+		return
+	}
+
+	startstring := fmt.Sprintf("%v", r.Meta.StartTime)
+	intentionsFileName := fmt.Sprintf("consul.intentions.%s.json", startstring)
+	intentionsPath := filepath.Join(r.ExtractedPath, intentionsFileName)
+	intentionsData, err := ioutil.ReadFile(intentionsPath)
+	if err != nil {
+		log.Fatalf("[ERR] Unable to read intentions backup file at %s: %v", intentionsPath, err)
+	}
+
+	if err := json.Unmarshal(intentionsData, &r.Intentions); err != nil {
+		log.Fatalf("[ERR] Unable to unmarshal intention data: %v", err)
+	}
+	log.Printf("[INFO] Loaded intentions for %v services to restore", len(r.Intentions))
+}
+
+// restoreKV takes the planned kv writes and puts them back in to consul one
+// by one with check-and-set, from Concurrency workers at up to Rate requests
+// per second.  It returns how many keys failed.
+func restoreKV(r *Restore, c *consul.Consul) int {
+	var restoredKeyCount, errorCount int64
+	limiter := newLimiter(r.Rate)
+	progress := startProgress("keys", len(r.KVWrites))
+	parallel(len(r.KVWrites), r.Concurrency, func(i int) {
+		defer progress.add(1)
+		data := r.KVWrites[i]
+		waitLimiter(limiter)
+		ok, err := c.Client.CASKV(data)
 		if err != nil {
-			errorCount++
+			atomic.AddInt64(&errorCount, 1)
 			log.Printf("Unable to restore key: %s, %v", data.Key, err)
+			return
 		}
-		restoredKeyCount++
-	}
+		if !ok {
+			changedDuringRestore(r, data)
+			return
+		}
+		r.journal.record(data.Key)
+		atomic.AddInt64(&restoredKeyCount, 1)
+	})
+	progress.finish()
 	log.Printf("[INFO] Restored %v keys with %v errors", restoredKeyCount, errorCount)
+	return int(errorCount)
 }
 
-// This needs a bit more testing before we can do PQ restores
+// restoreConfigEntries writes the restored config entries back in to consul
+// kind by kind in consul.ConfigEntryKinds order, so every entry is written
+// after the entries it depends on.  Kinds this version does not know about
+// are written last.
+func restoreConfigEntries(r *Restore, c *consul.Consul) {
+	if len(r.ConfigEntries) == 0 {
+		return
+	}
+
+	kinds := append([]string{}, consul.ConfigEntryKinds...)
+	var unknown []string
+	for kind := range r.ConfigEntries {
+		known := false
+		for _, k := range consul.ConfigEntryKinds {
+			if k == kind {
+				known = true
+				break
+			}
+		}
+		if !known {
+			unknown = append(unknown, kind)
+		}
+	}
+	sort.Strings(unknown)
+	kinds = append(kinds, unknown...)
+
+	restoredCount := 0
+	errorCount := 0
+	for _, kind := range kinds {
+		for _, entry := range r.ConfigEntries[kind] {
+			if err := c.Client.SetConfigEntry(entry); err != nil {
+				errorCount++
+				log.Printf("Unable to restore config entry: %s/%s, %v", kind, entry.GetName(), err)
+				continue
+			}
+			restoredCount++
+			log.Printf("[DEBUG] Restored config entry: %s/%s", kind, entry.GetName())
+		}
+	}
+	log.Printf("[INFO] Restored %v config entries with %v errors", restoredCount, errorCount)
+}
+
+// restoreIntentions writes the restored service intentions back in to consul.
+// Intentions are restored after config entries as L7 permissions depend on
+// the destination service protocol set in service-defaults.
+func restoreIntentions(r *Restore, c *consul.Consul) {
+	if len(r.Intentions) == 0 {
+		return
+	}
+
+	restoredCount := 0
+	errorCount := 0
+	for _, entry := range r.Intentions {
+		if entry.Kind == "" {
+			entry.Kind = consulapi.ServiceIntentions
+		}
+		if err := c.Client.SetIntentions(entry); err != nil {
+			errorCount++
+			log.Printf("Unable to restore intentions for: %s, %v", entry.Name, err)
+			continue
+		}
+		restoredCount += len(entry.Sources)
+		log.Printf("[DEBUG] Restored %v intentions for: %s", len(entry.Sources), entry.Name)
+	}
+	log.Printf("[INFO] Restored %v intentions with %v errors", restoredCount, errorCount)
+}
+
+// restorePQs takes the restored prepared queries and puts them back in to
+// consul.  Queries that already exist, matched by ID and then by name, are
+// updated in place so a restore never creates duplicates.
 func restorePQs(r *Restore, c *consul.Consul) {
-	log.Println("[WARN] PQ restoration currently unsupported")
+	existing, err := c.Client.ListPQs()
+	if err != nil {
+		log.Printf("[ERR] Unable to list existing prepared queries, skipping PQ restore: %v", err)
+		return
+	}
+
+	byID := make(map[string]*consulapi.PreparedQueryDefinition)
+	byName := make(map[string]*consulapi.PreparedQueryDefinition)
+	for _, pq := range existing {
+		byID[pq.ID] = pq
+		if pq.Name != "" {
+			byName[pq.Name] = pq
+		}
+	}
+
+	createdCount := 0
+	updatedCount := 0
+	errorCount := 0
+	for _, data := range r.PQData {
+		pq := *data
+
+		match, ok := byID[pq.ID]
+		if !ok && pq.Name != "" {
+			match, ok = byName[pq.Name]
+		}
+
+		// consul hides the token of a query from non-management tokens, never
+		// write the placeholder back as the real token.  An existing query
+		// keeps its own token.
+		if pq.Token == redactedToken {
+			pq.Token = ""
+			if ok {
+				pq.Token = match.Token
+			}
+		}
+		if pq.Token == redactedToken {
+			errorCount++
+			log.Printf("Unable to restore prepared query: %s, its token is hidden and updating it would remove the token", pqLabel(data))
+			continue
+		}
+
+		if ok {
+			pq.ID = match.ID
+			err = c.Client.UpdatePQ(&pq)
+		} else {
+			// consul always assigns the ID of a new query itself
+			pq.ID = ""
+			err = c.Client.CreatePQ(&pq)
+		}
+
+		if err != nil {
+			errorCount++
+			log.Printf("Unable to restore prepared query: %s, %v", pqLabel(data), err)
+			continue
+		}
+
+		if ok {
+			updatedCount++
+			log.Printf("[DEBUG] Updated prepared query: %s", pqLabel(data))
+		} else {
+			createdCount++
+			log.Printf("[DEBUG] Created prepared query: %s", pqLabel(data))
+		}
+	}
+	log.Printf("[INFO] Restored %v prepared queries (%v created, %v updated) with %v errors",
+		createdCount+updatedCount, createdCount, updatedCount, errorCount)
+}
+
+// pqLabel returns a human readable name for a prepared query in log lines
+func pqLabel(pq *consulapi.PreparedQueryDefinition) string {
+	if pq.Name != "" {
+		return pq.Name
+	}
+	return pq.ID
 }
 
-// This needs a bit more testing before we can do ACL restores
+// restoreACLs takes the restored legacy ACL tokens and puts them back in to
+// consul keeping their original IDs.  Tokens that already exist are updated
+// when they differ from the backup and skipped otherwise.
 func restoreACLs(r *Restore, c *consul.Consul) {
-	log.Println("[WARN] ACL restoration currently unsupported")
+	if len(r.ACLData) == 0 {
+		log.Print("[INFO] No ACLs in backup, skipping ACL restore")
+		return
+	}
+
+	existing, err := c.Client.ListACLs()
+	if err != nil {
+		log.Printf("[ERR] Unable to list existing ACLs, skipping ACL restore: %v", err)
+		return
+	}
+
+	byID := make(map[string]*consulapi.ACLEntry)
+	for _, acl := range existing {
+		byID[acl.ID] = acl
+	}
+
+	// legacy tokens are also listed by the ACL system with their ID as the
+	// secret, those were already restored by restoreACLSystem
+	restoredSecrets := make(map[string]bool)
+	if r.ACLSystem != nil {
+		for _, token := range r.ACLSystem.Tokens {
+			restoredSecrets[token.SecretID] = true
+		}
+	}
+
+	createdCount := 0
+	updatedCount := 0
+	skippedCount := 0
+	errorCount := 0
+	for _, data := range r.ACLData {
+		acl := &consulapi.ACLEntry{
+			ID:    data.ID,
+			Name:  data.Name,
+			Type:  data.Type,
+			Rules: data.Rules,
+		}
+
+		if restoredSecrets[acl.ID] {
+			skippedCount++
+			continue
+		}
+
+		match, ok := byID[acl.ID]
+		if ok && match.Name == acl.Name && match.Type == acl.Type && match.Rules == acl.Rules {
+			skippedCount++
+			log.Printf("[DEBUG] ACL already up to date: %s", aclLabel(acl))
+			continue
+		}
+
+		if ok {
+			err = c.Client.UpdateACL(acl)
+		} else {
+			err = c.Client.CreateACL(acl)
+		}
+
+		if err != nil {
+			errorCount++
+			log.Printf("Unable to restore ACL: %s, %v", aclLabel(acl), err)
+			continue
+		}
+
+		if ok {
+			updatedCount++
+			log.Printf("[DEBUG] Updated ACL: %s", aclLabel(acl))
+		} else {
+			createdCount++
+			log.Printf("[DEBUG] Created ACL: %s", aclLabel(acl))
+		}
+	}
+	log.Printf("[INFO] Restored %v ACLs (%v created, %v updated, %v unchanged) with %v errors",
+		createdCount+updatedCount, createdCount, updatedCount, skippedCount, errorCount)
+}
+
+// aclLabel returns a human readable name for an ACL in log lines without
+// leaking the token itself
+func aclLabel(acl *consulapi.ACLEntry) string {
+	if acl.Name != "" {
+		return acl.Name
+	}
+	return "(unnamed " + acl.Type + " token)"
 }
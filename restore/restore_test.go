@@ -1,16 +1,27 @@
 package restore
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 
 	consulapi "github.com/hashicorp/consul/api"
+	"github.com/mitchellh/cli"
 	"github.com/pshima/consul-snapshot/backup"
 	"github.com/pshima/consul-snapshot/config"
+	"github.com/pshima/consul-snapshot/consul"
+	"github.com/pshima/consul-snapshot/filter"
+	"github.com/pshima/consul-snapshot/mocks"
+	"github.com/pshima/consul-snapshot/rewrite"
 )
 
 func TestRestoreStruct(t *testing.T) {
@@ -382,6 +393,88 @@ func TestRestorePQs(t *testing.T) {
 	t.Logf("Would restore %d prepared queries", len(restore.PQData))
 }
 
+func TestRestorePQsCreateAndUpdate(t *testing.T) {
+	mockClient := mocks.NewMockConsulClient()
+	mockClient.PQData = []*consulapi.PreparedQueryDefinition{
+		{ID: "live-id", Name: "existing-query", Token: "old"},
+	}
+	c := consul.NewConsul(mockClient)
+
+	restore := &Restore{
+		PQData: []*consulapi.PreparedQueryDefinition{
+			{ID: "backup-id", Name: "existing-query", Token: redactedToken},
+			{ID: "new-id", Name: "new-query"},
+		},
+	}
+
+	restorePQs(restore, c)
+
+	if len(mockClient.PQData) != 2 {
+		t.Fatalf("expected 2 prepared queries after restore, got %d", len(mockClient.PQData))
+	}
+
+	updated := mockClient.PQData[0]
+	if updated.ID != "live-id" {
+		t.Errorf("expected existing query to keep live ID, got %s", updated.ID)
+	}
+	if updated.Token != "old" {
+		t.Errorf("expected redacted token to keep the live token, got %s", updated.Token)
+	}
+
+	created := mockClient.PQData[1]
+	if created.Name != "new-query" || created.ID != "" {
+		t.Errorf("expected new query to be created without an ID, got %+v", created)
+	}
+
+	// the archived data should never be modified by the restore
+	if restore.PQData[0].ID != "backup-id" {
+		t.Errorf("expected archived query to be untouched, got ID %s", restore.PQData[0].ID)
+	}
+}
+
+func TestRestorePQsHiddenTokens(t *testing.T) {
+	mockClient := mocks.NewMockConsulClient()
+	mockClient.PQData = []*consulapi.PreparedQueryDefinition{
+		{ID: "live-id", Name: "existing-query", Token: redactedToken, Service: consulapi.ServiceQuery{Service: "old"}},
+	}
+	c := consul.NewConsul(mockClient)
+
+	restore := &Restore{
+		PQData: []*consulapi.PreparedQueryDefinition{
+			{ID: "backup-id", Name: "existing-query", Token: redactedToken, Service: consulapi.ServiceQuery{Service: "new"}},
+			{ID: "new-id", Name: "new-query", Token: redactedToken},
+		},
+	}
+
+	restorePQs(restore, c)
+
+	if len(mockClient.PQData) != 2 {
+		t.Fatalf("expected 2 prepared queries after restore, got %d", len(mockClient.PQData))
+	}
+	if mockClient.PQData[0].Service.Service != "old" {
+		t.Errorf("expected a query whose live token is hidden to be left alone, got %+v", mockClient.PQData[0])
+	}
+	if mockClient.PQData[1].Token != "" {
+		t.Errorf("expected a new query to be created without the redacted token, got %s", mockClient.PQData[1].Token)
+	}
+}
+
+func TestRestorePQsErrors(t *testing.T) {
+	mockClient := mocks.NewMockConsulClient()
+	mockClient.CreatePQError = fmt.Errorf("permission denied")
+	c := consul.NewConsul(mockClient)
+
+	restore := &Restore{
+		PQData: []*consulapi.PreparedQueryDefinition{{ID: "a", Name: "query"}},
+	}
+
+	restorePQs(restore, c)
+
+	if len(mockClient.PQData) != 0 {
+		t.Errorf("expected no prepared queries to be created, got %d", len(mockClient.PQData))
+	}
+}
+
 func TestRestoreACLs(t *testing.T) {
 	// Test ACL restore logic
 	restore := &Restore{}
@@ -398,4 +491,1115 @@ func TestRestoreACLs(t *testing.T) {
 	}
 	
 	t.Logf("Would restore %d ACLs", len(restore.ACLData))
-}
\ No newline at end of file
+}
+
+func TestRestoreACLsKeepsIDs(t *testing.T) {
+	mockClient := mocks.NewMockConsulClient()
+	mockClient.ACLData = []*consulapi.ACLEntry{
+		{ID: "same", Name: "same", Type: "client", Rules: `key "" { policy = "read" }`},
+		{ID: "changed", Name: "changed", Type: "client", Rules: ""},
+	}
+	c := consul.NewConsul(mockClient)
+
+	restore := &Restore{
+		ACLData: []*consulapi.ACLEntry{
+			{ID: "same", Name: "same", Type: "client", Rules: `key "" { policy = "read" }`, CreateIndex: 10},
+			{ID: "changed", Name: "changed", Type: "client", Rules: `key "" { policy = "write" }`},
+			{ID: "missing", Name: "missing", Type: "management"},
+		},
+	}
+
+	restoreACLs(restore, c)
+
+	if len(mockClient.ACLData) != 3 {
+		t.Fatalf("expected 3 ACLs after restore, got %d", len(mockClient.ACLData))
+	}
+	if mockClient.ACLData[1].Rules != `key "" { policy = "write" }` {
+		t.Errorf("expected changed ACL to be updated, got rules %q", mockClient.ACLData[1].Rules)
+	}
+	if mockClient.ACLData[2].ID != "missing" {
+		t.Errorf("expected created ACL to keep its original ID, got %s", mockClient.ACLData[2].ID)
+	}
+}
+
+func TestRestoreACLSystem(t *testing.T) {
+	mockClient := mocks.NewMockConsulClient()
+	mockClient.ACLPolicyData = []*consulapi.ACLPolicy{
+		{ID: "00000000-0000-0000-0000-000000000001", Name: "global-management", Rules: "operator = \"write\""},
+	}
+	c := consul.NewConsul(mockClient)
+
+	restore := &Restore{
+		ACLSystem: &consul.ACLSystem{
+			Policies: []*consulapi.ACLPolicy{
+				{ID: "00000000-0000-0000-0000-000000000001", Name: "global-management", Rules: "operator = \"write\""},
+				{ID: "old-policy", Name: "readonly", Rules: "key_prefix \"\" { policy = \"read\" }"},
+			},
+			Roles: []*consulapi.ACLRole{
+				{ID: "old-role", Name: "readers", Policies: []*consulapi.ACLLink{{ID: "old-policy", Name: "readonly"}}},
+			},
+			Tokens: []*consulapi.ACLToken{
+				{
+					AccessorID: "accessor",
+					SecretID:   "secret",
+					Policies:   []*consulapi.ACLLink{{ID: "old-policy", Name: "readonly"}},
+					Roles:      []*consulapi.ACLLink{{ID: "old-role", Name: "readers"}},
+				},
+				{AccessorID: "login", SecretID: "login-secret", AuthMethod: "k8s"},
+			},
+			AuthMethods: []*consulapi.ACLAuthMethod{{Name: "k8s", Type: "kubernetes"}},
+			BindingRules: []*consulapi.ACLBindingRule{
+				{ID: "old-rule", AuthMethod: "k8s", BindType: consulapi.BindingRuleBindTypeRole, BindName: "readers"},
+			},
+		},
+	}
+
+	restoreACLSystem(restore, c)
+
+	if len(mockClient.ACLPolicyData) != 2 {
+		t.Fatalf("expected builtin policy to be left alone and 1 policy created, got %d policies", len(mockClient.ACLPolicyData))
+	}
+	newPolicyID := mockClient.ACLPolicyData[1].ID
+
+	if len(mockClient.ACLRoleData) != 1 || mockClient.ACLRoleData[0].Policies[0].ID != newPolicyID {
+		t.Errorf("expected role to link to the new policy ID %s, got %+v", newPolicyID, mockClient.ACLRoleData)
+	}
+	newRoleID := mockClient.ACLRoleData[0].ID
+
+	if len(mockClient.ACLTokenData) != 1 {
+		t.Fatalf("expected login token to be skipped, got %d tokens", len(mockClient.ACLTokenData))
+	}
+	token := mockClient.ACLTokenData[0]
+	if token.AccessorID != "accessor" || token.SecretID != "secret" {
+		t.Errorf("expected token to keep its IDs, got %s/%s", token.AccessorID, token.SecretID)
+	}
+	if token.Policies[0].ID != newPolicyID || token.Roles[0].ID != newRoleID {
+		t.Errorf("expected token links to be remapped, got policies %+v roles %+v", token.Policies[0], token.Roles[0])
+	}
+
+	if len(mockClient.ACLAuthMethodData) != 1 || len(mockClient.ACLBindingRuleData) != 1 {
+		t.Errorf("expected auth method and binding rule to be created")
+	}
+}
+
+func TestRestoreConfigEntries(t *testing.T) {
+	mockClient := mocks.NewMockConsulClient()
+	mockClient.ConfigEntryData = map[string][]consulapi.ConfigEntry{
+		consulapi.ServiceDefaults: {
+			&consulapi.ServiceConfigEntry{Kind: consulapi.ServiceDefaults, Name: "web", Protocol: "tcp"},
+		},
+	}
+	c := consul.NewConsul(mockClient)
+
+	restore := &Restore{
+		ConfigEntries: consul.ConfigEntries{
+			consulapi.ServiceDefaults: {
+				&consulapi.ServiceConfigEntry{Kind: consulapi.ServiceDefaults, Name: "web", Protocol: "http"},
+			},
+			consulapi.ServiceRouter: {
+				&consulapi.ServiceRouterConfigEntry{Kind: consulapi.ServiceRouter, Name: "web"},
+			},
+		},
+	}
+
+	restoreConfigEntries(restore, c)
+
+	web := mockClient.ConfigEntryData[consulapi.ServiceDefaults]
+	if len(web) != 1 || web[0].(*consulapi.ServiceConfigEntry).Protocol != "http" {
+		t.Errorf("expected service-defaults entry to be replaced, got %+v", web)
+	}
+	if len(mockClient.ConfigEntryData[consulapi.ServiceRouter]) != 1 {
+		t.Errorf("expected service-router entry to be created, got %+v", mockClient.ConfigEntryData)
+	}
+}
+
+func TestRestoreIntentions(t *testing.T) {
+	mockClient := mocks.NewMockConsulClient()
+	c := consul.NewConsul(mockClient)
+
+	restore := &Restore{
+		Intentions: []*consulapi.ServiceIntentionsConfigEntry{
+			{Name: "db", Sources: []*consulapi.SourceIntention{{Name: "web", Action: consulapi.IntentionActionAllow}}},
+			{Kind: consulapi.ServiceIntentions, Name: "web", Sources: []*consulapi.SourceIntention{{Name: "*", Action: consulapi.IntentionActionDeny}}},
+		},
+	}
+
+	restoreIntentions(restore, c)
+
+	if len(mockClient.IntentionData) != 2 {
+		t.Fatalf("expected intentions for 2 services, got %d", len(mockClient.IntentionData))
+	}
+	if mockClient.IntentionData[0].Kind != consulapi.ServiceIntentions {
+		t.Errorf("expected missing kind to be filled in, got %q", mockClient.IntentionData[0].Kind)
+	}
+
+	mockClient.SetIntentionsError = fmt.Errorf("permission denied")
+	restoreIntentions(restore, c)
+}
+
+func TestRestoreSnapshot(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "restore_snapshot")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	if err := ioutil.WriteFile(filepath.Join(tempDir, "consul.raft.1502901220.snap"), []byte("raft snapshot"), 0644); err != nil {
+		t.Fatalf("failed to write snapshot: %v", err)
+	}
+
+	mockClient := mocks.NewMockConsulClient()
+	c := consul.NewConsul(mockClient)
+	restore := &Restore{
+		ExtractedPath: tempDir,
+		Meta: &backup.Meta{
+			StartTime:  1502901220,
+			BackupMode: config.BackupModeNative,
+			RaftSha256: "0000000000000000000000000000000000000000000000000000000000000000",
+		},
+	}
+
+	if err := restoreSnapshot(restore, c); err == nil {
+		t.Error("expected a checksum mismatch to be refused")
+	}
+	if mockClient.RestoredSnapshot != nil {
+		t.Error("expected nothing to be restored on a checksum mismatch")
+	}
+
+	sum := sha256.Sum256([]byte("raft snapshot"))
+	restore.Meta.RaftSha256 = hex.EncodeToString(sum[:])
+	if err := restoreSnapshot(restore, c); err != nil {
+		t.Fatalf("restoreSnapshot failed: %v", err)
+	}
+	if string(mockClient.RestoredSnapshot) != "raft snapshot" {
+		t.Errorf("expected snapshot to be restored, got %q", mockClient.RestoredSnapshot)
+	}
+
+	restore.Meta.RaftSha256 = ""
+	if err := restoreSnapshot(restore, c); err == nil {
+		t.Error("expected an error for a backup without a native snapshot")
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	mockClient := mocks.NewMockConsulClient()
+	mockClient.KeyData = consulapi.KVPairs{
+		{Key: "same", Value: []byte("value")},
+		{Key: "changed", Value: []byte("old")},
+		{Key: "live-only", Value: []byte("untouched")},
+	}
+	mockClient.PQData = []*consulapi.PreparedQueryDefinition{
+		{ID: "live-pq", Name: "web", Service: consulapi.ServiceQuery{Service: "web"}},
+	}
+	mockClient.ACLData = []*consulapi.ACLEntry{{ID: "acl1", Name: "agent", Type: "client", Rules: "old"}}
+	c := consul.NewConsul(mockClient)
+
+	restore := &Restore{
+		RestorePath: "backups/test.tar.gz",
+		JSONData: consulapi.KVPairs{
+			{Key: "same", Value: []byte("value")},
+			{Key: "changed", Value: []byte("new value")},
+			{Key: "new", Value: []byte("created")},
+		},
+		PQData: []*consulapi.PreparedQueryDefinition{
+			{ID: "old-pq", Name: "web", Service: consulapi.ServiceQuery{Service: "web"}},
+			{ID: "other", Name: "db", Service: consulapi.ServiceQuery{Service: "db"}},
+		},
+		ACLData: []*consulapi.ACLEntry{{ID: "acl1", Name: "agent", Type: "client", Rules: "new"}},
+	}
+
+	result, err := dryRun(restore, c)
+	if err != nil {
+		t.Fatalf("dryRun failed: %v", err)
+	}
+
+	if result.KeyCounts != (ChangeCounts{Create: 1, Update: 1, Unchanged: 1}) {
+		t.Errorf("unexpected key counts %+v", result.KeyCounts)
+	}
+	changed := result.Keys[1]
+	if changed.Action != ActionUpdate || changed.LiveSize != 3 || changed.Size != 9 || changed.LiveSha256 == changed.Sha256 {
+		t.Errorf("unexpected change for updated key %+v", changed)
+	}
+	if result.PQCounts != (ChangeCounts{Create: 1, Unchanged: 1}) {
+		t.Errorf("unexpected prepared query counts %+v", result.PQCounts)
+	}
+	if result.ACLCounts != (ChangeCounts{Update: 1}) {
+		t.Errorf("unexpected ACL counts %+v", result.ACLCounts)
+	}
+
+	if len(mockClient.KeyData) != 3 || string(mockClient.KeyData[1].Value) != "old" {
+		t.Error("expected a dry run not to write any keys")
+	}
+
+	text := result.Text()
+	for _, expected := range []string{"Keys: 1 to create, 1 to update, 1 unchanged", "  + new (7 bytes)", "  ~ changed (3 -> 9 bytes", "  + db", "  ~ agent"} {
+		if !strings.Contains(text, expected) {
+			t.Errorf("expected dry run text to contain %q, got:\n%s", expected, text)
+		}
+	}
+	if strings.Contains(text, "same") {
+		t.Error("expected unchanged keys to be left out of the text report")
+	}
+}
+
+func TestReportDryRunJSON(t *testing.T) {
+	mockClient := mocks.NewMockConsulClient()
+	c := consul.NewConsul(mockClient)
+	restore := &Restore{JSONData: consulapi.KVPairs{{Key: "new", Value: []byte("created")}}}
+
+	ui := &cli.BasicUi{Writer: &bytes.Buffer{}, ErrorWriter: &bytes.Buffer{}}
+	if err := reportDryRun(restore, c, Options{DryRun: true, Format: "json", UI: ui}); err != nil {
+		t.Fatalf("reportDryRun failed: %v", err)
+	}
+
+	result := &DryRun{}
+	if err := json.Unmarshal(ui.Writer.(*bytes.Buffer).Bytes(), result); err != nil {
+		t.Fatalf("expected json dry run report: %v", err)
+	}
+	if len(result.Keys) != 1 || result.Keys[0].Action != ActionCreate {
+		t.Errorf("unexpected dry run report %+v", result)
+	}
+
+	mockClient.KeyError = fmt.Errorf("no leader")
+	if err := reportDryRun(restore, c, Options{DryRun: true, UI: ui}); err == nil {
+		t.Error("expected an error when the cluster cannot be listed")
+	}
+}
+
+func testingConfirmRestore(answer string) (*Restore, *consul.Consul, *mocks.MockConsulClient, *cli.BasicUi) {
+	mockClient := mocks.NewMockConsulClient()
+	mockClient.DatacenterName = "dc1"
+	mockClient.KeyData = consulapi.KVPairs{{Key: "changed", Value: []byte("old")}}
+	c := consul.NewConsul(mockClient)
+
+	restore := &Restore{
+		Config:      &config.Config{},
+		RestorePath: "backups/2017/8/16/web1.consul.snapshot.1502901220.tar.gz",
+		Meta:        &backup.Meta{Datacenter: "dc1", StartTime: 1502901220},
+		JSONData: consulapi.KVPairs{
+			{Key: "changed", Value: []byte("new")},
+			{Key: "created", Value: []byte("new")},
+		},
+	}
+	ui := &cli.BasicUi{
+		Reader:      strings.NewReader(answer + "\n"),
+		Writer:      &bytes.Buffer{},
+		ErrorWriter: &bytes.Buffer{},
+	}
+	return restore, c, mockClient, ui
+}
+
+func TestConfirmRestore(t *testing.T) {
+	restore, c, _, ui := testingConfirmRestore("yes")
+	if err := confirmRestore(restore, c, Options{UI: ui}, false); err != nil {
+		t.Fatalf("expected restore to be confirmed: %v", err)
+	}
+
+	output := ui.Writer.(*bytes.Buffer).String()
+	for _, expected := range []string{"datacenter dc1", "Backup host:      web1", "2 in backup, 1 will be overwritten, 1 created"} {
+		if !strings.Contains(output, expected) {
+			t.Errorf("expected summary to contain %q, got:\n%s", expected, output)
+		}
+	}
+
+	restore, c, _, ui = testingConfirmRestore("no")
+	if err := confirmRestore(restore, c, Options{UI: ui}, false); err != errAborted {
+		t.Errorf("expected restore to be aborted, got %v", err)
+	}
+}
+
+func TestConfirmRestoreForce(t *testing.T) {
+	restore, c, _, ui := testingConfirmRestore("")
+	if err := confirmRestore(restore, c, Options{UI: ui, Force: true}, false); err != nil {
+		t.Errorf("expected a forced restore not to ask: %v", err)
+	}
+	if strings.Contains(ui.Writer.(*bytes.Buffer).String(), "Only 'yes'") {
+		t.Error("expected no confirmation prompt for a forced restore")
+	}
+
+	if err := confirmRestore(restore, c, Options{}, false); err == nil {
+		t.Error("expected an error when there is no UI to confirm with")
+	}
+}
+
+func TestConfirmRestoreDatacenterMismatch(t *testing.T) {
+	restore, c, mockClient, ui := testingConfirmRestore("yes")
+	mockClient.DatacenterName = "dc2"
+
+	err := confirmRestore(restore, c, Options{UI: ui, Force: true}, false)
+	if err == nil || !strings.Contains(err.Error(), "-allow-datacenter-mismatch") {
+		t.Errorf("expected a datacenter mismatch to be refused, got %v", err)
+	}
+
+	if err := confirmRestore(restore, c, Options{UI: ui, Force: true, AllowDatacenterMismatch: true}, false); err != nil {
+		t.Errorf("expected the mismatch to be allowed: %v", err)
+	}
+
+	// indexes of another cluster can not be compared with the live ones
+	restore.OnConflict = ConflictSkipIfNewer
+	err = confirmRestore(restore, c, Options{UI: ui, Force: true, AllowDatacenterMismatch: true}, false)
+	if err == nil || !strings.Contains(err.Error(), ConflictSkipIfNewer) {
+		t.Errorf("expected skip-if-newer to be refused for another datacenter, got %v", err)
+	}
+
+	// an unknown target datacenter is no match either
+	mockClient.DatacenterError = fmt.Errorf("connection refused")
+	err = confirmRestore(restore, c, Options{UI: ui, Force: true, AllowDatacenterMismatch: true}, false)
+	if err == nil || !strings.Contains(err.Error(), "could not be determined") {
+		t.Errorf("expected skip-if-newer to be refused for an unknown datacenter, got %v", err)
+	}
+	restore.OnConflict = ""
+	err = confirmRestore(restore, c, Options{UI: ui, Force: true}, false)
+	if err == nil || !strings.Contains(err.Error(), "could not be determined") || !strings.Contains(err.Error(), "-allow-datacenter-mismatch") {
+		t.Errorf("expected an unknown datacenter to be refused, got %v", err)
+	}
+	if err := confirmRestore(restore, c, Options{UI: ui, Force: true, AllowDatacenterMismatch: true}, false); err != nil {
+		t.Errorf("expected an unknown datacenter to be allowed: %v", err)
+	}
+	mockClient.DatacenterError = nil
+
+	// backups from before the datacenter was recorded can not be checked
+	restore.Meta.Datacenter = ""
+	if err := confirmRestore(restore, c, Options{UI: ui, Force: true}, false); err != nil {
+		t.Errorf("expected a backup without a datacenter to be allowed: %v", err)
+	}
+}
+
+func TestApplyKVFilter(t *testing.T) {
+	restore := &Restore{
+		JSONData: consulapi.KVPairs{
+			{Key: "service/payments/config", Value: []byte("a")},
+			{Key: "service/payments/tmp/lock", Value: []byte("b")},
+			{Key: "service/web/config", Value: []byte("c")},
+		},
+		PQData:  []*consulapi.PreparedQueryDefinition{{Name: "web"}},
+		ACLData: []*consulapi.ACLEntry{{ID: "acl1"}},
+	}
+
+	restore.applyKVFilter(&filter.KV{
+		IncludePrefixes: []string{"service/payments/"},
+		ExcludePrefixes: []string{"service/payments/tmp/"},
+	})
+
+	if len(restore.JSONData) != 1 || restore.JSONData[0].Key != "service/payments/config" {
+		t.Errorf("expected only the selected key to be left, got %+v", restore.JSONData)
+	}
+	if restore.FilteredKeys != 2 {
+		t.Errorf("expected 2 keys to be filtered out, got %d", restore.FilteredKeys)
+	}
+	if restore.PQData != nil || restore.ACLData != nil {
+		t.Error("expected a partial restore to skip prepared queries and ACLs")
+	}
+
+	mockClient := mocks.NewMockConsulClient()
+	result, err := dryRun(restore, consul.NewConsul(mockClient))
+	if err != nil {
+		t.Fatalf("dryRun failed: %v", err)
+	}
+	if !strings.Contains(result.Text(), "Keys: 1 to create, 0 to update, 0 unchanged, 2 filtered out") {
+		t.Errorf("expected filtered count in the dry run, got:\n%s", result.Text())
+	}
+}
+
+func TestApplyKVFilterExcludeOnly(t *testing.T) {
+	restore := &Restore{
+		JSONData: consulapi.KVPairs{
+			{Key: "service/payments/config", Value: []byte("a")},
+			{Key: "service/payments/tmp/lock", Value: []byte("b")},
+		},
+		PQData:  []*consulapi.PreparedQueryDefinition{{Name: "web"}},
+		ACLData: []*consulapi.ACLEntry{{ID: "acl1"}},
+	}
+
+	restore.applyKVFilter(&filter.KV{ExcludePrefixes: []string{"service/payments/tmp/"}})
+
+	if len(restore.JSONData) != 1 || restore.FilteredKeys != 1 {
+		t.Errorf("expected the excluded key to be filtered out, got %+v", restore.JSONData)
+	}
+	if len(restore.PQData) != 1 || len(restore.ACLData) != 1 {
+		t.Error("expected excluding prefixes to still restore prepared queries and ACLs")
+	}
+}
+
+func testingMirrorRestore() (*Restore, *consul.Consul, *mocks.MockConsulClient) {
+	mockClient := mocks.NewMockConsulClient()
+	mockClient.KeyData = consulapi.KVPairs{
+		{Key: "service/db/config", Value: []byte("db")},
+		{Key: "service/web/config", Value: []byte("old")},
+		{Key: "service/web/added", Value: []byte("after backup")},
+		{Key: "stale/one", Value: []byte("1")},
+		{Key: "stale/two", Value: []byte("2")},
+		{Key: "team/other", Value: []byte("other")},
+	}
+	c := consul.NewConsul(mockClient)
+
+	restore := &Restore{
+		Config:      &config.Config{},
+		RestorePath: "backups/test.tar.gz",
+		Meta:        &backup.Meta{},
+		Mirror:      true,
+		KVFilter:    filter.KV{IncludePrefixes: []string{"service/", "stale/"}},
+		JSONData: consulapi.KVPairs{
+			{Key: "service/db/config", Value: []byte("db")},
+			{Key: "service/web/config", Value: []byte("new")},
+		},
+	}
+	return restore, c, mockClient
+}
+
+func TestMirrorDryRun(t *testing.T) {
+	restore, c, mockClient := testingMirrorRestore()
+
+	result, err := dryRun(restore, c)
+	if err != nil {
+		t.Fatalf("dryRun failed: %v", err)
+	}
+	if result.Mode != ModeMirror || result.KeyCounts != (ChangeCounts{Update: 1, Unchanged: 1, Delete: 3}) {
+		t.Errorf("unexpected mirror dry run %v %+v", result.Mode, result.KeyCounts)
+	}
+	if len(mockClient.DeletedKeys) != 0 || len(mockClient.KeyData) != 6 {
+		t.Error("expected a dry run not to delete any keys")
+	}
+
+	text := result.Text()
+	for _, expected := range []string{"3 to delete", "  - service/web/added (12 bytes)", "  - stale/one"} {
+		if !strings.Contains(text, expected) {
+			t.Errorf("expected dry run text to contain %q, got:\n%s", expected, text)
+		}
+	}
+	if strings.Contains(text, "team/other") {
+		t.Errorf("expected keys outside the restored prefixes to be left alone, got:\n%s", text)
+	}
+}
+
+func TestDeleteMirroredKeys(t *testing.T) {
+	restore, c, mockClient := testingMirrorRestore()
+
+	if err := deleteMirroredKeys(restore, c); err != nil {
+		t.Fatalf("deleteMirroredKeys failed: %v", err)
+	}
+
+	expected := []string{"service/web/added", "stale/one", "stale/two"}
+	if !reflect.DeepEqual(mockClient.DeletedKeys, expected) {
+		t.Errorf("expected %v to be deleted, got %v", expected, mockClient.DeletedKeys)
+	}
+	if len(mockClient.KeyData) != 3 {
+		t.Errorf("expected 3 keys to be left, got %v", len(mockClient.KeyData))
+	}
+}
+
+func TestDeleteMirroredKeysErrors(t *testing.T) {
+	restore, c, mockClient := testingMirrorRestore()
+	mockClient.DeleteKVError = fmt.Errorf("permission denied")
+
+	if err := deleteMirroredKeys(restore, c); err == nil {
+		t.Error("expected an error when keys can not be deleted")
+	}
+}
+
+func TestMirrorScopeOfPartialBackup(t *testing.T) {
+	restore, c, mockClient := testingMirrorRestore()
+	restore.KVFilter = filter.KV{}
+	restore.Meta.KVFilter = &filter.KV{IncludePrefixes: []string{"service/web/"}}
+
+	if err := deleteMirroredKeys(restore, c); err != nil {
+		t.Fatalf("deleteMirroredKeys failed: %v", err)
+	}
+	if len(mockClient.DeletedKeys) != 1 || mockClient.DeletedKeys[0] != "service/web/added" {
+		t.Errorf("expected only keys the backup captured to be mirrored, got %v", mockClient.DeletedKeys)
+	}
+}
+
+func TestConfirmMirrorRestore(t *testing.T) {
+	restore, c, mockClient, ui := testingConfirmRestore("yes")
+	restore.Mirror = true
+	mockClient.KeyData = append(mockClient.KeyData, &consulapi.KVPair{Key: "gone", Value: []byte("x")})
+
+	if err := confirmRestore(restore, c, Options{UI: ui}, false); err != nil {
+		t.Fatalf("expected restore to be confirmed: %v", err)
+	}
+	output := ui.Writer.(*bytes.Buffer).String()
+	if !strings.Contains(output, "1 keys not in the backup will be DELETED") {
+		t.Errorf("expected the summary to warn about deletes, got:\n%s", output)
+	}
+}
+
+func TestRestoreKVTxn(t *testing.T) {
+	txnRetryWait = 0
+	mockClient := mocks.NewMockConsulClient()
+	mockClient.TxnFailures = 1
+	mockClient.TxnError = fmt.Errorf("connection reset")
+	c := consul.NewConsul(mockClient)
+
+	restore := &Restore{}
+	for i := 0; i < txnBatchSize*2+1; i++ {
+		restore.JSONData = append(restore.JSONData, &consulapi.KVPair{Key: fmt.Sprintf("key%03d", i), Value: []byte("value")})
+	}
+
+	restore.KVWrites = restore.JSONData
+	restoreKVTxn(restore, c)
+
+	// three batches, the first of which is retried once
+	if len(mockClient.Txns) != 4 {
+		t.Errorf("expected 4 transactions, got %v", len(mockClient.Txns))
+	}
+	if len(mockClient.Txns[0]) != txnBatchSize || len(mockClient.Txns[3]) != 1 {
+		t.Errorf("unexpected batch sizes %v and %v", len(mockClient.Txns[0]), len(mockClient.Txns[3]))
+	}
+	if len(mockClient.KeyData) != len(restore.JSONData) {
+		t.Errorf("expected %v keys to be restored, got %v", len(restore.JSONData), len(mockClient.KeyData))
+	}
+}
+
+func TestRestoreKVTxnGivesUp(t *testing.T) {
+	txnRetryWait = 0
+	mockClient := mocks.NewMockConsulClient()
+	mockClient.TxnFailures = txnAttempts
+	c := consul.NewConsul(mockClient)
+
+	restore := &Restore{KVWrites: consulapi.KVPairs{{Key: "a", Value: []byte("1")}}}
+	restoreKVTxn(restore, c)
+
+	if len(mockClient.Txns) != txnAttempts || len(mockClient.KeyData) != 0 {
+		t.Errorf("expected %v attempts and no keys, got %v attempts and %v keys",
+			txnAttempts, len(mockClient.Txns), len(mockClient.KeyData))
+	}
+}
+
+func TestRestoreKVTxnPermanentErrors(t *testing.T) {
+	txnRetryWait = 0
+	mockClient := mocks.NewMockConsulClient()
+	mockClient.TxnFailures = txnAttempts
+	mockClient.TxnError = fmt.Errorf("Failed request: Request body(600000 bytes) too large, max size: 524288 bytes")
+	c := consul.NewConsul(mockClient)
+
+	restore := &Restore{KVWrites: consulapi.KVPairs{{Key: "a", Value: []byte("1")}}}
+	if failed := restoreKVTxn(restore, c); failed != 1 {
+		t.Errorf("expected the key to fail, got %v failed keys", failed)
+	}
+	if len(mockClient.Txns) != 1 {
+		t.Errorf("expected a request consul refuses not to be retried, got %v attempts", len(mockClient.Txns))
+	}
+}
+
+func TestRestoreKVTxnUnknownStaleOp(t *testing.T) {
+	txnRetryWait = 0
+	mockClient := mocks.NewMockConsulClient()
+	mockClient.TxnRollback = &consulapi.TxnResponse{Errors: consulapi.TxnErrors{
+		{OpIndex: 5, What: "failed to set key, index is stale"},
+	}}
+	c := consul.NewConsul(mockClient)
+
+	restore := &Restore{KVWrites: consulapi.KVPairs{{Key: "a", Value: []byte("1")}}}
+	if failed := restoreKVTxn(restore, c); failed != 1 {
+		t.Errorf("expected the key to fail, got %v failed keys", failed)
+	}
+	if len(mockClient.Txns) != 1 {
+		t.Errorf("expected a stale operation outside the batch not to resend it, got %v attempts", len(mockClient.Txns))
+	}
+}
+
+func TestTxnBatches(t *testing.T) {
+	var keys consulapi.KVPairs
+	for i := 0; i < 5; i++ {
+		keys = append(keys, &consulapi.KVPair{Key: fmt.Sprintf("big%v", i), Value: make([]byte, 100*1024)})
+	}
+	keys = append(keys, &consulapi.KVPair{Key: "huge", Value: make([]byte, txnBatchBytes+1)})
+	keys = append(keys, &consulapi.KVPair{Key: "small", Value: []byte("x")})
+
+	var sizes []int
+	for _, batch := range txnBatches(keys) {
+		sizes = append(sizes, len(batch.Keys))
+	}
+	if !reflect.DeepEqual(sizes, []int{2, 2, 1, 1, 1}) {
+		t.Errorf("expected batches to be split by size, got %v", sizes)
+	}
+}
+
+func TestBatchNumbers(t *testing.T) {
+	var batches []*txnBatch
+	for _, number := range []int{1, 2, 3, 5, 7, 8} {
+		batches = append(batches, &txnBatch{Number: number})
+	}
+	if got := batchNumbers(batches); got != "1-3, 5, 7-8" {
+		t.Errorf("unexpected batch numbers %q", got)
+	}
+	if got := batchNumbers(nil); got != "none" {
+		t.Errorf("unexpected batch numbers %q", got)
+	}
+}
+
+func TestTxnError(t *testing.T) {
+	ops := consulapi.KVTxnOps{{Verb: consulapi.KVSet, Key: "big"}}
+	resp := &consulapi.TxnResponse{Errors: consulapi.TxnErrors{{OpIndex: 0, What: "value too large"}}}
+	if err := txnError(resp, ops); err == nil || !strings.Contains(err.Error(), "big: value too large") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func testingConflictRestore(policy string) (*Restore, *consul.Consul, *mocks.MockConsulClient) {
+	mockClient := mocks.NewMockConsulClient()
+	mockClient.KeyData = consulapi.KVPairs{
+		{Key: "same", Value: []byte("value"), ModifyIndex: 10},
+		{Key: "older", Value: []byte("live"), ModifyIndex: 5},
+		{Key: "newer", Value: []byte("live"), ModifyIndex: 50},
+	}
+	c := consul.NewConsul(mockClient)
+
+	restore := &Restore{
+		OnConflict: policy,
+		JSONData: consulapi.KVPairs{
+			{Key: "same", Value: []byte("value"), ModifyIndex: 10},
+			{Key: "older", Value: []byte("backup"), ModifyIndex: 20},
+			{Key: "newer", Value: []byte("backup"), ModifyIndex: 20},
+			{Key: "created", Value: []byte("backup"), ModifyIndex: 20},
+		},
+	}
+	return restore, c, mockClient
+}
+
+func TestPlanKV(t *testing.T) {
+	cases := []struct {
+		policy  string
+		written []string
+		actions []string
+	}{
+		{ConflictOverwrite, []string{"same", "older", "newer", "created"}, []string{ConflictOverwritten, ConflictOverwritten}},
+		{ConflictSkipExisting, []string{"created"}, []string{ConflictSkipped, ConflictSkipped}},
+		{ConflictSkipIfNewer, []string{"same", "older", "created"}, []string{ConflictOverwritten, ConflictSkipped}},
+	}
+
+	for _, tc := range cases {
+		restore, c, _ := testingConflictRestore(tc.policy)
+		if err := planKV(restore, c); err != nil {
+			t.Fatalf("%s: planKV failed: %v", tc.policy, err)
+		}
+
+		var written []string
+		for _, kv := range restore.KVWrites {
+			written = append(written, kv.Key)
+		}
+		if !reflect.DeepEqual(written, tc.written) {
+			t.Errorf("%s: expected to write %v, got %v", tc.policy, tc.written, written)
+		}
+
+		if len(restore.Conflicts) != 2 {
+			t.Fatalf("%s: expected 2 conflicts, got %+v", tc.policy, restore.Conflicts)
+		}
+		if restore.Conflicts[0].Reason != ReasonDifferent || restore.Conflicts[1].Reason != ReasonNewer {
+			t.Errorf("%s: unexpected conflict reasons %+v", tc.policy, restore.Conflicts)
+		}
+		for i, action := range tc.actions {
+			if restore.Conflicts[i].Action != action {
+				t.Errorf("%s: expected %s to be %s, got %s", tc.policy, restore.Conflicts[i].Key, action, restore.Conflicts[i].Action)
+			}
+		}
+	}
+}
+
+func TestKeyConflictFlags(t *testing.T) {
+	kv := &consulapi.KVPair{Key: "a", Value: []byte("value"), Flags: 1, ModifyIndex: 10}
+	live := &consulapi.KVPair{Key: "a", Value: []byte("value"), Flags: 2, ModifyIndex: 5}
+	if reason := keyConflict(kv, live); reason != ReasonDifferent {
+		t.Errorf("expected different flags to conflict, got %q", reason)
+	}
+	live.Flags = 1
+	if reason := keyConflict(kv, live); reason != "" {
+		t.Errorf("expected the same value and flags not to conflict, got %q", reason)
+	}
+}
+
+func TestCheckConflicts(t *testing.T) {
+	restore, c, _ := testingConflictRestore(ConflictFail)
+	if err := planKV(restore, c); err != nil {
+		t.Fatalf("planKV failed: %v", err)
+	}
+	if err := checkConflicts(restore); err == nil || !strings.Contains(err.Error(), "2 keys conflict") {
+		t.Errorf("expected the fail policy to refuse the restore, got %v", err)
+	}
+
+	restore.OnConflict = ConflictOverwrite
+	if err := checkConflicts(restore); err != nil {
+		t.Errorf("expected overwrite to allow conflicts, got %v", err)
+	}
+}
+
+func TestRestoreKVChangedDuringRestore(t *testing.T) {
+	for _, txn := range []bool{false, true} {
+		restore, c, mockClient := testingConflictRestore(ConflictOverwrite)
+		if err := planKV(restore, c); err != nil {
+			t.Fatalf("planKV failed: %v", err)
+		}
+
+		// someone writes a key between the plan and the restore
+		mockClient.KeyData[0].ModifyIndex = 11
+
+		if txn {
+			restoreKVTxn(restore, c)
+		} else {
+			restoreKV(restore, c)
+		}
+
+		changed := restore.Conflicts[len(restore.Conflicts)-1]
+		if changed.Key != "same" || changed.Reason != ReasonChanged || changed.Action != ConflictNotWritten {
+			t.Errorf("txn %v: expected same to be reported as changed during the restore, got %+v", txn, changed)
+		}
+		for _, kv := range mockClient.KeyData {
+			if kv.Key == "same" && kv.ModifyIndex != 11 {
+				t.Errorf("txn %v: expected the concurrent write to survive", txn)
+			}
+			if kv.Key == "newer" && string(kv.Value) != "backup" {
+				t.Errorf("txn %v: expected the rest of the keys to be restored", txn)
+			}
+		}
+	}
+}
+
+func TestRestoreKVPreservesFlags(t *testing.T) {
+	for _, txn := range []bool{false, true} {
+		mockClient := mocks.NewMockConsulClient()
+		mockClient.KeyData = consulapi.KVPairs{{Key: "config", Value: []byte("{}"), ModifyIndex: 3}}
+		c := consul.NewConsul(mockClient)
+
+		restore := &Restore{
+			OnConflict: ConflictOverwrite,
+			JSONData: consulapi.KVPairs{
+				{Key: "config", Value: []byte("{}"), Flags: 42},
+				{Key: "created", Value: []byte("yes"), Flags: 7},
+			},
+		}
+		if err := planKV(restore, c); err != nil {
+			t.Fatalf("planKV failed: %v", err)
+		}
+		if txn {
+			restoreKVTxn(restore, c)
+		} else {
+			restoreKV(restore, c)
+		}
+
+		flags := make(map[string]uint64)
+		for _, kv := range mockClient.KeyData {
+			flags[kv.Key] = kv.Flags
+		}
+		if flags["config"] != 42 || flags["created"] != 7 {
+			t.Errorf("txn %v: expected flags to be restored, got %v", txn, flags)
+		}
+	}
+}
+
+func TestDryRunFlags(t *testing.T) {
+	mockClient := mocks.NewMockConsulClient()
+	mockClient.KeyData = consulapi.KVPairs{{Key: "config", Value: []byte("{}"), Flags: 1}}
+	c := consul.NewConsul(mockClient)
+
+	restore := &Restore{JSONData: consulapi.KVPairs{{Key: "config", Value: []byte("{}"), Flags: 2}}}
+	result, err := dryRun(restore, c)
+	if err != nil {
+		t.Fatalf("dryRun failed: %v", err)
+	}
+	if result.Keys[0].Action != ActionUpdate {
+		t.Errorf("expected a flags change to be an update, got %v", result.Keys[0].Action)
+	}
+	if !strings.Contains(result.Text(), "flags 1 -> 2") {
+		t.Errorf("expected the flags change in the text report, got:\n%s", result.Text())
+	}
+}
+
+func TestLockedKeys(t *testing.T) {
+	restore, c, _, ui := testingConfirmRestore("yes")
+	restore.WarnLocks = true
+	restore.JSONData[0].Session = "adf4238a-882b-9ddc-4a9d-5b6758e4159e"
+	restore.JSONData[0].LockIndex = 3
+
+	locked := restore.lockedKeys()
+	if len(locked) != 1 || locked[0].Key != "changed" {
+		t.Errorf("expected changed to be locked, got %v", locked)
+	}
+
+	if err := confirmRestore(restore, c, Options{UI: ui}, false); err != nil {
+		t.Fatalf("expected restore to be confirmed: %v", err)
+	}
+	if !strings.Contains(ui.Writer.(*bytes.Buffer).String(), "1 were held by a session at backup time") {
+		t.Errorf("expected the summary to warn about locked keys, got:\n%s", ui.Writer.(*bytes.Buffer).String())
+	}
+}
+
+func TestApplyRewrite(t *testing.T) {
+	restore := &Restore{
+		RestorePath: "backups/test.tar.gz",
+		JSONData: consulapi.KVPairs{
+			{Key: "prod/web/config", Value: []byte("web")},
+			{Key: "prod/secrets/db", Value: []byte("secret")},
+			{Key: "global", Value: []byte("global")},
+		},
+	}
+	rules := rewrite.Rules{
+		{From: "prod/secrets/", Drop: true},
+		{From: "prod/", To: "staging/"},
+	}
+
+	if err := restore.applyRewrite(rules); err != nil {
+		t.Fatalf("applyRewrite failed: %v", err)
+	}
+	if len(restore.JSONData) != 2 || restore.JSONData[0].Key != "staging/web/config" || restore.JSONData[1].Key != "global" {
+		t.Errorf("unexpected keys after rewrite %v", restore.JSONData)
+	}
+
+	expected := []KeyRewrite{
+		{Key: "prod/web/config", NewKey: "staging/web/config"},
+		{Key: "prod/secrets/db", Dropped: true},
+	}
+	if !reflect.DeepEqual(restore.Rewrites, expected) {
+		t.Errorf("unexpected rewrites %+v", restore.Rewrites)
+	}
+
+	result := &DryRun{RestorePath: restore.RestorePath, Rewrites: restore.Rewrites}
+	text := result.Text()
+	for _, line := range []string{"  prod/web/config -> staging/web/config", "  prod/secrets/db dropped"} {
+		if !strings.Contains(text, line) {
+			t.Errorf("expected dry run text to contain %q, got:\n%s", line, text)
+		}
+	}
+}
+
+func TestApplyRewriteCollision(t *testing.T) {
+	restore := &Restore{
+		JSONData: consulapi.KVPairs{
+			{Key: "prod/config", Value: []byte("prod")},
+			{Key: "staging/config", Value: []byte("staging")},
+		},
+	}
+	err := restore.applyRewrite(rewrite.Rules{{From: "prod/", To: "staging/"}})
+	if err == nil || !strings.Contains(err.Error(), "to staging/config") {
+		t.Errorf("expected rewrites onto the same key to be refused, got %v", err)
+	}
+}
+
+func TestRestoreKVConcurrent(t *testing.T) {
+	txnRetryWait = 0
+	for _, txn := range []bool{false, true} {
+		mockClient := mocks.NewMockConsulClient()
+		c := consul.NewConsul(mockClient)
+
+		restore := &Restore{OnConflict: ConflictOverwrite, Concurrency: 4, Rate: 10000}
+		for i := 0; i < 300; i++ {
+			restore.JSONData = append(restore.JSONData, &consulapi.KVPair{Key: fmt.Sprintf("key%03d", i), Value: []byte("value")})
+		}
+		if err := planKV(restore, c); err != nil {
+			t.Fatalf("planKV failed: %v", err)
+		}
+
+		if txn {
+			restoreKVTxn(restore, c)
+		} else {
+			restoreKV(restore, c)
+		}
+		if len(mockClient.KeyData) != 300 {
+			t.Errorf("txn %v: expected 300 keys to be restored, got %v", txn, len(mockClient.KeyData))
+		}
+	}
+}
+
+func TestProgress(t *testing.T) {
+	p := &progress{what: "keys", total: 100, start: time.Now().Add(-10 * time.Second)}
+	if got := p.String(); got != "Restored 0 of 100 keys" {
+		t.Errorf("unexpected progress %q", got)
+	}
+
+	p.add(25)
+	if got := p.String(); !strings.Contains(got, "Restored 25 of 100 keys (25%, 2 keys/s, ETA 30s)") {
+		t.Errorf("unexpected progress %q", got)
+	}
+}
+
+func TestRestoreJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	restore, c, mockClient := testingConflictRestore(ConflictOverwrite)
+	restore.RestorePath = "backups/test.tar.gz"
+	restore.Meta = &backup.Meta{KVSha256: "abcd"}
+	if err := planKV(restore, c); err != nil {
+		t.Fatalf("planKV failed: %v", err)
+	}
+
+	// the restore is interrupted after the first two keys
+	path := journalPath(dir, 1502901220)
+	if restore.journal, err = createJournal(path, restore); err != nil {
+		t.Fatalf("createJournal failed: %v", err)
+	}
+	restore.KVWrites = restore.KVWrites[:2]
+	restoreKV(restore, c)
+	restore.journal.finish(1)
+
+	if restorePath, err := JournalRestorePath(path); err != nil || restorePath != "backups/test.tar.gz" {
+		t.Errorf("expected the journal to record the backup, got %q %v", restorePath, err)
+	}
+
+	resumed, _, _ := testingConflictRestore(ConflictOverwrite)
+	resumed.Meta = &backup.Meta{KVSha256: "abcd"}
+	resumed.KVWrites = nil
+	if err := planKV(resumed, consul.NewConsul(mockClient)); err != nil {
+		t.Fatalf("planKV failed: %v", err)
+	}
+	if err := resumeJournal(resumed, path); err != nil {
+		t.Fatalf("resumeJournal failed: %v", err)
+	}
+	if resumed.ResumedKeys != 2 || len(resumed.KVWrites) != 2 || resumed.KVWrites[0].Key != "newer" {
+		t.Errorf("expected the last 2 keys to be left, got %v resumed and %v", resumed.ResumedKeys, resumed.KVWrites)
+	}
+
+	resumed.Meta.KVSha256 = "other"
+	if err := resumeJournal(resumed, path); err == nil || !strings.Contains(err.Error(), "key checksum abcd") {
+		t.Errorf("expected a journal for another backup to be refused, got %v", err)
+	}
+}
+
+func TestRestoreJournalRemovedWhenComplete(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	restore := &Restore{Meta: &backup.Meta{}}
+	path := journalPath(dir, 1)
+	j, err := createJournal(path, restore)
+	if err != nil {
+		t.Fatalf("createJournal failed: %v", err)
+	}
+	j.record("a", "b")
+	j.finish(0)
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected a complete restore to remove its journal, got %v", err)
+	}
+}
+
+func TestVerifyRestore(t *testing.T) {
+	restore, c, mockClient := testingConflictRestore(ConflictSkipIfNewer)
+	if err := planKV(restore, c); err != nil {
+		t.Fatalf("planKV failed: %v", err)
+	}
+
+	// nothing written yet, older differs and created is missing, newer was
+	// skipped by the policy and is not checked
+	result, err := verifyRestore(restore, c)
+	if err != nil {
+		t.Fatalf("verifyRestore failed: %v", err)
+	}
+	if result.Checked != 3 {
+		t.Errorf("expected 3 keys to be checked, got %v", result.Checked)
+	}
+	if !reflect.DeepEqual(result.Missing, []string{"created"}) {
+		t.Errorf("expected created to be missing, got %v", result.Missing)
+	}
+	if !reflect.DeepEqual(result.Different, []string{"older"}) {
+		t.Errorf("expected older to differ, got %v", result.Different)
+	}
+	if err := reportVerification(result); err == nil {
+		t.Error("expected a failed verification to return an error")
+	}
+
+	restore.Concurrency = 1
+	if failed := restoreKV(restore, c); failed != 0 {
+		t.Fatalf("expected no failed keys, got %v", failed)
+	}
+	result, err = verifyRestore(restore, c)
+	if err != nil {
+		t.Fatalf("verifyRestore failed: %v", err)
+	}
+	if result.Failed() {
+		t.Errorf("expected the restore to verify, got %+v", result)
+	}
+	if err := reportVerification(result); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+
+	mockClient.KeyError = fmt.Errorf("no leader")
+	if _, err := verifyRestore(restore, c); err == nil {
+		t.Error("expected an error when keys can not be listed")
+	}
+}
+
+func TestVerifyMirrorRestore(t *testing.T) {
+	restore, c, _ := testingMirrorRestore()
+	if err := planKV(restore, c); err != nil {
+		t.Fatalf("planKV failed: %v", err)
+	}
+	restore.Concurrency = 1
+	restoreKV(restore, c)
+
+	result, err := verifyRestore(restore, c)
+	if err != nil {
+		t.Fatalf("verifyRestore failed: %v", err)
+	}
+	expected := []string{"service/web/added", "stale/one", "stale/two"}
+	if !reflect.DeepEqual(result.Unexpected, expected) {
+		t.Errorf("expected unexpected keys %v, got %v", expected, result.Unexpected)
+	}
+
+	if err := deleteMirroredKeys(restore, c); err != nil {
+		t.Fatalf("deleteMirroredKeys failed: %v", err)
+	}
+	result, err = verifyRestore(restore, c)
+	if err != nil {
+		t.Fatalf("verifyRestore failed: %v", err)
+	}
+	if result.Failed() {
+		t.Errorf("expected the mirror restore to verify, got %+v", result)
+	}
+}
+
+func TestReplayChain(t *testing.T) {
+	full := &Restore{JSONData: consulapi.KVPairs{
+		{Key: "a", Value: []byte("1")},
+		{Key: "b", Value: []byte("2")},
+		{Key: "c", Value: []byte("3")},
+	}}
+	first := &Restore{
+		JSONData:   consulapi.KVPairs{{Key: "b", Value: []byte("changed")}},
+		Tombstones: []string{"c"},
+	}
+	second := &Restore{
+		JSONData:   consulapi.KVPairs{{Key: "c", Value: []byte("again")}},
+		Tombstones: []string{"a"},
+	}
+
+	keys := replayChain([]*Restore{second, first, full})
+	expected := map[string]string{"b": "changed", "c": "again"}
+	if len(keys) != len(expected) {
+		t.Fatalf("expected %v keys, got %v", len(expected), len(keys))
+	}
+	for _, kv := range keys {
+		if expected[kv.Key] != string(kv.Value) {
+			t.Errorf("expected %s to be %q, got %q", kv.Key, expected[kv.Key], kv.Value)
+		}
+	}
+}
+
+func TestLoadTombstones(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tombstones")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := &Restore{ExtractedPath: dir, Meta: &backup.Meta{StartTime: 1, TombstonesSha256: "abc"}}
+	if err := r.loadTombstones(); err == nil {
+		t.Error("expected an error for a missing tombstones file")
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "consul.tombstones.1.json"), []byte(`["a","b"]`), 0644); err != nil {
+		t.Fatalf("Unable to write tombstones: %v", err)
+	}
+	if err := r.loadTombstones(); err != nil {
+		t.Fatalf("loadTombstones failed: %v", err)
+	}
+	if !reflect.DeepEqual(r.Tombstones, []string{"a", "b"}) {
+		t.Errorf("unexpected tombstones %v", r.Tombstones)
+	}
+}
@@ -0,0 +1,255 @@
+package restore
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/pshima/consul-snapshot/consul"
+	"golang.org/x/time/rate"
+)
+
+// txnBatchSize is the most operations consul accepts in one transaction
+const txnBatchSize = 64
+
+// txnBatchBytes bounds the size of the keys and values in one transaction.
+// consul refuses transactions over 512KB by default and values are base64
+// encoded in the request, which makes them a third larger.
+const txnBatchBytes = 256 * 1024
+
+// permanentTxnErrors are failed requests that fail the same way every time
+// they are retried
+var permanentTxnErrors = []string{"too large", "too many operations"}
+
+// txnAttempts is how many times a batch is tried before it is given up on
+const txnAttempts = 3
+
+// txnRetryWait is the wait before the first retry of a batch, it doubles
+// with every retry
+var txnRetryWait = time.Second
+
+// txnBatch is one transaction of a transactional restore
+type txnBatch struct {
+	Number int
+	Keys   consulapi.KVPairs
+}
+
+// first and last keys in the batch, to find it in the report
+func (b *txnBatch) String() string {
+	return fmt.Sprintf("%v (%s .. %s)", b.Number, b.Keys[0].Key, b.Keys[len(b.Keys)-1].Key)
+}
+
+// txnBatches splits keys in to batches of at most txnBatchSize keys and
+// txnBatchBytes of keys and values, numbered from 1.  A key larger than
+// txnBatchBytes is written in a batch of its own.
+func txnBatches(keys consulapi.KVPairs) []*txnBatch {
+	var batches []*txnBatch
+	start, size := 0, 0
+	for i, kv := range keys {
+		kvSize := len(kv.Key) + len(kv.Value)
+		if i > start && (i-start == txnBatchSize || size+kvSize > txnBatchBytes) {
+			batches = append(batches, &txnBatch{Number: len(batches) + 1, Keys: keys[start:i]})
+			start, size = i, 0
+		}
+		size += kvSize
+	}
+	if start < len(keys) {
+		batches = append(batches, &txnBatch{Number: len(batches) + 1, Keys: keys[start:]})
+	}
+	return batches
+}
+
+// restoreKVTxn writes the restored keys in transactions, so every batch is
+// either written completely or not at all.  Batches are written from
+// Concurrency workers at up to Rate transactions per second, batches that
+// fail are retried, and the report lists exactly which batches committed.
+// It returns how many keys were in batches that failed.
+func restoreKVTxn(r *Restore, c *consul.Consul) int {
+	batches := txnBatches(r.KVWrites)
+	written := make([]int, len(batches))
+	errs := make([]error, len(batches))
+
+	limiter := newLimiter(r.Rate)
+	progress := startProgress("keys", len(r.KVWrites))
+	parallel(len(batches), r.Concurrency, func(i int) {
+		written[i], errs[i] = commitBatch(r, c, batches[i], limiter)
+		progress.add(len(batches[i].Keys))
+	})
+	progress.finish()
+
+	var committed, failed []*txnBatch
+	restoredKeyCount := 0
+	errorCount := 0
+	for i, batch := range batches {
+		if errs[i] != nil {
+			log.Printf("Unable to restore batch: %s, %v", batch, errs[i])
+			failed = append(failed, batch)
+			errorCount += len(batch.Keys)
+			continue
+		}
+		log.Printf("[DEBUG] Committed batch %s", batch)
+		committed = append(committed, batch)
+		restoredKeyCount += written[i]
+	}
+
+	log.Printf("[INFO] Restored %v keys with %v errors in %v of %v transactions",
+		restoredKeyCount, errorCount, len(committed), len(batches))
+	log.Printf("[INFO] Committed batches: %s", batchNumbers(committed))
+	for _, batch := range failed {
+		log.Printf("[ERR] Batch %s did not commit, its %v keys were not restored", batch, len(batch.Keys))
+	}
+	return errorCount
+}
+
+// commitBatch writes a batch in one transaction with check-and-set and
+// returns how many keys it wrote.  Keys that were changed in the cluster
+// since they were planned roll the transaction back, they are recorded as
+// conflicts and the rest of the batch is committed without them.  Other
+// operations failing, or requests consul refuses outright, fail the batch
+// straight away, and the remaining failures are retried.
+func commitBatch(r *Restore, c *consul.Consul, batch *txnBatch, limiter *rate.Limiter) (int, error) {
+	ops := make(consulapi.KVTxnOps, 0, len(batch.Keys))
+	for _, kv := range batch.Keys {
+		ops = append(ops, &consulapi.KVTxnOp{
+			Verb:  consulapi.KVCAS,
+			Key:   kv.Key,
+			Value: kv.Value,
+			Flags: kv.Flags,
+			Index: kv.ModifyIndex,
+		})
+	}
+
+	var err error
+	wait := txnRetryWait
+	for attempt := 1; attempt <= txnAttempts; {
+		if len(ops) == 0 {
+			return 0, nil
+		}
+
+		waitLimiter(limiter)
+		ok, resp, txnErr := c.Client.KVTxn(ops)
+		if txnErr == nil && ok {
+			keys := make([]string, 0, len(ops))
+			for _, op := range ops {
+				keys = append(keys, op.Key)
+			}
+			r.journal.record(keys...)
+			return len(ops), nil
+		}
+		if txnErr == nil {
+			if stale := staleOps(resp); len(stale) > 0 {
+				// stale operations that are not in the batch would have
+				// the same transaction sent again and again
+				remaining := dropStaleOps(r, batch, ops, stale)
+				if len(remaining) == len(ops) {
+					return 0, txnError(resp, ops)
+				}
+				ops = remaining
+				continue
+			}
+			if resp != nil && len(resp.Errors) > 0 {
+				return 0, txnError(resp, ops)
+			}
+			txnErr = txnError(resp, ops)
+		} else if permanentTxnError(txnErr) {
+			return 0, txnErr
+		}
+
+		err = txnErr
+		attempt++
+		if attempt <= txnAttempts {
+			log.Printf("[WARN] Retrying batch %v in %v, attempt %v of %v: %v", batch.Number, wait, attempt, txnAttempts, err)
+			time.Sleep(wait)
+			wait *= 2
+		}
+	}
+	return 0, err
+}
+
+// staleOps returns the indexes of the operations that failed their
+// check-and-set, or nothing if the transaction failed for another reason
+func staleOps(resp *consulapi.TxnResponse) map[int]bool {
+	if resp == nil || len(resp.Errors) == 0 {
+		return nil
+	}
+	stale := make(map[int]bool)
+	for _, txnErr := range resp.Errors {
+		if !strings.Contains(txnErr.What, "index is stale") {
+			return nil
+		}
+		stale[txnErr.OpIndex] = true
+	}
+	return stale
+}
+
+// dropStaleOps records the keys of stale operations as conflicts and
+// returns the remaining operations
+func dropStaleOps(r *Restore, batch *txnBatch, ops consulapi.KVTxnOps, stale map[int]bool) consulapi.KVTxnOps {
+	var remaining consulapi.KVTxnOps
+	for i, op := range ops {
+		if !stale[i] {
+			remaining = append(remaining, op)
+			continue
+		}
+		log.Printf("[WARN] Key %s in batch %v changed during the restore, leaving it alone", op.Key, batch.Number)
+		changedDuringRestore(r, &consulapi.KVPair{Key: op.Key, ModifyIndex: op.Index})
+	}
+	return remaining
+}
+
+// permanentTxnError reports whether retrying a failed request can not help
+func permanentTxnError(err error) bool {
+	for _, reason := range permanentTxnErrors {
+		if strings.Contains(err.Error(), reason) {
+			return true
+		}
+	}
+	return false
+}
+
+// txnError describes why consul rolled back a transaction
+func txnError(resp *consulapi.TxnResponse, ops consulapi.KVTxnOps) error {
+	if resp == nil || len(resp.Errors) == 0 {
+		return fmt.Errorf("transaction was rolled back")
+	}
+
+	var reasons []string
+	for _, txnErr := range resp.Errors {
+		if txnErr.OpIndex >= 0 && txnErr.OpIndex < len(ops) {
+			reasons = append(reasons, fmt.Sprintf("%s: %s", ops[txnErr.OpIndex].Key, txnErr.What))
+		} else {
+			reasons = append(reasons, txnErr.What)
+		}
+	}
+	return fmt.Errorf("transaction was rolled back: %s", strings.Join(reasons, "; "))
+}
+
+// batchNumbers formats batch numbers as ranges, e.g. "1-5, 7, 9-12"
+func batchNumbers(batches []*txnBatch) string {
+	if len(batches) == 0 {
+		return "none"
+	}
+
+	var ranges []string
+	start := batches[0].Number
+	end := start
+	for _, batch := range batches[1:] {
+		if batch.Number == end+1 {
+			end = batch.Number
+			continue
+		}
+		ranges = append(ranges, numberRange(start, end))
+		start, end = batch.Number, batch.Number
+	}
+	ranges = append(ranges, numberRange(start, end))
+	return strings.Join(ranges, ", ")
+}
+
+func numberRange(start, end int) string {
+	if start == end {
+		return fmt.Sprintf("%v", start)
+	}
+	return fmt.Sprintf("%v-%v", start, end)
+}
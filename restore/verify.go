@@ -0,0 +1,103 @@
+package restore
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"sort"
+
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/pshima/consul-snapshot/consul"
+)
+
+// Verification is the result of comparing the cluster with the backup after
+// a restore
+type Verification struct {
+	Checked    int
+	Missing    []string
+	Different  []string
+	Unexpected []string
+}
+
+// Failed reports whether the cluster does not hold what the backup held
+func (v *Verification) Failed() bool {
+	return len(v.Missing) > 0 || len(v.Different) > 0 || len(v.Unexpected) > 0
+}
+
+// verifyRestore lists the restored prefixes again and compares every key
+// with the backup.  Keys the conflict policy left alone are not expected to
+// match.  Live keys that are not in the backup are only unexpected after a
+// mirror restore, a merge leaves them in place on purpose.
+func verifyRestore(r *Restore, c *consul.Consul) (*Verification, error) {
+	// rewritten keys no longer live under the prefixes they were selected by
+	prefixes := r.KVFilter.IncludePrefixes
+	if len(prefixes) == 0 || len(r.Rewrites) > 0 {
+		prefixes = []string{""}
+	}
+	live := make(map[string]*consulapi.KVPair)
+	for _, prefix := range prefixes {
+		keys, err := c.Client.ListKeys(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to list keys to verify the restore: %v", err)
+		}
+		for _, kv := range keys {
+			live[kv.Key] = kv
+		}
+	}
+
+	leftAlone := make(map[string]bool)
+	for _, conflict := range r.Conflicts {
+		if conflict.Action != ConflictOverwritten {
+			leftAlone[conflict.Key] = true
+		}
+	}
+
+	result := &Verification{}
+	inBackup := make(map[string]bool, len(r.JSONData))
+	for _, kv := range r.JSONData {
+		inBackup[kv.Key] = true
+		if leftAlone[kv.Key] {
+			continue
+		}
+
+		result.Checked++
+		existing, ok := live[kv.Key]
+		switch {
+		case !ok:
+			result.Missing = append(result.Missing, kv.Key)
+		case !bytes.Equal(existing.Value, kv.Value) || existing.Flags != kv.Flags:
+			result.Different = append(result.Different, kv.Key)
+		}
+	}
+
+	if r.Mirror {
+		for key := range live {
+			if !inBackup[key] && r.inMirrorScope(key) {
+				result.Unexpected = append(result.Unexpected, key)
+			}
+		}
+		sort.Strings(result.Unexpected)
+	}
+	return result, nil
+}
+
+// reportVerification logs the keys that did not verify and returns an error
+// when there are any
+func reportVerification(v *Verification) error {
+	for _, key := range v.Missing {
+		log.Printf("[ERR] Verify: key %s is missing from the cluster", key)
+	}
+	for _, key := range v.Different {
+		log.Printf("[ERR] Verify: key %s differs from the backup", key)
+	}
+	for _, key := range v.Unexpected {
+		log.Printf("[ERR] Verify: key %s is not in the backup", key)
+	}
+
+	if v.Failed() {
+		return fmt.Errorf("Restore verification failed: %v missing, %v different and %v unexpected keys",
+			len(v.Missing), len(v.Different), len(v.Unexpected))
+	}
+	log.Printf("[INFO] Verified %v restored keys against the backup", v.Checked)
+	return nil
+}
@@ -0,0 +1,118 @@
+package restore
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// progressInterval is how often a running restore logs its progress
+var progressInterval = 10 * time.Second
+
+// newLimiter returns a limiter for requests per second, or nil when
+// requests are not limited
+func newLimiter(perSecond int) *rate.Limiter {
+	if perSecond <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(perSecond), 1)
+}
+
+// waitLimiter blocks until the limiter allows another request
+func waitLimiter(limiter *rate.Limiter) {
+	if limiter != nil {
+		limiter.Wait(context.Background())
+	}
+}
+
+// parallel calls work for every index below n from concurrency workers
+func parallel(n, concurrency int, work func(i int)) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				work(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+}
+
+// progress logs how far a restore has come and when it will finish
+type progress struct {
+	what  string
+	total int64
+	done  int64
+	start time.Time
+	stop  chan struct{}
+	wg    sync.WaitGroup
+}
+
+// startProgress logs the progress of restoring total items every
+// progressInterval until finish is called
+func startProgress(what string, total int) *progress {
+	p := &progress{
+		what:  what,
+		total: int64(total),
+		start: time.Now(),
+		stop:  make(chan struct{}),
+	}
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				log.Printf("[INFO] %s", p.String())
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+	return p
+}
+
+// add counts finished items
+func (p *progress) add(n int) {
+	atomic.AddInt64(&p.done, int64(n))
+}
+
+// finish stops logging progress
+func (p *progress) finish() {
+	close(p.stop)
+	p.wg.Wait()
+}
+
+// String describes the progress with the rate so far and an estimate of the
+// time left
+func (p *progress) String() string {
+	done := atomic.LoadInt64(&p.done)
+	elapsed := time.Since(p.start).Seconds()
+	if done == 0 || elapsed <= 0 {
+		return fmt.Sprintf("Restored 0 of %v %s", p.total, p.what)
+	}
+
+	perSecond := float64(done) / elapsed
+	eta := time.Duration(float64(p.total-done) / perSecond * float64(time.Second))
+	return fmt.Sprintf("Restored %v of %v %s (%.0f%%, %.0f %s/s, ETA %v)",
+		done, p.total, p.what, float64(done)*100/float64(p.total), perSecond, p.what, eta.Round(time.Second))
+}
@@ -0,0 +1,101 @@
+package rewrite
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pshima/consul-snapshot/filter"
+)
+
+// Rule replaces a key prefix, or drops the keys under it
+type Rule struct {
+	From string
+	To   string
+	Drop bool
+}
+
+// String formats a rule the way it is written in a rules file
+func (r Rule) String() string {
+	if r.Drop {
+		return "drop " + r.From
+	}
+	return r.From + " => " + r.To
+}
+
+// Rules are applied in order, the first rule whose prefix matches a key
+// decides what happens to it
+type Rules []Rule
+
+// Apply returns the new name of a key, and false if the key is dropped.
+// Keys no rule matches keep their name.
+func (rules Rules) Apply(key string) (string, bool) {
+	for _, rule := range rules {
+		if !strings.HasPrefix(key, rule.From) {
+			continue
+		}
+		if rule.Drop {
+			return "", false
+		}
+		return rule.To + strings.TrimPrefix(key, rule.From), true
+	}
+	return key, true
+}
+
+// ParseRule parses a from=to prefix replacement as given on the command line
+func ParseRule(value string) (Rule, error) {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+		return Rule{}, fmt.Errorf("Invalid rewrite %q, must be from=to", value)
+	}
+	return Rule{
+		From: filter.NormalizePrefix(strings.TrimSpace(parts[0])),
+		To:   filter.NormalizePrefix(strings.TrimSpace(parts[1])),
+	}, nil
+}
+
+// ParseFile reads rules from a file with one rule per line, either
+// "from => to" to replace a prefix or "drop prefix" to drop the keys under
+// it.  Blank lines and lines starting with # are ignored.
+func ParseFile(path string) (Rules, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open rewrite file: %v", err)
+	}
+	defer file.Close()
+
+	var rules Rules
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		rule, err := parseLine(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s line %v: %v", path, line, err)
+		}
+		rules = append(rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Unable to read rewrite file: %v", err)
+	}
+	return rules, nil
+}
+
+func parseLine(text string) (Rule, error) {
+	if fields := strings.Fields(text); len(fields) == 2 && fields[0] == "drop" {
+		return Rule{From: filter.NormalizePrefix(fields[1]), Drop: true}, nil
+	}
+
+	parts := strings.SplitN(text, "=>", 2)
+	if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+		return Rule{}, fmt.Errorf("invalid rule %q, must be \"from => to\" or \"drop prefix\"", text)
+	}
+	return Rule{
+		From: filter.NormalizePrefix(strings.TrimSpace(parts[0])),
+		To:   filter.NormalizePrefix(strings.TrimSpace(parts[1])),
+	}, nil
+}
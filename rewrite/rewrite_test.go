@@ -0,0 +1,79 @@
+package rewrite
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestApply(t *testing.T) {
+	rules := Rules{
+		{From: "prod/secrets/", Drop: true},
+		{From: "prod/", To: "staging/"},
+		{From: "prod/other/", To: "never/"},
+	}
+
+	cases := []struct {
+		key  string
+		want string
+		keep bool
+	}{
+		{"prod/web/config", "staging/web/config", true},
+		{"prod/other/key", "staging/other/key", true},
+		{"prod/secrets/db", "", false},
+		{"global", "global", true},
+	}
+	for _, tc := range cases {
+		got, keep := rules.Apply(tc.key)
+		if got != tc.want || keep != tc.keep {
+			t.Errorf("%s: expected %q %v, got %q %v", tc.key, tc.want, tc.keep, got, keep)
+		}
+	}
+}
+
+func TestParseRule(t *testing.T) {
+	rule, err := ParseRule("/prod/=staging/")
+	if err != nil {
+		t.Fatalf("ParseRule failed: %v", err)
+	}
+	if rule.From != "prod/" || rule.To != "staging/" || rule.Drop {
+		t.Errorf("unexpected rule %+v", rule)
+	}
+
+	for _, value := range []string{"prod/", "=staging/"} {
+		if _, err := ParseRule(value); err == nil {
+			t.Errorf("expected an error for %q", value)
+		}
+	}
+}
+
+func TestParseFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rewrite")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "rules")
+	contents := "# prod to staging\n\ndrop prod/secrets/\nprod/ => staging/\n"
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatalf("Unable to write rules: %v", err)
+	}
+
+	rules, err := ParseFile(path)
+	if err != nil {
+		t.Fatalf("ParseFile failed: %v", err)
+	}
+	if len(rules) != 2 || rules[0].String() != "drop prod/secrets/" || rules[1].String() != "prod/ => staging/" {
+		t.Errorf("unexpected rules %v", rules)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("prod/ -> staging/\n"), 0644); err != nil {
+		t.Fatalf("Unable to write rules: %v", err)
+	}
+	if _, err := ParseFile(path); err == nil || !strings.Contains(err.Error(), "line 1") {
+		t.Errorf("expected an error pointing at line 1, got %v", err)
+	}
+}